@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/tg123/docker-sshd/pkg/bridge"
+	"github.com/tg123/docker-sshd/pkg/crisshd"
+	"github.com/tg123/docker-sshd/pkg/sshauth"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/crypto/ssh"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+func main() {
+
+	config := struct {
+		ListenAddr string
+		Port       int
+		KeyFile    string
+		Cmd        string
+		Endpoint   string
+		SyncExec   bool
+		Share      bool
+		PickerUser string
+		Allow      cli.StringSlice
+		AuthKeys   string
+	}{}
+
+	log.SetLevel(log.DebugLevel)
+
+	app := &cli.App{
+		Name:  "cri-sshd",
+		Usage: "make kubernetes containers sshable through the cri runtime of the node, without the api server",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "address",
+				Aliases:     []string{"l"},
+				Value:       "0.0.0.0",
+				Usage:       "listening address",
+				Destination: &config.ListenAddr,
+			},
+			&cli.IntFlag{
+				Name:        "port",
+				Aliases:     []string{"p"},
+				Value:       2232,
+				Usage:       "listening port",
+				Destination: &config.Port,
+			},
+			&cli.StringFlag{
+				Name:        "server-key",
+				Aliases:     []string{"i"},
+				Usage:       "server key files, support wildcard",
+				Value:       "/etc/ssh/ssh_host_ed25519_key",
+				Destination: &config.KeyFile,
+			},
+			&cli.StringFlag{
+				Name:        "command",
+				Aliases:     []string{"c"},
+				Usage:       "default exec command",
+				Value:       "/bin/sh",
+				Destination: &config.Cmd,
+			},
+			&cli.StringFlag{
+				Name:        "runtime-endpoint",
+				Usage:       "cri runtime service endpoint, e.g. unix:///var/run/crio/crio.sock for cri-o",
+				Value:       crisshd.DefaultEndpoint,
+				Destination: &config.Endpoint,
+			},
+			&cli.BoolFlag{
+				Name:        "exec-sync",
+				Usage:       "run commands without a pty with ExecSync instead of the streaming server, stdin is not forwarded",
+				Destination: &config.SyncExec,
+			},
+			&cli.BoolFlag{
+				Name:        "share-sessions",
+				Usage:       "allow others to join interactive sessions with join+<id> username",
+				Destination: &config.Share,
+			},
+			&cli.StringFlag{
+				Name:        "picker-user",
+				Usage:       "username which shows a menu to pick the target, disabled if empty",
+				Value:       "pick",
+				Destination: &config.PickerUser,
+			},
+			&cli.StringSliceFlag{
+				Name:        "allow-target",
+				Usage:       "glob pattern of targets users may connect to, can be repeated, required, the allow-target option of a key narrows it",
+				Destination: &config.Allow,
+			},
+			&cli.StringFlag{
+				Name:        "authorized-keys",
+				Usage:       "only accept public keys in this authorized_keys file, the key comment is the user identity, required",
+				Destination: &config.AuthKeys,
+			},
+		},
+		Action: func(c *cli.Context) error {
+
+			// containers of every pod on the node are reachable, anonymous access is not offered
+			if config.AuthKeys == "" {
+				return fmt.Errorf("--authorized-keys is required")
+			}
+
+			if len(config.Allow.Value()) == 0 {
+				return fmt.Errorf("--allow-target is required")
+			}
+
+			conn, err := crisshd.Dial(config.Endpoint)
+			if err != nil {
+				return err
+			}
+			defer conn.Close()
+
+			runtime := runtimeapi.NewRuntimeServiceClient(conn)
+
+			privateBytes, err := os.ReadFile(config.KeyFile)
+			if err != nil {
+				return err
+			}
+
+			private, err := ssh.ParsePrivateKey(privateBytes)
+			if err != nil {
+				return err
+			}
+
+			keys, err := sshauth.LoadAuthorizedKeys(config.AuthKeys)
+			if err != nil {
+				return err
+			}
+
+			sshserver := &ssh.ServerConfig{
+				PublicKeyCallback: keys.PublicKeyCallback,
+			}
+
+			sshserver.AddHostKey(private)
+			addr := net.JoinHostPort(config.ListenAddr, fmt.Sprintf("%d", config.Port))
+			listener, err := net.Listen("tcp", addr)
+			if err != nil {
+				return err
+			}
+			defer listener.Close()
+
+			log.Printf("cri-sshd started, listening at %v, runtime endpoint %v", addr, config.Endpoint)
+
+			allow := bridge.TargetPolicy(config.Allow.Value())
+
+			newProvider := func(target string, id sshauth.Identity) (bridge.SessionProvider, error) {
+				c, err := crisshd.Resolve(context.Background(), runtime, target)
+				if err != nil {
+					return nil, err
+				}
+
+				if !allow(id, c.String()) {
+					return nil, fmt.Errorf("target [%v] is not allowed", c)
+				}
+
+				return crisshd.New(runtime, c.ID, crisshd.Options{
+					SyncExec: config.SyncExec,
+				})
+			}
+
+			newPicker := func(id sshauth.Identity) bridge.SessionProvider {
+				return bridge.NewPicker(bridge.FilterTargets(func(ctx context.Context) ([]bridge.Target, error) {
+					return crisshd.ListTargets(ctx, runtime)
+				}, func(target string) bool {
+					return allow(id, target)
+				}), func(target string) (bridge.SessionProvider, error) {
+					return newProvider(target, id)
+				})
+			}
+
+			registry := bridge.NewRegistry()
+
+			bridge.Serve(listener, sshserver, &bridge.BridgeConfig{
+				DefaultCmd:    config.Cmd,
+				Registry:      registry,
+				ShareSessions: config.Share,
+			}, func(sc *ssh.ServerConn) (bridge.SessionProvider, error) {
+				id, _ := sshauth.FromPermissions(sc.Permissions)
+
+				if config.PickerUser != "" && sc.User() == config.PickerUser {
+					return newPicker(id), nil
+				}
+
+				return newProvider(sc.User(), id)
+			})
+
+			return nil
+		},
+	}
+
+	if err := app.Run(os.Args); err != nil {
+		log.Fatal(err)
+	}
+}
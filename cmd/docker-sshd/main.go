@@ -1,17 +1,27 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net"
 	"os"
+	"strings"
+	"time"
 
+	"github.com/tg123/docker-sshd/pkg/admin"
 	"github.com/tg123/docker-sshd/pkg/bridge"
 	"github.com/tg123/docker-sshd/pkg/dockersshd"
+	"github.com/tg123/docker-sshd/pkg/localsshd"
+	"github.com/tg123/docker-sshd/pkg/sshauth"
+	"github.com/tg123/docker-sshd/pkg/webterm"
+	"github.com/tg123/docker-sshd/pkg/wsconn"
 
 	"github.com/docker/docker/client"
 	log "github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
 )
 
 func main() {
@@ -21,6 +31,35 @@ func main() {
 		Port       int
 		KeyFile    string
 		Cmd        string
+		WsAddr     string
+		WsPath     string
+		TLSCert    string
+		TLSKey     string
+		WebAddr    string
+		WebTokens  string
+		WebIssuer  string
+		WebClaim   string
+		WebRO      bool
+		Share      bool
+		AdminAddr  string
+		PickerUser string
+		Fallback   bool
+		Allow      cli.StringSlice
+		AuthKeys   string
+		DetachKeys string
+		Sandboxes  string
+		SandboxTTL time.Duration
+		SandboxImg string
+		AutoStart  bool
+		ExecUser   string
+		ExecDir    string
+		ExecTime   time.Duration
+		HostUser   string
+		HostGroup  string
+		JumpKey    string
+		JumpUser   string
+		JumpPort   int
+		JumpHosts  string
 	}{}
 
 	log.SetLevel(log.DebugLevel)
@@ -57,6 +96,160 @@ func main() {
 				Value:       "/bin/sh",
 				Destination: &config.Cmd,
 			},
+			&cli.StringFlag{
+				Name:        "websocket-address",
+				Usage:       "also accept ssh over websocket at this address, e.g. 0.0.0.0:8443, disabled if empty",
+				Destination: &config.WsAddr,
+			},
+			&cli.StringFlag{
+				Name:        "websocket-path",
+				Usage:       "http path of the websocket endpoint",
+				Value:       "/ssh",
+				Destination: &config.WsPath,
+			},
+			&cli.StringFlag{
+				Name:        "tls-cert",
+				Usage:       "tls certificate file for websocket listener, plain http if empty",
+				Destination: &config.TLSCert,
+			},
+			&cli.StringFlag{
+				Name:        "tls-key",
+				Usage:       "tls private key file for websocket listener",
+				Destination: &config.TLSKey,
+			},
+			&cli.StringFlag{
+				Name:        "web-address",
+				Usage:       "serve browser web terminal at this address, e.g. 0.0.0.0:8080, disabled if empty",
+				Destination: &config.WebAddr,
+			},
+			&cli.StringFlag{
+				Name:        "web-token-file",
+				Usage:       "web terminal bearer tokens, one \"token user\" per line",
+				Destination: &config.WebTokens,
+			},
+			&cli.StringFlag{
+				Name:        "web-oidc-issuer",
+				Usage:       "web terminal accepts access tokens of this oidc issuer",
+				Destination: &config.WebIssuer,
+			},
+			&cli.StringFlag{
+				Name:        "web-oidc-claim",
+				Usage:       "userinfo claim used as web terminal user name",
+				Value:       "preferred_username",
+				Destination: &config.WebClaim,
+			},
+			&cli.BoolFlag{
+				Name:        "web-readonly",
+				Usage:       "web terminal sessions are read-only",
+				Destination: &config.WebRO,
+			},
+			&cli.BoolFlag{
+				Name:        "share-sessions",
+				Usage:       "allow others to join interactive sessions with join+<id> username",
+				Destination: &config.Share,
+			},
+			&cli.StringFlag{
+				Name:        "admin-address",
+				Usage:       "serve admin api at loopback host:port or unix:/path/to/socket, disabled if empty",
+				Destination: &config.AdminAddr,
+			},
+			&cli.StringFlag{
+				Name:        "picker-user",
+				Usage:       "username which shows a menu to pick the target, disabled if empty",
+				Value:       "pick",
+				Destination: &config.PickerUser,
+			},
+			&cli.BoolFlag{
+				Name:        "picker-fallback",
+				Usage:       "show the picker menu when the username is not a valid target",
+				Destination: &config.Fallback,
+			},
+			&cli.StringSliceFlag{
+				Name:        "allow-target",
+				Usage:       "glob pattern of targets users may connect to, can be repeated, all allowed if empty, the allow-target option of a key narrows it",
+				Destination: &config.Allow,
+			},
+			&cli.StringFlag{
+				Name:        "authorized-keys",
+				Usage:       "only accept public keys in this authorized_keys file, the key comment is the user identity, anyone may connect if empty",
+				Destination: &config.AuthKeys,
+			},
+			&cli.StringFlag{
+				Name:        "detach-keys",
+				Usage:       "key sequence to detach from <target>+attach sessions without stopping the container",
+				Value:       dockersshd.DefaultDetachKeys,
+				Destination: &config.DetachKeys,
+			},
+			&cli.StringFlag{
+				Name:        "sandbox-templates",
+				Usage:       "json file of templates for sandbox:<template> usernames, a new container is created per connection, disabled if empty",
+				Destination: &config.Sandboxes,
+			},
+			&cli.DurationFlag{
+				Name:        "sandbox-timeout",
+				Usage:       "how long creating a sandbox container may take, including the image pull",
+				Value:       5 * time.Minute,
+				Destination: &config.SandboxTTL,
+			},
+			&cli.StringFlag{
+				Name:        "sandbox-image-template",
+				Usage:       "template used for sandbox:<image> usernames without a template of their own, lets users run any image, disabled if empty",
+				Destination: &config.SandboxImg,
+			},
+			&cli.BoolFlag{
+				Name:        "auto-start",
+				Usage:       "start or unpause the target container if it is not running",
+				Destination: &config.AutoStart,
+			},
+			&cli.StringFlag{
+				Name:        "exec-user",
+				Usage:       "user inside the container, user+target usernames may only choose this user or the exec-user of their key, image default if empty",
+				Destination: &config.ExecUser,
+			},
+			&cli.StringFlag{
+				Name:        "exec-workdir",
+				Usage:       "working directory inside the container, image default if empty",
+				Destination: &config.ExecDir,
+			},
+			&cli.DurationFlag{
+				Name:        "exec-timeout",
+				Usage:       "how long to wait for the exit code after the output of a command ends",
+				Value:       dockersshd.DefaultExecTimeout,
+				Destination: &config.ExecTime,
+			},
+			&cli.StringFlag{
+				Name:        "host-user",
+				Usage:       "username which runs commands on the docker host itself instead of a container, requires --authorized-keys, disabled if empty",
+				Destination: &config.HostUser,
+			},
+			&cli.StringFlag{
+				Name:        "host-group",
+				Usage:       "group an --authorized-keys identity must have to use --host-user, never allowed from the web terminal",
+				Value:       "host",
+				Destination: &config.HostGroup,
+			},
+			&cli.StringFlag{
+				Name:        "jump-key",
+				Usage:       "private key to log in to the sshd inside containers for <target>+sshd usernames, disabled if empty",
+				Destination: &config.JumpKey,
+			},
+			&cli.StringFlag{
+				Name:        "jump-user",
+				Usage:       "user of the sshd inside containers, user+target usernames choose another",
+				Value:       "root",
+				Destination: &config.JumpUser,
+			},
+			&cli.IntFlag{
+				Name:        "jump-port",
+				Usage:       "port of the sshd inside containers",
+				Value:       22,
+				Destination: &config.JumpPort,
+			},
+			&cli.StringFlag{
+				Name:        "jump-known-hosts",
+				Usage:       "known_hosts file to verify the sshd inside containers, any host key is accepted if empty",
+				Destination: &config.JumpHosts,
+			},
 		},
 		Action: func(c *cli.Context) error {
 
@@ -95,6 +288,25 @@ func main() {
 				},
 			}
 
+			if config.HostUser != "" && config.AuthKeys == "" {
+				return fmt.Errorf("--host-user requires --authorized-keys")
+			}
+
+			if config.HostUser != "" && config.HostGroup == "" {
+				return fmt.Errorf("--host-user requires --host-group")
+			}
+
+			if config.AuthKeys != "" {
+				keys, err := sshauth.LoadAuthorizedKeys(config.AuthKeys)
+				if err != nil {
+					return err
+				}
+
+				sshserver = &ssh.ServerConfig{
+					PublicKeyCallback: keys.PublicKeyCallback,
+				}
+			}
+
 			sshserver.AddHostKey(private)
 			addr := net.JoinHostPort(config.ListenAddr, fmt.Sprintf("%d", config.Port))
 			listener, err := net.Listen("tcp", addr)
@@ -105,26 +317,272 @@ func main() {
 
 			log.Printf("docker-sshd started, listening at %v", addr)
 
-			for {
-				c, err := listener.Accept()
+			allow := bridge.TargetPolicy(config.Allow.Value())
+
+			var jump *bridge.JumpConfig
+			if config.JumpKey != "" {
+				keyBytes, err := os.ReadFile(config.JumpKey)
+				if err != nil {
+					return err
+				}
+
+				signer, err := ssh.ParsePrivateKey(keyBytes)
+				if err != nil {
+					return err
+				}
+
+				hostKeyCallback := ssh.InsecureIgnoreHostKey()
+				if config.JumpHosts != "" {
+					hostKeyCallback, err = knownhosts.New(config.JumpHosts)
+					if err != nil {
+						return err
+					}
+				} else {
+					log.Warnf("--jump-known-hosts is not set, host keys of the sshd inside containers are not verified")
+				}
+
+				jump = &bridge.JumpConfig{
+					User:            config.JumpUser,
+					Port:            config.JumpPort,
+					Signer:          signer,
+					HostKeyCallback: hostKeyCallback,
+					ExecTimeout:     config.ExecTime,
+				}
+			}
+
+			var sandboxes dockersshd.SandboxTemplates
+			if config.Sandboxes != "" {
+				sandboxes, err = dockersshd.LoadSandboxTemplates(config.Sandboxes)
+				if err != nil {
+					return err
+				}
+			}
+
+			if _, ok := sandboxes[config.SandboxImg]; config.SandboxImg != "" && !ok {
+				return fmt.Errorf("--sandbox-image-template %v is not a template of --sandbox-templates", config.SandboxImg)
+			}
+
+			// ctx ends with the connection, the container is removed by Close of the provider afterwards
+			newTarget := func(ctx context.Context, target string, attach bool, id sshauth.Identity) (bridge.SessionProvider, error) {
+				if name, ok := dockersshd.IsSandbox(target); ok && sandboxes != nil {
+					if !allow(id, target) {
+						return nil, fmt.Errorf("target [%v] is not allowed", target)
+					}
+
+					t, err := sandboxes.Lookup(name, config.SandboxImg)
+					if err != nil {
+						return nil, err
+					}
+
+					ctx, cancel := context.WithTimeout(ctx, config.SandboxTTL)
+					defer cancel()
+
+					return dockersshd.NewSandbox(ctx, dockercli, t)
+				}
+
+				c, err := dockersshd.Resolve(ctx, dockercli, target)
+				if err != nil {
+					return nil, err
+				}
+
+				if !allow(id, c.Name) {
+					return nil, fmt.Errorf("target [%v] is not allowed", c.Name)
+				}
+
+				opts := dockersshd.Options{
+					AutoStart:  config.AutoStart,
+					DetachKeys: config.DetachKeys,
+				}
+
+				if attach {
+					return dockersshd.NewAttach(dockercli, c.ID, opts)
+				}
+
+				return dockersshd.New(dockercli, c.ID, opts)
+			}
+
+			// isHost reports whether the username is the host user, with or without user+ and suffixes
+			isHost := func(user string) bool {
+				target, _ := strings.CutSuffix(user, bridge.JumpSuffix)
+				target, _ = strings.CutSuffix(target, dockersshd.AttachSuffix)
+				_, target = bridge.CutExecUser(target)
+
+				return config.HostUser != "" && target == config.HostUser
+			}
+
+			newProvider := func(ctx context.Context, target string, id sshauth.Identity) (bridge.SessionProvider, error) {
+				target, sshd := strings.CutSuffix(target, bridge.JumpSuffix)
+				if sshd && jump == nil {
+					return nil, fmt.Errorf("%v is disabled, use ssh -J instead", bridge.JumpSuffix)
+				}
+
+				target, attach := strings.CutSuffix(target, dockersshd.AttachSuffix)
+				requested, target := bridge.CutExecUser(target)
+
+				execUser, err := id.ExecUser(requested, config.ExecUser)
 				if err != nil {
-					log.Printf("failed to accept connection: %v", err)
-					continue
+					return nil, err
+				}
+
+				var provider bridge.SessionProvider
+				if config.HostUser != "" && target == config.HostUser && !attach {
+					if !allow(id, target) {
+						return nil, fmt.Errorf("target [%v] is not allowed", target)
+					}
+
+					if !id.InGroup(config.HostGroup) {
+						return nil, fmt.Errorf("%v is not in group %v required for host access", id.Name, config.HostGroup)
+					}
+
+					provider, err = localsshd.New()
+				} else {
+					provider, err = newTarget(ctx, target, attach, id)
+				}
+
+				if err != nil {
+					return nil, err
+				}
+
+				if sshd {
+					provider = bridge.NewJump(provider, *jump)
+				}
+
+				return bridge.WithExecDefaults(provider, execUser, config.ExecDir), nil
+			}
+
+			newPicker := func(id sshauth.Identity) bridge.SessionProvider {
+				return bridge.NewPicker(bridge.FilterTargets(func(ctx context.Context) ([]bridge.Target, error) {
+					return dockersshd.ListTargets(ctx, dockercli)
+				}, func(target string) bool {
+					return allow(id, target)
+				}), func(target string) (bridge.SessionProvider, error) {
+					return newProvider(context.Background(), target, id)
+				})
+			}
+
+			isPicker := func(user string) bool {
+				if config.PickerUser != "" && user == config.PickerUser {
+					return true
+				}
+
+				if !config.Fallback {
+					return false
 				}
 
-				b, err := bridge.New(c, sshserver, &bridge.BridgeConfig{
-					DefaultCmd: config.Cmd,
+				if isHost(user) {
+					return false
+				}
+
+				target, _ := strings.CutSuffix(user, bridge.JumpSuffix)
+				target, _ = strings.CutSuffix(target, dockersshd.AttachSuffix)
+				_, target = bridge.CutExecUser(target)
+
+				_, err := dockersshd.Resolve(context.Background(), dockercli, target)
+				return errors.Is(err, dockersshd.ErrNotFound)
+			}
+
+			registry := bridge.NewRegistry()
+
+			// the handshake and creating the provider, e.g. pulling a sandbox image, must not hold up other connections
+			serve := func(listener net.Listener) {
+				bridge.Serve(listener, sshserver, &bridge.BridgeConfig{
+					DefaultCmd:    config.Cmd,
+					ExecTimeout:   config.ExecTime,
+					Registry:      registry,
+					ShareSessions: config.Share,
 				}, func(sc *ssh.ServerConn) (bridge.SessionProvider, error) {
-					return dockersshd.New(dockercli, sc.User())
+					id, _ := sshauth.FromPermissions(sc.Permissions)
+
+					if isPicker(sc.User()) {
+						return newPicker(id), nil
+					}
+
+					ctx, cancel := context.WithCancel(context.Background())
+					defer cancel()
+
+					// stop creating the provider when the client goes away
+					go func() {
+						_ = sc.Wait()
+						cancel()
+					}()
+
+					return newProvider(ctx, sc.User(), id)
+				})
+			}
+
+			if config.WsAddr != "" {
+				wslistener, err := wsconn.Listen(config.WsAddr, config.WsPath, config.TLSCert, config.TLSKey)
+				if err != nil {
+					return err
+				}
+				defer wslistener.Close()
+
+				log.Printf("docker-sshd websocket listening at %v%v", config.WsAddr, config.WsPath)
+
+				go serve(wslistener)
+			}
+
+			if config.WebAddr != "" {
+				var auth webterm.Authenticator
+
+				switch {
+				case config.WebIssuer != "":
+					auth, err = webterm.OIDC(c.Context, config.WebIssuer, config.WebClaim)
+				case config.WebTokens != "":
+					auth, err = webterm.LoadTokenFile(config.WebTokens)
+				default:
+					err = fmt.Errorf("web terminal requires --web-token-file or --web-oidc-issuer")
+				}
+
+				if err != nil {
+					return err
+				}
+
+				web, err := webterm.New(webterm.Config{
+					DefaultCmd:    config.Cmd,
+					Authenticator: auth,
+					ReadOnly:      config.WebRO,
+					Registry:      registry,
+					NewProvider: func(ctx context.Context, user, target string) (bridge.SessionProvider, error) {
+						// web users have no key and no groups, the host shell is reachable by ssh only
+						if isHost(target) {
+							return nil, fmt.Errorf("host access is not available from the web terminal")
+						}
+
+						return newProvider(ctx, target, sshauth.Identity{Name: user})
+					},
 				})
+				if err != nil {
+					return err
+				}
+
+				log.Printf("docker-sshd web terminal listening at %v", config.WebAddr)
 
+				go func() {
+					if err := web.ListenAndServe(config.WebAddr, config.TLSCert, config.TLSKey); err != nil {
+						log.Errorf("web terminal stopped: %v", err)
+					}
+				}()
+			}
+
+			if config.AdminAddr != "" {
+				adminlistener, err := admin.Listen(config.AdminAddr)
 				if err != nil {
-					log.Printf("failed to establish ssh connection: %v", err)
-					continue
+					return err
 				}
+				defer adminlistener.Close()
 
-				go b.Start()
+				log.Printf("docker-sshd admin api listening at %v", config.AdminAddr)
+
+				go func() {
+					if err := admin.New(registry).Serve(adminlistener); err != nil {
+						log.Errorf("admin api stopped: %v", err)
+					}
+				}()
 			}
+
+			serve(listener)
+			return nil
 		},
 	}
 
@@ -1,13 +1,20 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"os"
 	"strings"
+	"time"
 
+	"github.com/tg123/docker-sshd/pkg/admin"
 	"github.com/tg123/docker-sshd/pkg/bridge"
 	"github.com/tg123/docker-sshd/pkg/kubesshd"
+	"github.com/tg123/docker-sshd/pkg/sshauth"
+	"github.com/tg123/docker-sshd/pkg/webterm"
+	"github.com/tg123/docker-sshd/pkg/wsconn"
+	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/clientcmd"
 
 	log "github.com/sirupsen/logrus"
@@ -22,7 +29,32 @@ func main() {
 		Port       int
 		KeyFile    string
 		Cmd        string
+		WsAddr     string
+		WsPath     string
+		TLSCert    string
+		TLSKey     string
+		WebAddr    string
+		WebTokens  string
+		WebIssuer  string
+		WebClaim   string
+		WebRO      bool
+		Share      bool
+		AdminAddr  string
+		PickerUser string
+		Fallback   bool
+		Allow      cli.StringSlice
+		AuthKeys   string
 		Namespace  string
+		Strategy   string
+		Imperson   bool
+		Review     bool
+		Context    string
+		Multi      bool
+		DebugImage string
+		ExecUser   string
+		ExecDir    string
+		Wrapper    string
+		ResolveTO  time.Duration
 	}{}
 
 	app := &cli.App{
@@ -57,22 +89,149 @@ func main() {
 				Value:       "/bin/sh",
 				Destination: &config.Cmd,
 			},
+			&cli.StringFlag{
+				Name:        "websocket-address",
+				Usage:       "also accept ssh over websocket at this address, e.g. 0.0.0.0:8443, disabled if empty",
+				Destination: &config.WsAddr,
+			},
+			&cli.StringFlag{
+				Name:        "websocket-path",
+				Usage:       "http path of the websocket endpoint",
+				Value:       "/ssh",
+				Destination: &config.WsPath,
+			},
+			&cli.StringFlag{
+				Name:        "tls-cert",
+				Usage:       "tls certificate file for websocket listener, plain http if empty",
+				Destination: &config.TLSCert,
+			},
+			&cli.StringFlag{
+				Name:        "tls-key",
+				Usage:       "tls private key file for websocket listener",
+				Destination: &config.TLSKey,
+			},
+			&cli.StringFlag{
+				Name:        "web-address",
+				Usage:       "serve browser web terminal at this address, e.g. 0.0.0.0:8080, disabled if empty",
+				Destination: &config.WebAddr,
+			},
+			&cli.StringFlag{
+				Name:        "web-token-file",
+				Usage:       "web terminal bearer tokens, one \"token user\" per line",
+				Destination: &config.WebTokens,
+			},
+			&cli.StringFlag{
+				Name:        "web-oidc-issuer",
+				Usage:       "web terminal accepts access tokens of this oidc issuer",
+				Destination: &config.WebIssuer,
+			},
+			&cli.StringFlag{
+				Name:        "web-oidc-claim",
+				Usage:       "userinfo claim used as web terminal user name",
+				Value:       "preferred_username",
+				Destination: &config.WebClaim,
+			},
+			&cli.BoolFlag{
+				Name:        "web-readonly",
+				Usage:       "web terminal sessions are read-only",
+				Destination: &config.WebRO,
+			},
+			&cli.BoolFlag{
+				Name:        "share-sessions",
+				Usage:       "allow others to join interactive sessions with join+<id> username",
+				Destination: &config.Share,
+			},
+			&cli.StringFlag{
+				Name:        "admin-address",
+				Usage:       "serve admin api at loopback host:port or unix:/path/to/socket, disabled if empty",
+				Destination: &config.AdminAddr,
+			},
+			&cli.StringFlag{
+				Name:        "picker-user",
+				Usage:       "username which shows a menu to pick the target, disabled if empty",
+				Value:       "pick",
+				Destination: &config.PickerUser,
+			},
+			&cli.BoolFlag{
+				Name:        "picker-fallback",
+				Usage:       "show the picker menu when the username is not a valid target",
+				Destination: &config.Fallback,
+			},
+			&cli.StringSliceFlag{
+				Name:        "allow-target",
+				Usage:       "glob pattern of targets users may connect to, can be repeated, all allowed if empty, the allow-target option of a key narrows it",
+				Destination: &config.Allow,
+			},
+			&cli.StringFlag{
+				Name:        "authorized-keys",
+				Usage:       "only accept public keys in this authorized_keys file, the key comment is the user identity, anyone may connect if empty",
+				Destination: &config.AuthKeys,
+			},
 			&cli.StringFlag{
 				Name:        "namespace",
 				Usage:       "kubernetes namespace",
 				Value:       "default",
 				Destination: &config.Namespace,
 			},
+			&cli.StringFlag{
+				Name:        "pick-strategy",
+				Usage:       "pod picked for workload targets such as deploy/name: first, random or newest ready pod",
+				Value:       "first",
+				Destination: &config.Strategy,
+			},
+			&cli.BoolFlag{
+				Name:        "impersonate",
+				Usage:       "exec as the authenticated identity and its groups instead of kube-sshd's own credentials, requires --authorized-keys or web terminal",
+				Destination: &config.Imperson,
+			},
+			&cli.BoolFlag{
+				Name:        "access-review",
+				Usage:       "check with SubjectAccessReview that the authenticated identity may create pods/exec (pods/portforward for forwarding), requires --authorized-keys or web terminal",
+				Destination: &config.Review,
+			},
+			&cli.StringFlag{
+				Name:        "context",
+				Usage:       "kubeconfig context, current-context if empty",
+				Destination: &config.Context,
+			},
+			&cli.BoolFlag{
+				Name:        "multi-cluster",
+				Usage:       "select kubeconfig context by username prefix, e.g. context/namespace/pod/container",
+				Destination: &config.Multi,
+			},
+			&cli.StringFlag{
+				Name:        "debug-image",
+				Usage:       "image of the ephemeral container started for <target>+debug usernames, e.g. busybox, disabled if empty",
+				Destination: &config.DebugImage,
+			},
+			&cli.StringFlag{
+				Name:        "exec-user",
+				Usage:       "user inside the container, user+target usernames may only choose this user or the exec-user of their key, image default if empty",
+				Destination: &config.ExecUser,
+			},
+			&cli.StringFlag{
+				Name:        "exec-workdir",
+				Usage:       "working directory inside the container, image default if empty",
+				Destination: &config.ExecDir,
+			},
+			&cli.StringFlag{
+				Name:        "user-wrapper",
+				Usage:       "command prepended to run as the exec user, {user} is replaced",
+				Value:       strings.Join(kubesshd.UserWrapper, " "),
+				Destination: &config.Wrapper,
+			},
+			&cli.DurationFlag{
+				Name:        "resolve-timeout",
+				Usage:       "time allowed to resolve the target and review the access of a connection",
+				Value:       30 * time.Second,
+				Destination: &config.ResolveTO,
+			},
 		},
 		Action: func(c *cli.Context) error {
 
-			kubeConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
-				clientcmd.NewDefaultClientConfigLoadingRules(),
-				&clientcmd.ConfigOverrides{},
-			)
+			clusters := kubesshd.NewClusters(clientcmd.NewDefaultClientConfigLoadingRules(), config.Context)
 
-			kubeClientConfig, err := kubeConfig.ClientConfig()
-			if err != nil {
+			if _, err := clusters.Get(""); err != nil {
 				return err
 			}
 
@@ -106,6 +265,17 @@ func main() {
 				},
 			}
 
+			if config.AuthKeys != "" {
+				keys, err := sshauth.LoadAuthorizedKeys(config.AuthKeys)
+				if err != nil {
+					return err
+				}
+
+				sshserver = &ssh.ServerConfig{
+					PublicKeyCallback: keys.PublicKeyCallback,
+				}
+			}
+
 			sshserver.AddHostKey(private)
 			addr := net.JoinHostPort(config.ListenAddr, fmt.Sprintf("%d", config.Port))
 			listener, err := net.Listen("tcp", addr)
@@ -116,51 +286,265 @@ func main() {
 
 			log.Printf("kube-sshd started, listening at %v", addr)
 
-			for {
-				c, err := listener.Accept()
+			strategy, err := kubesshd.ParsePickStrategy(config.Strategy)
+			if err != nil {
+				return err
+			}
+
+			allow := bridge.TargetPolicy(config.Allow.Value())
+
+			kubesshd.UserWrapper = strings.Fields(config.Wrapper)
+
+			if (config.Imperson || config.Review) && config.AuthKeys == "" && config.WebAddr == "" {
+				return fmt.Errorf("--impersonate and --access-review require --authorized-keys or --web-address")
+			}
+
+			// split returns the cluster of user and the target without context prefix
+			split := func(user string) (*kubesshd.Cluster, string, error) {
+				kubecontext := ""
+				if config.Multi {
+					kubecontext, user = clusters.Split(user)
+				}
+
+				cluster, err := clusters.Get(kubecontext)
+				return cluster, user, err
+			}
+
+			newProvider := func(ctx context.Context, target string, id sshauth.Identity) (bridge.SessionProvider, error) {
+				target, debug := strings.CutSuffix(target, kubesshd.DebugSuffix)
+				if debug && config.DebugImage == "" {
+					return nil, fmt.Errorf("debug containers are disabled, start kube-sshd with --debug-image")
+				}
+
+				requested, target := bridge.CutExecUser(target)
+
+				execUser, err := id.ExecUser(requested, config.ExecUser)
 				if err != nil {
-					log.Printf("failed to accept connection: %v", err)
-					continue
+					return nil, err
 				}
 
-				b, err := bridge.New(c, sshserver, &bridge.BridgeConfig{
-					DefaultCmd: config.Cmd,
-				}, func(sc *ssh.ServerConn) (bridge.SessionProvider, error) {
+				cluster, target, err := split(target)
+				if err != nil {
+					return nil, err
+				}
 
-					full := sc.User()
+				t := kubesshd.ParseTarget(target, config.Namespace)
 
-					parts := strings.Split(full, "/")
+				if (config.Imperson || config.Review) && id.Name == "" {
+					return nil, fmt.Errorf("an authenticated identity is required")
+				}
 
-					ns := config.Namespace
-					pod := full
-					container := ""
+				// with impersonation, resolving the target is also subject to the rbac of the identity
+				restConfig := cluster.Config
+				clientset := cluster.Clientset
+				if config.Imperson {
+					restConfig = kubesshd.Impersonate(cluster.Config, id.Name, id.Groups)
 
-					switch len(parts) {
-					case 2: // Format: pod/container
-						pod = parts[0]
-						container = parts[1]
-					case 3: // Format: namespace/pod/container
-						ns = parts[0]
-						pod = parts[1]
-						container = parts[2]
-					default:
+					clientset, err = kubernetes.NewForConfig(restConfig)
+					if err != nil {
+						return nil, err
 					}
+				}
+
+				resolver := &kubesshd.Resolver{
+					Clientset: clientset,
+					Strategy:  strategy,
+				}
 
-					kube, err := kubesshd.New(kubeClientConfig, ns, pod, container)
+				pod, err := resolver.Resolve(ctx, t)
+				if err != nil {
+					return nil, err
+				}
+
+				name := t.Namespace + "/" + pod
+				if cluster.Context != config.Context {
+					name = cluster.Context + "/" + name
+				}
+
+				if !allow(id, name) {
+					return nil, fmt.Errorf("target [%v] is not allowed", name)
+				}
+
+				container, err := resolver.Container(ctx, t.Namespace, pod, t.Container)
+				if err != nil {
+					return nil, err
+				}
+
+				var provider bridge.SessionProvider
+				if debug {
+					provider, err = kubesshd.NewDebug(restConfig, t.Namespace, pod, container, config.DebugImage)
+				} else {
+					provider, err = kubesshd.New(restConfig, t.Namespace, pod, container)
+				}
+				if err != nil {
+					return nil, err
+				}
+
+				if config.Review {
+					reviewer := &kubesshd.AccessReviewer{
+						Clientset: cluster.Clientset,
+					}
+
+					review := func(ctx context.Context, subresource string) error {
+						return reviewer.Review(ctx, id.Name, id.Groups, t.Namespace, pod, subresource)
+					}
+
+					// debug containers are added by the daemon, the identity must be allowed to add them too
+					subresources := []string{kubesshd.SubresourceExec}
+					if debug {
+						subresources = []string{kubesshd.SubresourceEphemeralContainers, kubesshd.SubresourceAttach}
+					}
+
+					for _, subresource := range subresources {
+						if err := review(ctx, subresource); err != nil {
+							return nil, err
+						}
+					}
+
+					provider = kubesshd.WithReview(provider, review)
+				}
+
+				return bridge.WithExecDefaults(provider, execUser, config.ExecDir), nil
+			}
+
+			newPicker := func(id sshauth.Identity) bridge.SessionProvider {
+				return bridge.NewPicker(bridge.FilterTargets(func(ctx context.Context) ([]bridge.Target, error) {
+					cluster, err := clusters.Get("")
 					if err != nil {
 						return nil, err
 					}
 
-					return kube, nil
+					return kubesshd.ListTargets(ctx, cluster.Clientset, config.Namespace)
+				}, func(pod string) bool {
+					return allow(id, config.Namespace+"/"+pod)
+				}), func(target string) (bridge.SessionProvider, error) {
+					ctx, cancel := context.WithTimeout(context.Background(), config.ResolveTO)
+					defer cancel()
+
+					return newProvider(ctx, target, id)
+				})
+			}
+
+			isPicker := func(ctx context.Context, user string) bool {
+				if config.PickerUser != "" && user == config.PickerUser {
+					return true
+				}
+
+				if !config.Fallback {
+					return false
+				}
+
+				user, _ = strings.CutSuffix(user, kubesshd.DebugSuffix)
+				_, user = bridge.CutExecUser(user)
+
+				cluster, target, err := split(user)
+				if err != nil {
+					return false
+				}
+
+				t := kubesshd.ParseTarget(target, config.Namespace)
+				return t.Kind == "" && t.Selector == "" && !kubesshd.Exists(ctx, cluster.Clientset, t.Namespace, t.Name)
+			}
+
+			registry := bridge.NewRegistry()
+
+			// the handshake and resolving the target must not hold up other connections
+			serve := func(listener net.Listener) {
+				bridge.Serve(listener, sshserver, &bridge.BridgeConfig{
+					DefaultCmd:    config.Cmd,
+					Registry:      registry,
+					ShareSessions: config.Share,
+				}, func(sc *ssh.ServerConn) (bridge.SessionProvider, error) {
+					id, _ := sshauth.FromPermissions(sc.Permissions)
+
+					ctx, cancel := context.WithTimeout(context.Background(), config.ResolveTO)
+					defer cancel()
+
+					// stop resolving when the client goes away
+					go func() {
+						_ = sc.Wait()
+						cancel()
+					}()
+
+					if isPicker(ctx, sc.User()) {
+						return newPicker(id), nil
+					}
+
+					return newProvider(ctx, sc.User(), id)
+				})
+			}
+
+			if config.WsAddr != "" {
+				wslistener, err := wsconn.Listen(config.WsAddr, config.WsPath, config.TLSCert, config.TLSKey)
+				if err != nil {
+					return err
+				}
+				defer wslistener.Close()
+
+				log.Printf("kube-sshd websocket listening at %v%v", config.WsAddr, config.WsPath)
+
+				go serve(wslistener)
+			}
+
+			if config.WebAddr != "" {
+				var auth webterm.Authenticator
+
+				switch {
+				case config.WebIssuer != "":
+					auth, err = webterm.OIDC(c.Context, config.WebIssuer, config.WebClaim)
+				case config.WebTokens != "":
+					auth, err = webterm.LoadTokenFile(config.WebTokens)
+				default:
+					err = fmt.Errorf("web terminal requires --web-token-file or --web-oidc-issuer")
+				}
+
+				if err != nil {
+					return err
+				}
+
+				web, err := webterm.New(webterm.Config{
+					DefaultCmd:    config.Cmd,
+					Authenticator: auth,
+					ReadOnly:      config.WebRO,
+					Registry:      registry,
+					NewProvider: func(ctx context.Context, user, target string) (bridge.SessionProvider, error) {
+						ctx, cancel := context.WithTimeout(ctx, config.ResolveTO)
+						defer cancel()
+
+						return newProvider(ctx, target, sshauth.Identity{Name: user})
+					},
 				})
+				if err != nil {
+					return err
+				}
+
+				log.Printf("kube-sshd web terminal listening at %v", config.WebAddr)
 
+				go func() {
+					if err := web.ListenAndServe(config.WebAddr, config.TLSCert, config.TLSKey); err != nil {
+						log.Errorf("web terminal stopped: %v", err)
+					}
+				}()
+			}
+
+			if config.AdminAddr != "" {
+				adminlistener, err := admin.Listen(config.AdminAddr)
 				if err != nil {
-					log.Printf("failed to establish ssh connection: %v", err)
-					continue
+					return err
 				}
+				defer adminlistener.Close()
+
+				log.Printf("kube-sshd admin api listening at %v", config.AdminAddr)
 
-				go b.Start()
+				go func() {
+					if err := admin.New(registry).Serve(adminlistener); err != nil {
+						log.Errorf("admin api stopped: %v", err)
+					}
+				}()
 			}
+
+			serve(listener)
+			return nil
 		},
 	}
 
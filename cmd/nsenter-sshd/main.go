@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/tg123/docker-sshd/pkg/bridge"
+	"github.com/tg123/docker-sshd/pkg/nsentersshd"
+	"github.com/tg123/docker-sshd/pkg/sshauth"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/crypto/ssh"
+)
+
+func main() {
+
+	config := struct {
+		ListenAddr string
+		Port       int
+		KeyFile    string
+		Cmd        string
+		Namespaces cli.StringSlice
+		Share      bool
+		Allow      cli.StringSlice
+		AuthKeys   string
+		ExecUser   string
+		ExecDir    string
+		AllowHost  bool
+	}{}
+
+	log.SetLevel(log.DebugLevel)
+
+	app := &cli.App{
+		Name:  "nsenter-sshd",
+		Usage: "make processes in linux namespaces sshable, e.g. systemd-nspawn machines",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "address",
+				Aliases:     []string{"l"},
+				Value:       "0.0.0.0",
+				Usage:       "listening address",
+				Destination: &config.ListenAddr,
+			},
+			&cli.IntFlag{
+				Name:        "port",
+				Aliases:     []string{"p"},
+				Value:       2232,
+				Usage:       "listening port",
+				Destination: &config.Port,
+			},
+			&cli.StringFlag{
+				Name:        "server-key",
+				Aliases:     []string{"i"},
+				Usage:       "server key files, support wildcard",
+				Value:       "/etc/ssh/ssh_host_ed25519_key",
+				Destination: &config.KeyFile,
+			},
+			&cli.StringFlag{
+				Name:        "command",
+				Aliases:     []string{"c"},
+				Usage:       "default exec command",
+				Value:       "/bin/sh",
+				Destination: &config.Cmd,
+			},
+			&cli.StringSliceFlag{
+				Name:        "namespace",
+				Usage:       "namespaces to enter, can be repeated, as nsenter options e.g. mount, pid, net, uts, ipc, cgroup, user",
+				Value:       cli.NewStringSlice(nsentersshd.DefaultNamespaces...),
+				Destination: &config.Namespaces,
+			},
+			&cli.BoolFlag{
+				Name:        "share-sessions",
+				Usage:       "allow others to join interactive sessions with join+<id> username",
+				Destination: &config.Share,
+			},
+			&cli.StringSliceFlag{
+				Name:        "allow-target",
+				Usage:       "glob pattern of targets users may connect to, can be repeated, required, the allow-target option of a key narrows it",
+				Destination: &config.Allow,
+			},
+			&cli.StringFlag{
+				Name:        "authorized-keys",
+				Usage:       "only accept public keys in this authorized_keys file, the key comment is the user identity, required",
+				Destination: &config.AuthKeys,
+			},
+			&cli.BoolFlag{
+				Name:        "allow-host-namespaces",
+				Usage:       "allow targets in the mount or pid namespace of the host, which gives a root shell on the host",
+				Destination: &config.AllowHost,
+			},
+			&cli.StringFlag{
+				Name:        "exec-user",
+				Usage:       "uid or uid:gid inside the namespaces, user+target usernames may only choose this user or the exec-user of their key, root if empty",
+				Destination: &config.ExecUser,
+			},
+			&cli.StringFlag{
+				Name:        "exec-workdir",
+				Usage:       "working directory inside the mount namespace, working directory of the target process if empty",
+				Destination: &config.ExecDir,
+			},
+		},
+		Action: func(c *cli.Context) error {
+
+			// targets are entered as root, unlike the other sshds there is no anonymous mode
+			if config.AuthKeys == "" {
+				return fmt.Errorf("--authorized-keys is required")
+			}
+
+			if len(config.Allow.Value()) == 0 {
+				return fmt.Errorf("--allow-target is required")
+			}
+
+			privateBytes, err := os.ReadFile(config.KeyFile)
+			if err != nil {
+				return err
+			}
+
+			private, err := ssh.ParsePrivateKey(privateBytes)
+			if err != nil {
+				return err
+			}
+
+			keys, err := sshauth.LoadAuthorizedKeys(config.AuthKeys)
+			if err != nil {
+				return err
+			}
+
+			sshserver := &ssh.ServerConfig{
+				PublicKeyCallback: keys.PublicKeyCallback,
+			}
+
+			sshserver.AddHostKey(private)
+			addr := net.JoinHostPort(config.ListenAddr, fmt.Sprintf("%d", config.Port))
+			listener, err := net.Listen("tcp", addr)
+			if err != nil {
+				return err
+			}
+			defer listener.Close()
+
+			log.Printf("nsenter-sshd started, listening at %v", addr)
+
+			allow := bridge.TargetPolicy(config.Allow.Value())
+
+			newProvider := func(target string, id sshauth.Identity) (bridge.SessionProvider, error) {
+				requested, target := bridge.CutExecUser(target)
+
+				execUser, err := id.ExecUser(requested, config.ExecUser)
+				if err != nil {
+					return nil, err
+				}
+
+				// 0042 or cgroup:a/../b must not slip past patterns of the canonical form
+				target, err = nsentersshd.Normalize(target)
+				if err != nil {
+					return nil, err
+				}
+
+				if !allow(id, target) {
+					return nil, fmt.Errorf("target [%v] is not allowed", target)
+				}
+
+				pid, err := nsentersshd.Resolve(context.Background(), target)
+				if err != nil {
+					return nil, err
+				}
+
+				provider, err := nsentersshd.New(pid, nsentersshd.Options{
+					Namespaces: config.Namespaces.Value(),
+					AllowHost:  config.AllowHost,
+				})
+				if err != nil {
+					return nil, err
+				}
+
+				return bridge.WithExecDefaults(provider, execUser, config.ExecDir), nil
+			}
+
+			registry := bridge.NewRegistry()
+
+			bridge.Serve(listener, sshserver, &bridge.BridgeConfig{
+				DefaultCmd:    config.Cmd,
+				Registry:      registry,
+				ShareSessions: config.Share,
+			}, func(sc *ssh.ServerConn) (bridge.SessionProvider, error) {
+				id, _ := sshauth.FromPermissions(sc.Permissions)
+
+				return newProvider(sc.User(), id)
+			})
+
+			return nil
+		},
+	}
+
+	if err := app.Run(os.Args); err != nil {
+		log.Fatal(err)
+	}
+}
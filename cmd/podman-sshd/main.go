@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/tg123/docker-sshd/pkg/bridge"
+	"github.com/tg123/docker-sshd/pkg/podmansshd"
+	"github.com/tg123/docker-sshd/pkg/sshauth"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/crypto/ssh"
+)
+
+func main() {
+
+	config := struct {
+		ListenAddr string
+		Port       int
+		KeyFile    string
+		Cmd        string
+		Socket     string
+		Share      bool
+		PickerUser string
+		Allow      cli.StringSlice
+		AuthKeys   string
+		ExecUser   string
+		ExecDir    string
+		ExecTime   time.Duration
+	}{}
+
+	log.SetLevel(log.DebugLevel)
+
+	app := &cli.App{
+		Name:  "podman-sshd",
+		Usage: "make podman container sshable",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "address",
+				Aliases:     []string{"l"},
+				Value:       "0.0.0.0",
+				Usage:       "listening address",
+				Destination: &config.ListenAddr,
+			},
+			&cli.IntFlag{
+				Name:        "port",
+				Aliases:     []string{"p"},
+				Value:       2232,
+				Usage:       "listening port",
+				Destination: &config.Port,
+			},
+			&cli.StringFlag{
+				Name:        "server-key",
+				Aliases:     []string{"i"},
+				Usage:       "server key files, support wildcard",
+				Value:       "/etc/ssh/ssh_host_ed25519_key",
+				Destination: &config.KeyFile,
+			},
+			&cli.StringFlag{
+				Name:        "command",
+				Aliases:     []string{"c"},
+				Usage:       "default exec command",
+				Value:       "/bin/sh",
+				Destination: &config.Cmd,
+			},
+			&cli.StringFlag{
+				Name:        "socket",
+				Usage:       "podman api unix socket",
+				Value:       podmansshd.DefaultSocket(),
+				Destination: &config.Socket,
+			},
+			&cli.BoolFlag{
+				Name:        "share-sessions",
+				Usage:       "allow others to join interactive sessions with join+<id> username",
+				Destination: &config.Share,
+			},
+			&cli.StringFlag{
+				Name:        "picker-user",
+				Usage:       "username which shows a menu to pick the target, disabled if empty",
+				Value:       "pick",
+				Destination: &config.PickerUser,
+			},
+			&cli.StringSliceFlag{
+				Name:        "allow-target",
+				Usage:       "glob pattern of targets users may connect to, can be repeated, all allowed if empty, the allow-target option of a key narrows it",
+				Destination: &config.Allow,
+			},
+			&cli.StringFlag{
+				Name:        "authorized-keys",
+				Usage:       "only accept public keys in this authorized_keys file, the key comment is the user identity, anyone may connect if empty",
+				Destination: &config.AuthKeys,
+			},
+			&cli.StringFlag{
+				Name:        "exec-user",
+				Usage:       "user inside the container, user+target usernames may only choose this user or the exec-user of their key, image default if empty",
+				Destination: &config.ExecUser,
+			},
+			&cli.StringFlag{
+				Name:        "exec-workdir",
+				Usage:       "working directory inside the container, image default if empty",
+				Destination: &config.ExecDir,
+			},
+			&cli.DurationFlag{
+				Name:        "exec-timeout",
+				Usage:       "how long to wait for the exit code after the output of a command ends",
+				Value:       podmansshd.DefaultExecTimeout,
+				Destination: &config.ExecTime,
+			},
+		},
+		Action: func(c *cli.Context) error {
+
+			podmancli := podmansshd.NewClient(config.Socket)
+
+			privateBytes, err := os.ReadFile(config.KeyFile)
+			if err != nil {
+				return err
+			}
+
+			private, err := ssh.ParsePrivateKey(privateBytes)
+			if err != nil {
+				return err
+			}
+
+			sshserver := &ssh.ServerConfig{
+				NoClientAuth: true,
+
+				NoClientAuthCallback: func(cm ssh.ConnMetadata) (*ssh.Permissions, error) {
+					return nil, nil
+				},
+
+				PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+					return nil, nil
+				},
+
+				PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+					return nil, nil
+				},
+
+				KeyboardInteractiveCallback: func(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+					return nil, nil
+				},
+			}
+
+			if config.AuthKeys != "" {
+				keys, err := sshauth.LoadAuthorizedKeys(config.AuthKeys)
+				if err != nil {
+					return err
+				}
+
+				sshserver = &ssh.ServerConfig{
+					PublicKeyCallback: keys.PublicKeyCallback,
+				}
+			}
+
+			sshserver.AddHostKey(private)
+			addr := net.JoinHostPort(config.ListenAddr, fmt.Sprintf("%d", config.Port))
+			listener, err := net.Listen("tcp", addr)
+			if err != nil {
+				return err
+			}
+			defer listener.Close()
+
+			log.Printf("podman-sshd started, listening at %v, podman socket %v", addr, config.Socket)
+
+			allow := bridge.TargetPolicy(config.Allow.Value())
+
+			newProvider := func(target string, id sshauth.Identity) (bridge.SessionProvider, error) {
+				requested, target := bridge.CutExecUser(target)
+
+				execUser, err := id.ExecUser(requested, config.ExecUser)
+				if err != nil {
+					return nil, err
+				}
+
+				c, err := podmansshd.Resolve(context.Background(), podmancli, target)
+				if err != nil {
+					return nil, err
+				}
+
+				if !allow(id, c.Name) {
+					return nil, fmt.Errorf("target [%v] is not allowed", c.Name)
+				}
+
+				provider, err := podmansshd.New(podmancli, c.ID)
+				if err != nil {
+					return nil, err
+				}
+
+				return bridge.WithExecDefaults(provider, execUser, config.ExecDir), nil
+			}
+
+			newPicker := func(id sshauth.Identity) bridge.SessionProvider {
+				return bridge.NewPicker(bridge.FilterTargets(func(ctx context.Context) ([]bridge.Target, error) {
+					return podmansshd.ListTargets(ctx, podmancli)
+				}, func(target string) bool {
+					return allow(id, target)
+				}), func(target string) (bridge.SessionProvider, error) {
+					return newProvider(target, id)
+				})
+			}
+
+			registry := bridge.NewRegistry()
+
+			bridge.Serve(listener, sshserver, &bridge.BridgeConfig{
+				DefaultCmd:    config.Cmd,
+				ExecTimeout:   config.ExecTime,
+				Registry:      registry,
+				ShareSessions: config.Share,
+			}, func(sc *ssh.ServerConn) (bridge.SessionProvider, error) {
+				id, _ := sshauth.FromPermissions(sc.Permissions)
+
+				if config.PickerUser != "" && sc.User() == config.PickerUser {
+					return newPicker(id), nil
+				}
+
+				return newProvider(sc.User(), id)
+			})
+
+			return nil
+		},
+	}
+
+	if err := app.Run(os.Args); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/tg123/docker-sshd/pkg/wsconn"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+func main() {
+
+	config := struct {
+		Headers cli.StringSlice
+	}{}
+
+	app := &cli.App{
+		Name:      "ws-proxy",
+		Usage:     "ssh ProxyCommand for docker-sshd/kube-sshd websocket listener",
+		ArgsUsage: "ws[s]://host:port/path",
+		Flags: []cli.Flag{
+			&cli.StringSliceFlag{
+				Name:        "header",
+				Aliases:     []string{"H"},
+				Usage:       "extra http header sent with the upgrade request, format: Name: value",
+				Destination: &config.Headers,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			if c.NArg() != 1 {
+				return fmt.Errorf("websocket url is required")
+			}
+
+			header := http.Header{}
+			for _, h := range config.Headers.Value() {
+				name, value, ok := strings.Cut(h, ":")
+				if !ok {
+					return fmt.Errorf("bad header %q, expected Name: value", h)
+				}
+				header.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+			}
+
+			conn, err := wsconn.Dial(context.Background(), c.Args().First(), header)
+			if err != nil {
+				return err
+			}
+			defer conn.Close()
+
+			go func() {
+				_, _ = io.Copy(conn, os.Stdin)
+				_ = conn.Close()
+			}()
+
+			_, err = io.Copy(os.Stdout, conn)
+			return err
+		},
+	}
+
+	if err := app.Run(os.Args); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,185 @@
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tg123/docker-sshd/pkg/bridge"
+)
+
+// Server is the local admin http api, it must only be exposed on loopback or a unix socket
+type Server struct {
+	registry *bridge.Registry
+	mux      *http.ServeMux
+}
+
+func New(registry *bridge.Registry) *Server {
+	s := &Server{
+		registry: registry,
+		mux:      http.NewServeMux(),
+	}
+
+	s.mux.HandleFunc("GET /connections", s.handleListConnections)
+	s.mux.HandleFunc("DELETE /connections", s.handleKillTarget)
+	s.mux.HandleFunc("DELETE /connections/{id}", s.handleKillConnection)
+	s.mux.HandleFunc("POST /broadcast", s.handleBroadcast)
+	s.mux.HandleFunc("GET /sessions", s.handleListSessions)
+
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+func (s *Server) handleListConnections(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.registry.Connections())
+}
+
+func (s *Server) handleKillConnection(w http.ResponseWriter, r *http.Request) {
+	if err := s.registry.Kill(r.PathValue("id")); err != nil {
+		writeJSON(w, http.StatusNotFound, errorResponse{Error: err.Error()})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, countResponse{Count: 1})
+}
+
+// handleKillTarget closes all connections to ?target=
+func (s *Server) handleKillTarget(w http.ResponseWriter, r *http.Request) {
+	target := r.URL.Query().Get("target")
+	if target == "" {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: "target is required"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, countResponse{Count: s.registry.KillTarget(target)})
+}
+
+func (s *Server) handleBroadcast(w http.ResponseWriter, r *http.Request) {
+	// browsers send cross-origin form posts without preflight, but never as application/json
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+		writeJSON(w, http.StatusUnsupportedMediaType, errorResponse{Error: "content type must be application/json"})
+		return
+	}
+
+	req := struct {
+		Message string `json:"message"`
+		Target  string `json:"target"`
+	}{}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: err.Error()})
+		return
+	}
+
+	if req.Message == "" {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: "message is required"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, countResponse{Count: s.registry.Broadcast(req.Target, req.Message)})
+}
+
+func (s *Server) handleListSessions(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.registry.Sessions())
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+type countResponse struct {
+	Count int `json:"count"`
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Warnf("admin api failed to write response: %v", err)
+	}
+}
+
+// Listen listens on addr, unix:/path/to/socket for unix socket, otherwise a loopback host:port
+// a stale socket at path is replaced, any other file is an error
+func Listen(addr string) (net.Listener, error) {
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		if info, err := os.Lstat(path); err == nil {
+			if info.Mode().Type() != os.ModeSocket {
+				return nil, fmt.Errorf("%v exists and is not a socket", path)
+			}
+
+			if err := os.Remove(path); err != nil {
+				return nil, err
+			}
+		}
+
+		l, err := net.Listen("unix", path)
+		if err != nil {
+			return nil, err
+		}
+
+		// the socket is created with the umask of the process, its directory should be private too, e.g. /run
+		if err := os.Chmod(path, 0600); err != nil {
+			_ = l.Close()
+			return nil, err
+		}
+
+		return l, nil
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, &net.AddrError{Err: "admin api only listens on loopback or unix socket", Addr: addr}
+	}
+
+	return net.Listen("tcp", addr)
+}
+
+// Serve serves the admin api on l until l is closed
+// on tcp any local process, including a browser, can connect, so requests must name a loopback host
+func (s *Server) Serve(l net.Listener) error {
+	var handler http.Handler = s
+	if l.Addr().Network() == "tcp" {
+		handler = loopbackHost(s)
+	}
+
+	server := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: 30 * time.Second,
+	}
+
+	return server.Serve(l)
+}
+
+// loopbackHost refuses requests whose Host is not localhost or a loopback ip,
+// a page of another site reaching the api by dns rebinding sends its own name
+func loopbackHost(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = strings.Trim(r.Host, "[]")
+		}
+
+		if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			log.Warnf("admin api refused request from %v for host %q", r.RemoteAddr, r.Host)
+			writeJSON(w, http.StatusForbidden, errorResponse{Error: "host must be localhost or a loopback address"})
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,245 @@
+package admin
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/tg123/docker-sshd/pkg/bridge"
+)
+
+// testConn is a registered connection which records being killed
+type testConn struct {
+	*bridge.Conn
+
+	mu     sync.Mutex
+	killed bool
+}
+
+func register(registry *bridge.Registry, user, target string) *testConn {
+	c := &testConn{}
+	c.Conn = &bridge.Conn{
+		User:       user,
+		RemoteAddr: "192.0.2.1:50000",
+		Target:     target,
+		Terminal:   io.Discard,
+		Close: func() error {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			c.killed = true
+			registry.Unregister(c.Conn)
+			return nil
+		},
+	}
+
+	registry.Register(c.Conn)
+	return c
+}
+
+func (c *testConn) isKilled() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.killed
+}
+
+func do(t *testing.T, server *httptest.Server, method, path string, v any) int {
+	t.Helper()
+
+	req, err := http.NewRequest(method, server.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%v %v returned error: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+
+	if v != nil {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("%v %v: decode returned error: %v", method, path, err)
+		}
+	}
+
+	return resp.StatusCode
+}
+
+func TestListAndKillConnections(t *testing.T) {
+	registry := bridge.NewRegistry()
+	web1 := register(registry, "alice", "web")
+	web2 := register(registry, "bob", "web")
+	db := register(registry, "alice", "db")
+
+	server := httptest.NewServer(New(registry))
+	defer server.Close()
+
+	var conns []bridge.ConnectionInfo
+	if code := do(t, server, http.MethodGet, "/connections", &conns); code != http.StatusOK || len(conns) != 3 {
+		t.Fatalf("unexpected connections %v %#v", code, conns)
+	}
+
+	var dbID string
+	for _, c := range conns {
+		if c.Target == "db" {
+			dbID = c.ID
+		}
+	}
+
+	if dbID == "" || conns[0].User == "" || conns[0].RemoteAddr != "192.0.2.1:50000" {
+		t.Fatalf("unexpected connections %#v", conns)
+	}
+
+	var count struct{ Count int }
+	if code := do(t, server, http.MethodDelete, "/connections/"+dbID, &count); code != http.StatusOK || count.Count != 1 {
+		t.Fatalf("unexpected kill by id %v %#v", code, count)
+	}
+
+	if !db.isKilled() || web1.isKilled() || web2.isKilled() {
+		t.Fatal("expected only the connection to db to be killed")
+	}
+
+	if code := do(t, server, http.MethodDelete, "/connections/"+dbID, nil); code != http.StatusNotFound {
+		t.Fatalf("expected 404 for a killed connection, got %v", code)
+	}
+
+	if code := do(t, server, http.MethodDelete, "/connections", nil); code != http.StatusBadRequest {
+		t.Fatalf("expected 400 without target, got %v", code)
+	}
+
+	if code := do(t, server, http.MethodDelete, "/connections?target=web", &count); code != http.StatusOK || count.Count != 2 {
+		t.Fatalf("unexpected kill by target %v %#v", code, count)
+	}
+
+	if !web1.isKilled() || !web2.isKilled() {
+		t.Fatal("expected connections to web to be killed")
+	}
+
+	if code := do(t, server, http.MethodGet, "/connections", &conns); code != http.StatusOK || len(conns) != 0 {
+		t.Fatalf("expected no connections, got %#v", conns)
+	}
+}
+
+func TestTCPRequiresLoopbackHost(t *testing.T) {
+	l, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen returned error: %v", err)
+	}
+
+	go func() { _ = New(bridge.NewRegistry()).Serve(l) }()
+	defer l.Close()
+
+	tests := []struct {
+		host string
+		code int
+	}{
+		{l.Addr().String(), http.StatusOK},
+		{"localhost", http.StatusOK},
+		{"[::1]:2233", http.StatusOK},
+		{"attacker.example:2233", http.StatusForbidden},
+		{"attacker.example", http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest(http.MethodGet, "http://"+l.Addr().String()+"/connections", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = tt.host
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("get returned error: %v", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != tt.code {
+			t.Fatalf("host %q: expected status %v, got %v", tt.host, tt.code, resp.StatusCode)
+		}
+	}
+}
+
+func TestListenUnixOnlyReplacesSockets(t *testing.T) {
+	dir := t.TempDir()
+
+	file := filepath.Join(dir, "admin.conf")
+	if err := os.WriteFile(file, []byte("keep"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Listen("unix:" + file); err == nil {
+		t.Fatal("expected Listen to refuse a path which is not a socket")
+	}
+
+	if data, err := os.ReadFile(file); err != nil || string(data) != "keep" {
+		t.Fatalf("expected the file to be kept, got %q %v", data, err)
+	}
+
+	// a socket left behind by a crashed daemon
+	path := filepath.Join(dir, "admin.sock")
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	_ = stale.Close()
+
+	l, err := Listen("unix:" + path)
+	if err != nil {
+		t.Fatalf("expected Listen to replace a stale socket, got %v", err)
+	}
+	_ = l.Close()
+}
+
+func TestBroadcastRequiresJSON(t *testing.T) {
+	server := httptest.NewServer(New(bridge.NewRegistry()))
+	defer server.Close()
+
+	tests := []struct {
+		contentType string
+		code        int
+	}{
+		{"text/plain", http.StatusUnsupportedMediaType},
+		{"application/x-www-form-urlencoded", http.StatusUnsupportedMediaType},
+		{"", http.StatusUnsupportedMediaType},
+		{"application/json; charset=utf-8", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		resp, err := http.Post(server.URL+"/broadcast", tt.contentType, strings.NewReader(`{"message": "maintenance"}`))
+		if err != nil {
+			t.Fatalf("post returned error: %v", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != tt.code {
+			t.Fatalf("content type %q: expected status %v, got %v", tt.contentType, tt.code, resp.StatusCode)
+		}
+	}
+}
+
+func TestListenUnixSocketIsPrivate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "admin.sock")
+
+	l, err := Listen("unix:" + path)
+	if err != nil {
+		t.Fatalf("Listen returned error: %v", err)
+	}
+	defer l.Close()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Fatalf("expected socket mode 0600, got %v", perm)
+	}
+}
@@ -2,6 +2,7 @@ package bridge
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -19,39 +20,188 @@ type ExecConfig struct {
 	Env    []string
 	Cmd    []string
 	Tty    bool
+
+	// ExitTimeout bounds the wait for the exit code once the output ends, provider default if zero
+	ExitTimeout time.Duration
+
+	// User and WorkingDir inside the container, image defaults if empty
+	User       string
+	WorkingDir string
+
+	// Forward is set when the exec relays a direct-tcpip channel
+	Forward bool
+
+	// Shell is set for shell requests, Cmd is then the default command
+	Shell bool
+
+	// Modes are the terminal modes of the pty-req, providers apply them where they can, see WithTerminalModes
+	Modes ssh.TerminalModes
 }
 
 type ExecResult struct {
 	ExitCode int
 	Error    error
+
+	// Signal is the name of the signal which killed the command without the SIG prefix, e.g. KILL, empty if it exited
+	Signal string
 }
 
 type ResizeOptions struct {
 	Height uint
 	Width  uint
+
+	// HeightPixels and WidthPixels are the size of the window in pixels, zero if the client does not send them
+	HeightPixels uint
+	WidthPixels  uint
 }
 
+// SessionProvider is the target of a connection, its state is shared by all channels of the connection
 type SessionProvider interface {
-	// Resize send resize request to container
+	// NewSession returns the exec handle of a session channel or a forwarded stream
+	NewSession() Session
+
+	// Close releases the provider when the connection ends, running execs are stopped
+	Close() error
+}
+
+// Session is one exec in the target, resize, cancel and exit state are independent of other sessions of the connection
+type Session interface {
+	// Resize send resize request to container, sizes before Exec are used as the initial size
 	Resize(context.Context, ResizeOptions) error
 
 	// Exec start command in container, will be called only once
+	// the command is stopped when ctx is cancelled, which happens when the client closes the channel
 	Exec(context.Context, ExecConfig) (<-chan ExecResult, error)
 }
 
+// errProvider fails every exec with err, used when the target cannot be reached
+type errProvider struct {
+	err error
+}
+
+func (e *errProvider) NewSession() Session {
+	return e
+}
+
+func (e *errProvider) Resize(context.Context, ResizeOptions) error {
+	return nil
+}
+
+func (e *errProvider) Exec(context.Context, ExecConfig) (<-chan ExecResult, error) {
+	return nil, e.err
+}
+
+func (e *errProvider) Close() error {
+	return nil
+}
+
+// CutExecUser splits a user+target username, execUser is empty for a plain target
+func CutExecUser(username string) (execUser, target string) {
+	if u, t, ok := strings.Cut(username, "+"); ok && u != "" && t != "" {
+		return u, t
+	}
+
+	return "", username
+}
+
+// WithExecDefaults sets User and WorkingDir of execs which leave them empty
+func WithExecDefaults(provider SessionProvider, user, workingDir string) SessionProvider {
+	if user == "" && workingDir == "" {
+		return provider
+	}
+
+	return &execDefaults{SessionProvider: provider, user: user, workingDir: workingDir}
+}
+
+type execDefaults struct {
+	SessionProvider
+	user       string
+	workingDir string
+}
+
+func (e *execDefaults) NewSession() Session {
+	return &execDefaultsSession{Session: e.SessionProvider.NewSession(), defaults: e}
+}
+
+type execDefaultsSession struct {
+	Session
+	defaults *execDefaults
+}
+
+func (e *execDefaultsSession) Exec(ctx context.Context, execconfig ExecConfig) (<-chan ExecResult, error) {
+	if execconfig.User == "" {
+		execconfig.User = e.defaults.user
+	}
+
+	if execconfig.WorkingDir == "" {
+		execconfig.WorkingDir = e.defaults.workingDir
+	}
+
+	return e.Session.Exec(ctx, execconfig)
+}
+
+// Target is the target of the wrapped provider
+func (e *execDefaults) Target() string {
+	return TargetOf(e.SessionProvider)
+}
+
+// Dial uses the Dialer of the wrapped provider
+func (e *execDefaults) Dial(ctx context.Context, network, address string) (net.Conn, error) {
+	return DialProvider(ctx, e.SessionProvider, network, address)
+}
+
 type BridgeConfig struct {
 	DefaultCmd  string
 	ExecTimeout time.Duration
+
+	// Registry tracks the connection for the admin api
+	Registry *Registry
+
+	// ShareSessions lets other users attach to interactive sessions with join+<id>, requires Registry
+	ShareSessions bool
 }
 
 type Bridge struct {
-	defaultcmd string
-	sshConn    ssh.Conn
-	chans      <-chan ssh.NewChannel
-	provider   SessionProvider
+	defaultcmd  string
+	execTimeout time.Duration
+	sshConn     ssh.Conn
+	permissions *ssh.Permissions
+	chans       <-chan ssh.NewChannel
+	provider    SessionProvider
+
+	// ctx is cancelled when the connection ends, channel contexts derive from it
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	id      string
+	target  string
+	started time.Time
+	stats   connStats
+
+	registry        *Registry
+	shareSessions   bool
+	joined          *sharedSession
+	joinedReadWrite bool
 }
 
 func (b *Bridge) Start() {
+	if b.registry != nil {
+		defer b.registry.remove(b.id)
+	}
+
+	// providers owning resources, e.g. sandbox containers or exec streams, release them with the connection
+	// joined sessions have no provider
+	if b.provider != nil {
+		defer func() {
+			if err := b.provider.Close(); err != nil {
+				log.Warnf("failed to close provider of %v: %v", b.target, err)
+			}
+		}()
+	}
+
+	// channels are cancelled before the provider is closed
+	defer b.cancel()
+
 	b.handleNewChannels(b.chans)
 }
 
@@ -65,6 +215,12 @@ func (b *Bridge) handleNewChannels(chans <-chan ssh.NewChannel) {
 		"direct-tcpip": b.handleDirectTcpip,
 	}
 
+	if b.joined != nil {
+		handlers = map[string]func(ssh.Channel, <-chan *ssh.Request, []byte){
+			"session": b.handleJoinedSession,
+		}
+	}
+
 	for newChannel := range chans {
 		t := newChannel.ChannelType()
 		handler, ok := handlers[t]
@@ -87,20 +243,32 @@ func (b *Bridge) handleNewChannels(chans <-chan ssh.NewChannel) {
 type session struct {
 	bridge *Bridge
 
+	// ctx is cancelled when the channel is closed by either side
+	ctx context.Context
+
+	// handle is the exec of this channel, other channels of the connection have their own
+	handle Session
+
 	channel      ssh.Channel
 	ptyRequested bool
 
 	env []string
 
-	width  uint32
-	height uint32
-	term   string // unused
+	width        uint32
+	height       uint32
+	widthPixels  uint32
+	heightPixels uint32
+	term         string
+	modes        ssh.TerminalModes
 
 	resizePending bool
 	resizeLock    sync.Mutex
 
 	execCalled bool
 	execLock   sync.Mutex
+	shell      bool
+
+	failed bool
 }
 
 func (s *session) handlePty(payload []byte) error {
@@ -120,8 +288,9 @@ func (s *session) handlePty(payload []byte) error {
 	}
 
 	s.term = msg.Term
+	s.modes = parseTerminalModes(msg.Encoded)
 	s.ptyRequested = true
-	return s.resize(msg.Width, msg.Height)
+	return s.resize(msg.Width, msg.Height, msg.WidthPixels, msg.HeightPixels)
 }
 
 func (s *session) handleWindowChanged(payload []byte) error {
@@ -137,14 +306,16 @@ func (s *session) handleWindowChanged(payload []byte) error {
 		return err
 	}
 
-	return s.resize(msg.Width, msg.Height)
+	return s.resize(msg.Width, msg.Height, msg.WidthPixels, msg.HeightPixels)
 }
 
-func (s *session) resize(width, height uint32) error {
+func (s *session) resize(width, height, widthPixels, heightPixels uint32) error {
 	s.resizePending = width > 0 && height > 0
 
 	s.width = width
 	s.height = height
+	s.widthPixels = widthPixels
+	s.heightPixels = heightPixels
 	return s.doResize()
 }
 
@@ -158,11 +329,13 @@ func (s *session) doResize() error {
 	s.resizeLock.Lock()
 	defer s.resizeLock.Unlock()
 
-	if err := s.bridge.provider.Resize(
-		context.Background(),
+	if err := s.handle.Resize(
+		s.ctx,
 		ResizeOptions{
-			Height: uint(s.height),
-			Width:  uint(s.width),
+			Height:       uint(s.height),
+			Width:        uint(s.width),
+			HeightPixels: uint(s.heightPixels),
+			WidthPixels:  uint(s.widthPixels),
 		},
 	); err != nil {
 		return err
@@ -184,17 +357,48 @@ func (s *session) exec(cmd string) error {
 	s.execCalled = true
 
 	log.Debugf("exec [%v] in container", cmd)
+	s.bridge.stats.addCommand(cmd)
 
-	r, err := s.bridge.provider.Exec(context.Background(), ExecConfig{
-		Input:  s.channel,
-		Output: s.channel,
-		Env:    s.env,
-		Tty:    s.ptyRequested,
-		Cmd:    strings.Split(cmd, " "),
+	client := &countingReader{Reader: s.channel, n: &s.bridge.stats.bytesIn}
+
+	var input io.Reader = client
+	var output io.Writer = &countingWriter{Writer: s.channel, n: &s.bridge.stats.bytesOut}
+	var shared *sharedSession
+
+	if s.ptyRequested && s.bridge.shareSessions && s.bridge.registry != nil {
+		shared = s.bridge.registry.registerShared(s.bridge.target, s.bridge.permissions, s.bridge.sshConn.RemoteAddr(), output)
+		input = shared.input
+		output = shared
+
+		// the owner types into the shared input like co-drivers do
+		go func() {
+			shared.feed(client)
+			_ = shared.inputWriter.Close()
+		}()
+
+		_, _ = fmt.Fprintf(s.channel.Stderr(), "shared session id %v, read-only: ssh %v%v, co-drive: ssh %v%v\r\n", shared.id, JoinPrefix, shared.id, JoinPrefix, shared.driveID)
+	}
+
+	r, err := s.handle.Exec(s.ctx, ExecConfig{
+		Input:       input,
+		Output:      output,
+		Env:         s.execEnv(),
+		Tty:         s.ptyRequested,
+		Cmd:         strings.Split(cmd, " "),
+		ExitTimeout: s.bridge.execTimeout,
+		Shell:       s.shell,
+		Modes:       s.modes,
 	})
 
 	if err != nil {
-		return err
+		if shared != nil {
+			shared.close()
+		}
+
+		// like sshd, the request succeeds and the failure is reported as output and exit status
+		log.Warnf("exec [%v] failed: %v", cmd, err)
+		s.fail(err)
+		return nil
 	}
 
 	if err := s.doResize(); err != nil {
@@ -203,9 +407,39 @@ func (s *session) exec(cmd string) error {
 
 	go func() {
 		defer s.channel.Close()
-		result := <-r
+		if shared != nil {
+			defer shared.close()
+		}
+
+		var result ExecResult
+		select {
+		case result = <-r:
+		case <-s.ctx.Done():
+			// the client is gone, there is no one to report the exit status to
+			log.Debugf("exec [%v] in container cancelled", cmd)
+			return
+		}
+
 		exitCode := result.ExitCode
 
+		// the client only sees the exit status, e.g. a failed hijack is otherwise lost
+		if result.Error != nil {
+			log.Warnf("exec [%v] in container failed: %v", cmd, result.Error)
+		}
+
+		if result.Signal != "" {
+			log.Infof("exec [%v] in container killed by signal %v", cmd, result.Signal)
+
+			ok, err := s.channel.SendRequest("exit-signal", false, ssh.Marshal(&struct {
+				Signal     string
+				CoreDumped bool
+				Error      string
+				Lang       string
+			}{Signal: result.Signal}))
+			log.Printf("send exit signal %v %v", ok, err)
+			return
+		}
+
 		log.Infof("exec [%v] in container exit status %v", cmd, exitCode)
 
 		ok, err := s.channel.SendRequest("exit-status", false, ssh.Marshal(&struct{ uint32 }{uint32(exitCode)}))
@@ -215,6 +449,14 @@ func (s *session) exec(cmd string) error {
 	return nil
 }
 
+// fail reports err to the client, the channel is closed after the request is replied
+// otherwise ssh clients only see a generic request failure
+func (s *session) fail(err error) {
+	_, _ = fmt.Fprintf(s.channel.Stderr(), "%v\r\n", err)
+	_, _ = s.channel.SendRequest("exit-status", false, ssh.Marshal(&struct{ uint32 }{255}))
+	s.failed = true
+}
+
 func (s *session) handleEnv(payload []byte) error {
 	msg := struct {
 		Name    string
@@ -230,6 +472,22 @@ func (s *session) handleEnv(payload []byte) error {
 	return nil
 }
 
+// execEnv is the env of the client with TERM of the pty-req, which wins over a TERM sent as env like in sshd
+func (s *session) execEnv() []string {
+	if !s.ptyRequested || s.term == "" {
+		return s.env
+	}
+
+	env := make([]string, 0, len(s.env)+1)
+	for _, e := range s.env {
+		if !strings.HasPrefix(e, "TERM=") {
+			env = append(env, e)
+		}
+	}
+
+	return append(env, "TERM="+s.term)
+}
+
 func (s *session) handleExec(payload []byte) error {
 	msg := struct {
 		Command string
@@ -244,11 +502,19 @@ func (s *session) handleExec(payload []byte) error {
 
 func (b *Bridge) handleSession(channel ssh.Channel, requests <-chan *ssh.Request, _ []byte) {
 
+	ctx, cancel := context.WithCancel(b.ctx)
+	defer cancel()
+
 	s := &session{
 		bridge:  b,
+		ctx:     ctx,
+		handle:  b.provider.NewSession(),
 		channel: channel,
 	}
 
+	b.stats.addChannel(channel)
+	defer b.stats.removeChannel(channel)
+
 	for req := range requests {
 		var err error
 
@@ -256,6 +522,7 @@ func (b *Bridge) handleSession(channel ssh.Channel, requests <-chan *ssh.Request
 		case "pty-req":
 			err = s.handlePty(req.Payload)
 		case "shell":
+			s.shell = true
 			err = s.exec(b.defaultcmd)
 		case "exec":
 			err = s.handleExec(req.Payload)
@@ -274,6 +541,10 @@ func (b *Bridge) handleSession(channel ssh.Channel, requests <-chan *ssh.Request
 		if req.WantReply {
 			_ = req.Reply(err == nil, nil)
 		}
+
+		if s.failed {
+			_ = channel.Close()
+		}
 	}
 }
 
@@ -296,17 +567,41 @@ func (b *Bridge) handleDirectTcpip(channel ssh.Channel, requests <-chan *ssh.Req
 	}{}
 
 	defer channel.Close()
-	go ssh.DiscardRequests(requests)
+
+	ctx, cancel := context.WithCancel(b.ctx)
+	defer cancel()
+
+	go func() {
+		ssh.DiscardRequests(requests)
+		cancel()
+	}()
 
 	if err := ssh.Unmarshal(payload, &msg); err != nil {
 		log.Errorf("failed to unmarshal direct-tcpip payload: %v", err)
 		return
 	}
 
-	r, err := b.provider.Exec(context.Background(), ExecConfig{
-		Input:  channel,
-		Output: channel,
-		Cmd:    []string{"nc", msg.HostToConnect, fmt.Sprintf("%v", msg.PortToConnect)},
+	b.stats.addCommand(fmt.Sprintf("direct-tcpip %v:%v", msg.HostToConnect, msg.PortToConnect))
+
+	if d, ok := b.provider.(Dialer); ok {
+		conn, err := d.Dial(ctx, "tcp", net.JoinHostPort(msg.HostToConnect, fmt.Sprintf("%v", msg.PortToConnect)))
+		if err == nil {
+			b.relay(ctx, channel, conn)
+			return
+		}
+
+		if !errors.Is(err, errors.ErrUnsupported) {
+			log.Warnf("direct-tcpip dial %v:%v failed: %v", msg.HostToConnect, msg.PortToConnect, err)
+			return
+		}
+	}
+
+	r, err := b.provider.NewSession().Exec(ctx, ExecConfig{
+		Input:       &countingReader{Reader: channel, n: &b.stats.bytesIn},
+		Output:      &countingWriter{Writer: channel, n: &b.stats.bytesOut},
+		Cmd:         []string{"nc", msg.HostToConnect, fmt.Sprintf("%v", msg.PortToConnect)},
+		Forward:     true,
+		ExitTimeout: b.execTimeout,
 	})
 
 	if err != nil {
@@ -314,11 +609,42 @@ func (b *Bridge) handleDirectTcpip(channel ssh.Channel, requests <-chan *ssh.Req
 		return
 	}
 
-	if err := (<-r).Error; err != nil {
-		log.Warningf("direct-tcpip io copy failed: %v", err)
+	select {
+	case result := <-r:
+		if result.Error != nil {
+			log.Warningf("direct-tcpip io copy failed: %v", result.Error)
+		}
+	case <-ctx.Done():
 	}
 }
 
+// relay copies between a direct-tcpip channel and conn until either side closes or ctx is cancelled
+func (b *Bridge) relay(ctx context.Context, channel ssh.Channel, conn net.Conn) {
+	defer conn.Close()
+
+	stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+	defer stop()
+
+	done := make(chan struct{}, 2)
+
+	go func() {
+		_, _ = io.Copy(conn, &countingReader{Reader: channel, n: &b.stats.bytesIn})
+		if c, ok := conn.(interface{ CloseWrite() error }); ok {
+			_ = c.CloseWrite()
+		}
+		done <- struct{}{}
+	}()
+
+	go func() {
+		_, _ = io.Copy(&countingWriter{Writer: channel, n: &b.stats.bytesOut}, conn)
+		_ = channel.CloseWrite()
+		done <- struct{}{}
+	}()
+
+	<-done
+	<-done
+}
+
 func New(conn net.Conn, sshconfig *ssh.ServerConfig, bridgeconfig *BridgeConfig, providerCreater func(*ssh.ServerConn) (SessionProvider, error)) (*Bridge, error) {
 
 	sshConn, chans, reqs, err := ssh.NewServerConn(conn, sshconfig)
@@ -326,18 +652,74 @@ func New(conn net.Conn, sshconfig *ssh.ServerConfig, bridgeconfig *BridgeConfig,
 		return nil, err
 	}
 
-	provider, err := providerCreater(sshConn)
-	if err != nil {
-		return nil, err
-	}
+	ctx, cancel := context.WithCancel(context.Background())
 
 	b := &Bridge{
-		provider:   provider,
-		chans:      chans,
-		defaultcmd: bridgeconfig.DefaultCmd,
+		ctx:           ctx,
+		cancel:        cancel,
+		sshConn:       sshConn,
+		permissions:   sshConn.Permissions,
+		chans:         chans,
+		defaultcmd:    bridgeconfig.DefaultCmd,
+		execTimeout:   bridgeconfig.ExecTimeout,
+		target:        sshConn.User(),
+		started:       time.Now(),
+		registry:      bridgeconfig.Registry,
+		shareSessions: bridgeconfig.ShareSessions,
+	}
+
+	if id, ok := joinID(sshConn.User()); ok && b.shareSessions && b.registry != nil {
+		shared, readWrite, err := b.registry.lookupShared(id, sshConn.Permissions)
+		if err != nil {
+			log.Warnf("%v failed to join: %v", b.remoteAddr(), err)
+			b.provider = &errProvider{err: err}
+		} else {
+			b.joined = shared
+			b.joinedReadWrite = readWrite
+			b.target = shared.target
+		}
+	} else {
+		provider, err := providerCreater(sshConn)
+		if err != nil {
+			// keep the connection, the error is reported when the client opens a session
+			log.Warnf("%v failed to create provider for [%v]: %v", b.remoteAddr(), sshConn.User(), err)
+			provider = &errProvider{err: err}
+		}
+
+		b.provider = provider
+	}
+
+	if b.registry != nil {
+		b.id = b.registry.newID()
+		b.registry.add(b.id, b)
 	}
 
 	go handleKeepAlive(reqs)
 
 	return b, nil
 }
+
+// Serve accepts connections on listener until it is closed, every connection is set up and served in its own goroutine
+// so a slow handshake or provider does not hold up others
+func Serve(listener net.Listener, sshconfig *ssh.ServerConfig, bridgeconfig *BridgeConfig, providerCreater func(*ssh.ServerConn) (SessionProvider, error)) {
+	for {
+		c, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("failed to accept connection: %v", err)
+			continue
+		}
+
+		go func() {
+			b, err := New(c, sshconfig, bridgeconfig, providerCreater)
+			if err != nil {
+				log.Printf("failed to establish ssh connection: %v", err)
+				return
+			}
+
+			b.Start()
+		}()
+	}
+}
@@ -2,7 +2,14 @@ package bridge
 
 import (
 	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
 	"io"
+	"net"
+	"runtime"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -19,6 +26,11 @@ type fakeProvider struct {
 	resizeErr   error
 }
 
+// NewSession returns the provider itself, all sessions record into the same calls
+func (f *fakeProvider) NewSession() Session {
+	return f
+}
+
 func (f *fakeProvider) Resize(ctx context.Context, size ResizeOptions) error {
 	f.mu.Lock()
 	defer f.mu.Unlock()
@@ -44,6 +56,10 @@ func (f *fakeProvider) Exec(ctx context.Context, cfg ExecConfig) (<-chan ExecRes
 	return resultChan, nil
 }
 
+func (f *fakeProvider) Close() error {
+	return nil
+}
+
 type fakeChannel struct {
 	closedCh  chan struct{}
 	closeOnce sync.Once
@@ -102,9 +118,9 @@ func TestSessionHandleEnv(t *testing.T) {
 
 func TestSessionResizeCallsProvider(t *testing.T) {
 	provider := &fakeProvider{}
-	s := &session{bridge: &Bridge{provider: provider}}
+	s := &session{bridge: &Bridge{provider: provider}, ctx: context.Background(), handle: provider}
 
-	if err := s.resize(80, 24); err != nil {
+	if err := s.resize(80, 24, 640, 480); err != nil {
 		t.Fatalf("resize returned error: %v", err)
 	}
 
@@ -126,6 +142,8 @@ func TestSessionExecUsesProviderConfig(t *testing.T) {
 	channel := newFakeChannel()
 	s := &session{
 		bridge:       &Bridge{provider: provider},
+		ctx:          context.Background(),
+		handle:       provider,
 		channel:      channel,
 		ptyRequested: true,
 		env:          []string{"FOO=BAR"},
@@ -175,3 +193,399 @@ func TestSessionExecUsesProviderConfig(t *testing.T) {
 		t.Fatal("expected error when exec called twice")
 	}
 }
+
+func TestSessionReportsProviderError(t *testing.T) {
+	provider := &errProvider{err: fmt.Errorf("[web] is ambiguous")}
+
+	_, client := newTestBridge(t, "web", provider, &BridgeConfig{})
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("NewSession returned error: %v", err)
+	}
+	defer session.Close()
+
+	out, err := session.CombinedOutput("ls")
+	if err == nil {
+		t.Fatal("expected exec to fail")
+	}
+
+	if !strings.Contains(string(out), "[web] is ambiguous") {
+		t.Fatalf("expected provider error in output, got %q", out)
+	}
+}
+
+func TestSessionReportsExitSignal(t *testing.T) {
+	provider := &fakeProvider{execResults: make(chan ExecResult, 1)}
+	provider.execResults <- ExecResult{ExitCode: 137, Signal: "KILL"}
+
+	_, client := newTestBridge(t, "c1", provider, &BridgeConfig{})
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("NewSession returned error: %v", err)
+	}
+	defer session.Close()
+
+	var exitErr *ssh.ExitError
+	if err := session.Run("sleep 100"); !errors.As(err, &exitErr) {
+		t.Fatalf("expected exit error, got %v", err)
+	}
+
+	if exitErr.Signal() != "KILL" {
+		t.Fatalf("expected KILL signal, got %q", exitErr.Signal())
+	}
+}
+
+type closingProvider struct {
+	fakeProvider
+	closed chan struct{}
+}
+
+func (c *closingProvider) Close() error {
+	close(c.closed)
+	return nil
+}
+
+func TestBridgeClosesProviderOnDisconnect(t *testing.T) {
+	provider := &closingProvider{closed: make(chan struct{})}
+
+	_, client := newTestBridge(t, "c1", provider, &BridgeConfig{})
+
+	select {
+	case <-provider.closed:
+		t.Fatal("provider closed while connected")
+	default:
+	}
+
+	_ = client.Close()
+
+	select {
+	case <-provider.closed:
+	case <-time.After(time.Second):
+		t.Fatal("expected provider to be closed after disconnect")
+	}
+}
+
+func TestServeDoesNotWaitForSlowConnections(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate host key: %v", err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatalf("failed to create signer: %v", err)
+	}
+
+	serverConfig := &ssh.ServerConfig{NoClientAuth: true}
+	serverConfig.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+
+	release := make(chan struct{})
+	defer close(release)
+
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+
+		Serve(listener, serverConfig, &BridgeConfig{}, func(sc *ssh.ServerConn) (SessionProvider, error) {
+			if sc.User() == "slow" {
+				<-release
+			}
+
+			return &fakeProvider{}, nil
+		})
+	}()
+
+	// one client never finishes the handshake, another hangs while its provider is created
+	stalled, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	defer stalled.Close()
+
+	go func() {
+		if c, err := ssh.Dial("tcp", listener.Addr().String(), &ssh.ClientConfig{User: "slow", HostKeyCallback: ssh.InsecureIgnoreHostKey()}); err == nil {
+			_ = c.Close()
+		}
+	}()
+
+	done := make(chan error, 1)
+	go func() {
+		c, err := ssh.Dial("tcp", listener.Addr().String(), &ssh.ClientConfig{User: "fast", HostKeyCallback: ssh.InsecureIgnoreHostKey()})
+		if err == nil {
+			_ = c.Close()
+		}
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("client handshake failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the connection to be served while others are slow")
+	}
+
+	_ = listener.Close()
+
+	select {
+	case <-served:
+	case <-time.After(time.Second):
+		t.Fatal("expected Serve to return once the listener is closed")
+	}
+}
+
+func TestCutExecUser(t *testing.T) {
+	tests := []struct {
+		username string
+		execUser string
+		target   string
+	}{
+		{"web", "", "web"},
+		{"app+web", "app", "web"},
+		{"app+prod/deploy/web", "app", "prod/deploy/web"},
+		{"+web", "", "+web"},
+	}
+
+	for _, tt := range tests {
+		execUser, target := CutExecUser(tt.username)
+		if execUser != tt.execUser || target != tt.target {
+			t.Fatalf("CutExecUser(%v) = %v, %v, expected %v, %v", tt.username, execUser, target, tt.execUser, tt.target)
+		}
+	}
+}
+
+func TestWithExecDefaults(t *testing.T) {
+	provider := &fakeProvider{execResults: make(chan ExecResult, 2)}
+	p := WithExecDefaults(provider, "app", "/srv")
+
+	if _, err := p.NewSession().Exec(context.Background(), ExecConfig{Cmd: []string{"id"}}); err != nil {
+		t.Fatalf("Exec returned error: %v", err)
+	}
+
+	if _, err := p.NewSession().Exec(context.Background(), ExecConfig{Cmd: []string{"id"}, User: "www", WorkingDir: "/tmp"}); err != nil {
+		t.Fatalf("Exec returned error: %v", err)
+	}
+
+	provider.mu.Lock()
+	defer provider.mu.Unlock()
+
+	if c := provider.execCalls[0]; c.User != "app" || c.WorkingDir != "/srv" {
+		t.Fatalf("expected defaults to be applied, got %#v", c)
+	}
+
+	if c := provider.execCalls[1]; c.User != "www" || c.WorkingDir != "/tmp" {
+		t.Fatalf("expected explicit values to be kept, got %#v", c)
+	}
+
+	if WithExecDefaults(provider, "", "") != SessionProvider(provider) {
+		t.Fatal("expected provider to be returned as is without defaults")
+	}
+}
+
+// blockingProvider runs execs until their context is cancelled
+type blockingProvider struct {
+	fakeProvider
+	cancelled chan struct{}
+}
+
+func (b *blockingProvider) NewSession() Session {
+	return b
+}
+
+func (b *blockingProvider) Exec(ctx context.Context, cfg ExecConfig) (<-chan ExecResult, error) {
+	_, _ = b.fakeProvider.Exec(ctx, cfg)
+
+	r := make(chan ExecResult, 1)
+	go func() {
+		<-ctx.Done()
+		b.cancelled <- struct{}{}
+		r <- ExecResult{ExitCode: -1, Error: ctx.Err()}
+	}()
+
+	return r, nil
+}
+
+func TestSessionCancelsExecOnChannelClose(t *testing.T) {
+	provider := &blockingProvider{cancelled: make(chan struct{}, 1)}
+
+	_, client := newTestBridge(t, "c1", provider, &BridgeConfig{})
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("NewSession returned error: %v", err)
+	}
+
+	if err := session.Start("sleep 100"); err != nil {
+		t.Fatalf("Start returned error: %v", err)
+	}
+
+	select {
+	case <-provider.cancelled:
+		t.Fatal("exec cancelled while the channel is open")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	_ = session.Close()
+
+	select {
+	case <-provider.cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("expected exec context to be cancelled after the channel closed")
+	}
+}
+
+func TestBridgeDoesNotLeakGoroutines(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	provider := &blockingProvider{cancelled: make(chan struct{}, 3)}
+	_, client := newTestBridge(t, "c1", provider, &BridgeConfig{})
+
+	for i := 0; i < 2; i++ {
+		session, err := client.NewSession()
+		if err != nil {
+			t.Fatalf("NewSession returned error: %v", err)
+		}
+
+		if err := session.Start("sleep 100"); err != nil {
+			t.Fatalf("Start returned error: %v", err)
+		}
+	}
+
+	// a forwarded stream falls back to nc, which blocks like the sessions
+	if _, err := client.Dial("tcp", "localhost:80"); err != nil {
+		t.Fatalf("Dial returned error: %v", err)
+	}
+
+	// execs are still running when the client goes away
+	_ = client.Close()
+
+	for i := 0; i < 3; i++ {
+		select {
+		case <-provider.cancelled:
+		case <-time.After(time.Second):
+			t.Fatalf("expected all execs to be cancelled, %v were", i)
+		}
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<16)
+			t.Fatalf("%v goroutines before, %v after disconnect\n%s", before, runtime.NumGoroutine(), buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// sessionsProvider gives every session its own fake, like providers with per channel exec state
+type sessionsProvider struct {
+	fakeProvider
+
+	mu       sync.Mutex
+	sessions []*fakeProvider
+}
+
+func (p *sessionsProvider) NewSession() Session {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s := &fakeProvider{execResults: make(chan ExecResult, 1)}
+	p.sessions = append(p.sessions, s)
+	return s
+}
+
+func (p *sessionsProvider) session(i int) *fakeProvider {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.sessions[i]
+}
+
+func TestSessionsOfConnectionAreIndependent(t *testing.T) {
+	provider := &sessionsProvider{}
+
+	_, client := newTestBridge(t, "c1", provider, &BridgeConfig{})
+	defer client.Close()
+
+	first, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("NewSession returned error: %v", err)
+	}
+
+	second, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("NewSession returned error: %v", err)
+	}
+	defer second.Close()
+
+	if err := first.RequestPty("xterm", 24, 80, ssh.TerminalModes{}); err != nil {
+		t.Fatalf("RequestPty returned error: %v", err)
+	}
+
+	if err := second.RequestPty("xterm", 40, 120, ssh.TerminalModes{}); err != nil {
+		t.Fatalf("RequestPty returned error: %v", err)
+	}
+
+	if err := first.Start("top"); err != nil {
+		t.Fatalf("Start returned error: %v", err)
+	}
+
+	if err := second.Start("vim"); err != nil {
+		t.Fatalf("Start returned error: %v", err)
+	}
+
+	if err := second.WindowChange(50, 160); err != nil {
+		t.Fatalf("WindowChange returned error: %v", err)
+	}
+
+	// window-change has no reply, wait until it reached the second session
+	deadline := time.Now().Add(time.Second)
+	for {
+		s := provider.session(1)
+		s.mu.Lock()
+		resized := len(s.resizeCalls) == 2
+		s.mu.Unlock()
+
+		if resized {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("expected window-change on the second session")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the first session ends, the second keeps running and still gets its exit status
+	provider.session(0).execResults <- ExecResult{ExitCode: 1}
+	if err := first.Wait(); err == nil {
+		t.Fatal("expected exit status 1 of the first session")
+	}
+
+	provider.session(1).execResults <- ExecResult{}
+	if err := second.Wait(); err != nil {
+		t.Fatalf("expected the second session to exit cleanly, got %v", err)
+	}
+
+	expected := []string{"[{24 80 192 640}] [top]", "[{40 120 320 960} {50 160 400 1280}] [vim]"}
+	for i, want := range expected {
+		s := provider.session(i)
+		s.mu.Lock()
+		got := fmt.Sprintf("%v %v", s.resizeCalls, s.execCalls[0].Cmd)
+		s.mu.Unlock()
+
+		if got != want {
+			t.Fatalf("session %v: expected %v, got %v", i, want, got)
+		}
+	}
+}
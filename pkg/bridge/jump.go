@@ -0,0 +1,342 @@
+package bridge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// JumpSuffix on a username connects to the sshd inside the target instead of exec, e.g. web+sshd
+const JumpSuffix = "+sshd"
+
+// Dialer is implemented by providers which can connect to ports of the target directly,
+// e.g. to the container ip. it returns errors.ErrUnsupported for addresses it cannot reach
+type Dialer interface {
+	Dial(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// DialProvider uses the Dialer of provider, errors.ErrUnsupported if it has none
+func DialProvider(ctx context.Context, provider SessionProvider, network, address string) (net.Conn, error) {
+	if d, ok := provider.(Dialer); ok {
+		return d.Dial(ctx, network, address)
+	}
+
+	return nil, errors.ErrUnsupported
+}
+
+// Dial connects to host:port as seen from the target, using the Dialer of the provider
+// or else nc inside the target like direct-tcpip
+func Dial(ctx context.Context, provider SessionProvider, host string, port int, timeout time.Duration) (net.Conn, error) {
+	address := net.JoinHostPort(host, strconv.Itoa(port))
+
+	if d, ok := provider.(Dialer); ok {
+		conn, err := d.Dial(ctx, "tcp", address)
+		if !errors.Is(err, errors.ErrUnsupported) {
+			return conn, err
+		}
+	}
+
+	inr, inw := io.Pipe()
+	outr, outw := io.Pipe()
+
+	r, err := provider.NewSession().Exec(ctx, ExecConfig{
+		Input:       inr,
+		Output:      outw,
+		Cmd:         []string{"nc", host, strconv.Itoa(port)},
+		Forward:     true,
+		ExitTimeout: timeout,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("dial %v requires [nc] inside the target: %w", address, err)
+	}
+
+	go func() {
+		result := <-r
+		if result.Error == nil && result.ExitCode != 0 {
+			result.Error = fmt.Errorf("nc %v exit code %v", address, result.ExitCode)
+		}
+
+		_ = outw.CloseWithError(result.Error)
+	}()
+
+	return &execConn{PipeReader: outr, w: inw, address: address}, nil
+}
+
+// execConn is a net.Conn over the input and output of an exec, deadlines are not supported
+type execConn struct {
+	*io.PipeReader
+	w       *io.PipeWriter
+	address string
+}
+
+func (c *execConn) Write(p []byte) (int, error) {
+	return c.w.Write(p)
+}
+
+func (c *execConn) Close() error {
+	_ = c.w.Close()
+	return c.PipeReader.Close()
+}
+
+func (c *execConn) LocalAddr() net.Addr                { return execAddr("exec") }
+func (c *execConn) RemoteAddr() net.Addr               { return execAddr(c.address) }
+func (c *execConn) SetDeadline(t time.Time) error      { return nil }
+func (c *execConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *execConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type execAddr string
+
+func (a execAddr) Network() string { return "exec" }
+func (a execAddr) String() string  { return string(a) }
+
+// JumpConfig is how the bridge logs in to the sshd inside targets
+type JumpConfig struct {
+	// User is the upstream user unless the exec sets one, e.g. with user+target
+	User string
+
+	// Port of the sshd inside the target, 22 if zero
+	Port int
+
+	Signer          ssh.Signer
+	HostKeyCallback ssh.HostKeyCallback
+
+	// ExecTimeout is used when the target is reached with nc
+	ExecTimeout time.Duration
+}
+
+// NewJump proxies sessions to the sshd inside the target of provider, authenticated with the configured key
+// the upstream connection is opened on the first exec, shared by the sessions and closed with the provider
+func NewJump(provider SessionProvider, config JumpConfig) SessionProvider {
+	if config.Port == 0 {
+		config.Port = 22
+	}
+
+	return &jump{
+		target:  provider,
+		config:  config,
+		clients: make(map[string]*ssh.Client),
+	}
+}
+
+type jump struct {
+	target SessionProvider
+	config JumpConfig
+
+	mu      sync.Mutex
+	clients map[string]*ssh.Client
+}
+
+func (j *jump) NewSession() Session {
+	return &jumpSession{jump: j}
+}
+
+// client returns the upstream connection as user, one per user
+func (j *jump) client(ctx context.Context, user string) (*ssh.Client, error) {
+	if user == "" {
+		user = j.config.User
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.clients == nil {
+		return nil, fmt.Errorf("jump to %v is closed", user)
+	}
+
+	if c, ok := j.clients[user]; ok {
+		return c, nil
+	}
+
+	conn, err := Dial(ctx, j.target, "localhost", j.config.Port, j.config.ExecTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	address := net.JoinHostPort("localhost", strconv.Itoa(j.config.Port))
+	sshconn, chans, reqs, err := ssh.NewClientConn(conn, address, &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(j.config.Signer)},
+		HostKeyCallback: j.config.HostKeyCallback,
+	})
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("login to sshd inside the target as %v failed: %w", user, err)
+	}
+
+	c := ssh.NewClient(sshconn, chans, reqs)
+	j.clients[user] = c
+
+	return c, nil
+}
+
+// jumpSession is an upstream session, one per channel
+type jumpSession struct {
+	jump *jump
+
+	mu      sync.Mutex
+	session *ssh.Session
+	size    ResizeOptions
+}
+
+func (j *jumpSession) Exec(ctx context.Context, execconfig ExecConfig) (<-chan ExecResult, error) {
+	if execconfig.Forward {
+		return nil, fmt.Errorf("forwarding goes through Dial of the upstream connection")
+	}
+
+	client, err := j.jump.client(ctx, execconfig.User)
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, err
+	}
+
+	term := "xterm"
+	for _, env := range execconfig.Env {
+		k, v, _ := strings.Cut(env, "=")
+		if k == "TERM" {
+			term = v
+		}
+
+		// sshd rejects variables not in AcceptEnv, like openssh the session goes on
+		_ = session.Setenv(k, v)
+	}
+
+	// not session.Stdin, Wait would block until the client closes its input
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		_ = session.Close()
+		return nil, err
+	}
+
+	session.Stdout = execconfig.Output
+	session.Stderr = execconfig.Output
+
+	j.mu.Lock()
+	size := j.size
+	j.session = session
+	j.mu.Unlock()
+
+	if execconfig.Tty {
+		if size.Width == 0 || size.Height == 0 {
+			size = ResizeOptions{Width: 80, Height: 24}
+		}
+
+		// the sshd inside the target applies the terminal modes of the client itself
+		if err := session.RequestPty(term, int(size.Height), int(size.Width), execconfig.Modes); err != nil {
+			_ = session.Close()
+			return nil, err
+		}
+
+		if size.WidthPixels > 0 || size.HeightPixels > 0 {
+			if err := windowChange(session, size); err != nil {
+				_ = session.Close()
+				return nil, err
+			}
+		}
+	}
+
+	if execconfig.Shell {
+		err = session.Shell()
+	} else {
+		err = session.Start(strings.Join(execconfig.Cmd, " "))
+	}
+
+	if err != nil {
+		_ = session.Close()
+		return nil, err
+	}
+
+	go func() {
+		_, _ = io.Copy(stdin, execconfig.Input)
+		_ = stdin.Close()
+	}()
+
+	// closing the upstream session ends the command like a disconnected ssh client would
+	stop := context.AfterFunc(ctx, func() { _ = session.Close() })
+
+	r := make(chan ExecResult, 1)
+
+	go func() {
+		defer stop()
+		defer session.Close()
+
+		err := session.Wait()
+		result := ExecResult{Error: err}
+
+		var exitErr *ssh.ExitError
+		switch {
+		case err == nil:
+		case errors.As(err, &exitErr):
+			result.ExitCode = exitErr.ExitStatus()
+			result.Signal = exitErr.Signal()
+		default:
+			result.ExitCode = -1
+		}
+
+		r <- result
+	}()
+
+	return r, nil
+}
+
+func (j *jumpSession) Resize(ctx context.Context, size ResizeOptions) error {
+	j.mu.Lock()
+	j.size = size
+	session := j.session
+	j.mu.Unlock()
+
+	if session == nil {
+		return nil
+	}
+
+	return windowChange(session, size)
+}
+
+// windowChange sends size with its pixels, ssh.Session.WindowChange derives them from the columns and rows
+func windowChange(session *ssh.Session, size ResizeOptions) error {
+	_, err := session.SendRequest("window-change", false, ssh.Marshal(&struct {
+		Width, Height, WidthPixels, HeightPixels uint32
+	}{uint32(size.Width), uint32(size.Height), uint32(size.WidthPixels), uint32(size.HeightPixels)}))
+	return err
+}
+
+// Target is the target whose sshd the jump connects to
+func (j *jump) Target() string {
+	return TargetOf(j.target)
+}
+
+// Dial forwards through the upstream connection, as direct-tcpip of the sshd inside the target
+func (j *jump) Dial(ctx context.Context, network, address string) (net.Conn, error) {
+	client, err := j.client(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	return client.DialContext(ctx, network, address)
+}
+
+// Close closes the upstream connections and the provider of the target
+func (j *jump) Close() error {
+	j.mu.Lock()
+	for user, c := range j.clients {
+		if err := c.Close(); err != nil {
+			log.Debugf("close upstream connection of %v: %v", user, err)
+		}
+	}
+	j.clients = nil
+	j.mu.Unlock()
+
+	return j.target.Close()
+}
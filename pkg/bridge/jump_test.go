@@ -0,0 +1,296 @@
+package bridge
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func newSigner(t *testing.T) ssh.Signer {
+	t.Helper()
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatalf("failed to create signer: %v", err)
+	}
+
+	return signer
+}
+
+// upstreamSshd is the sshd inside a target, exec writes user, term and command and exits with 5
+type upstreamSshd struct {
+	listener net.Listener
+
+	mu    sync.Mutex
+	users []string
+	sizes []string
+	modes []ssh.TerminalModes
+}
+
+func newUpstreamSshd(t *testing.T, clientKey ssh.PublicKey) *upstreamSshd {
+	t.Helper()
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if string(key.Marshal()) != string(clientKey.Marshal()) {
+				return nil, fmt.Errorf("unknown key")
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(newSigner(t))
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	u := &upstreamSshd{listener: listener}
+
+	go func() {
+		for {
+			c, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go u.serve(c, config)
+		}
+	}()
+
+	return u
+}
+
+func (u *upstreamSshd) serve(c net.Conn, config *ssh.ServerConfig) {
+	conn, chans, reqs, err := ssh.NewServerConn(c, config)
+	if err != nil {
+		return
+	}
+
+	u.mu.Lock()
+	u.users = append(u.users, conn.User())
+	u.mu.Unlock()
+
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+
+		go func() {
+			term := ""
+			for req := range requests {
+				switch req.Type {
+				case "pty-req":
+					msg := struct {
+						Term          string
+						Width, Height uint32
+						Wp, Hp        uint32
+						Modes         string
+					}{}
+					_ = ssh.Unmarshal(req.Payload, &msg)
+					term = msg.Term
+					u.addSize(msg.Width, msg.Height)
+
+					u.mu.Lock()
+					u.modes = append(u.modes, parseTerminalModes(msg.Modes))
+					u.mu.Unlock()
+
+					_ = req.Reply(true, nil)
+				case "window-change":
+					msg := struct{ Width, Height, Wp, Hp uint32 }{}
+					_ = ssh.Unmarshal(req.Payload, &msg)
+					u.addSize(msg.Width, msg.Height)
+				case "exec":
+					msg := struct{ Command string }{}
+					_ = ssh.Unmarshal(req.Payload, &msg)
+					_ = req.Reply(true, nil)
+
+					_, _ = fmt.Fprintf(channel, "%v %v %v", conn.User(), term, msg.Command)
+					_, _ = channel.SendRequest("exit-status", false, ssh.Marshal(&struct{ uint32 }{5}))
+					_ = channel.Close()
+				default:
+					if req.WantReply {
+						_ = req.Reply(false, nil)
+					}
+				}
+			}
+		}()
+	}
+}
+
+func (u *upstreamSshd) addSize(w, h uint32) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.sizes = append(u.sizes, fmt.Sprintf("%vx%v", w, h))
+}
+
+// dialerProvider reaches localhost:22 of the target at addr
+type dialerProvider struct {
+	fakeProvider
+	addr string
+}
+
+func (d *dialerProvider) Dial(ctx context.Context, network, address string) (net.Conn, error) {
+	if address != "localhost:22" {
+		return nil, errors.ErrUnsupported
+	}
+
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, network, d.addr)
+}
+
+func TestJumpExec(t *testing.T) {
+	signer := newSigner(t)
+	upstream := newUpstreamSshd(t, signer.PublicKey())
+
+	provider := NewJump(&dialerProvider{addr: upstream.listener.Addr().String()}, JumpConfig{
+		User:            "root",
+		Signer:          signer,
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+
+	_, client := newTestBridge(t, "web+sshd", WithExecDefaults(provider, "app", ""), &BridgeConfig{})
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("NewSession returned error: %v", err)
+	}
+	defer session.Close()
+
+	if err := session.RequestPty("vt100", 40, 120, ssh.TerminalModes{ssh.VERASE: 8, ssh.ECHO: 0}); err != nil {
+		t.Fatalf("RequestPty returned error: %v", err)
+	}
+
+	out, err := session.Output("id -u")
+
+	var exitErr *ssh.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitStatus() != 5 {
+		t.Fatalf("expected upstream exit status 5, got %v", err)
+	}
+
+	if string(out) != "app vt100 id -u" {
+		t.Fatalf("unexpected output %q", out)
+	}
+
+	upstream.mu.Lock()
+	defer upstream.mu.Unlock()
+
+	if len(upstream.sizes) == 0 || upstream.sizes[0] != "120x40" {
+		t.Fatalf("expected pty size of the client upstream, got %v", upstream.sizes)
+	}
+
+	if modes := upstream.modes[0]; modes[ssh.VERASE] != 8 || modes[ssh.ECHO] != 0 || len(modes) != 2 {
+		t.Fatalf("expected terminal modes of the client upstream, got %v", modes)
+	}
+}
+
+// echoProvider echoes the input of execs, like nc to an echo server
+type echoProvider struct {
+	fakeProvider
+}
+
+func (e *echoProvider) NewSession() Session {
+	return e
+}
+
+func (e *echoProvider) Exec(ctx context.Context, cfg ExecConfig) (<-chan ExecResult, error) {
+	_, _ = e.fakeProvider.Exec(ctx, cfg)
+
+	r := make(chan ExecResult, 1)
+	go func() {
+		_, err := io.Copy(cfg.Output, cfg.Input)
+		r <- ExecResult{Error: err}
+	}()
+
+	return r, nil
+}
+
+func TestDialFallsBackToNc(t *testing.T) {
+	provider := &echoProvider{}
+
+	conn, err := Dial(context.Background(), provider, "localhost", 22, 0)
+	if err != nil {
+		t.Fatalf("Dial returned error: %v", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("Write returned error: %v", err)
+	}
+
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("expected echo, got %q %v", buf, err)
+	}
+
+	provider.mu.Lock()
+	defer provider.mu.Unlock()
+
+	if call := provider.execCalls[0]; !call.Forward || fmt.Sprint(call.Cmd) != "[nc localhost 22]" {
+		t.Fatalf("unexpected exec %#v", call)
+	}
+}
+
+func TestDirectTcpipUsesDialer(t *testing.T) {
+	signer := newSigner(t)
+	upstream := newUpstreamSshd(t, signer.PublicKey())
+
+	provider := &dialerProvider{addr: upstream.listener.Addr().String()}
+
+	_, client := newTestBridge(t, "web", provider, &BridgeConfig{})
+	defer client.Close()
+
+	// like ssh -J, the client speaks ssh to the sshd inside the target over the forwarded stream
+	conn, err := client.Dial("tcp", "localhost:22")
+	if err != nil {
+		t.Fatalf("Dial returned error: %v", err)
+	}
+	defer conn.Close()
+
+	sshconn, chans, reqs, err := ssh.NewClientConn(conn, "localhost:22", &ssh.ClientConfig{
+		User:            "root",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatalf("handshake through the bridge failed: %v", err)
+	}
+
+	upstreamClient := ssh.NewClient(sshconn, chans, reqs)
+	defer upstreamClient.Close()
+
+	session, err := upstreamClient.NewSession()
+	if err != nil {
+		t.Fatalf("NewSession returned error: %v", err)
+	}
+	defer session.Close()
+
+	if out, _ := session.Output("hostname"); string(out) != "root  hostname" {
+		t.Fatalf("unexpected output %q", out)
+	}
+
+	provider.mu.Lock()
+	defer provider.mu.Unlock()
+
+	if len(provider.execCalls) != 0 {
+		t.Fatalf("expected no nc exec with a dialer, got %#v", provider.execCalls)
+	}
+}
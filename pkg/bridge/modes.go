@@ -0,0 +1,154 @@
+package bridge
+
+import (
+	"encoding/binary"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ttyOpEnd ends the encoded terminal modes of a pty-req, opcodes from 160 on are undefined and stop parsing
+const (
+	ttyOpEnd       = 0
+	ttyOpUndefined = 160
+)
+
+// parseTerminalModes decodes the terminal modes of a pty-req, RFC 4254 section 8
+func parseTerminalModes(encoded string) ssh.TerminalModes {
+	modes := ssh.TerminalModes{}
+	b := []byte(encoded)
+
+	for len(b) > 0 {
+		opcode := b[0]
+		if opcode == ttyOpEnd || opcode >= ttyOpUndefined || len(b) < 5 {
+			break
+		}
+
+		modes[opcode] = binary.BigEndian.Uint32(b[1:5])
+		b = b[5:]
+	}
+
+	return modes
+}
+
+// sttyChars are the special characters stty can set
+var sttyChars = map[uint8]string{
+	ssh.VINTR:    "intr",
+	ssh.VQUIT:    "quit",
+	ssh.VERASE:   "erase",
+	ssh.VKILL:    "kill",
+	ssh.VEOF:     "eof",
+	ssh.VEOL:     "eol",
+	ssh.VEOL2:    "eol2",
+	ssh.VSTART:   "start",
+	ssh.VSTOP:    "stop",
+	ssh.VSUSP:    "susp",
+	ssh.VREPRINT: "rprnt",
+	ssh.VWERASE:  "werase",
+	ssh.VLNEXT:   "lnext",
+}
+
+// sttyFlags are the input, local and output flags stty can set, speeds and character size are left to the pty
+var sttyFlags = map[uint8]string{
+	ssh.IGNPAR:  "ignpar",
+	ssh.PARMRK:  "parmrk",
+	ssh.INPCK:   "inpck",
+	ssh.ISTRIP:  "istrip",
+	ssh.INLCR:   "inlcr",
+	ssh.IGNCR:   "igncr",
+	ssh.ICRNL:   "icrnl",
+	ssh.IXON:    "ixon",
+	ssh.IXANY:   "ixany",
+	ssh.IXOFF:   "ixoff",
+	ssh.IMAXBEL: "imaxbel",
+	ssh.IUTF8:   "iutf8",
+	ssh.ISIG:    "isig",
+	ssh.ICANON:  "icanon",
+	ssh.ECHO:    "echo",
+	ssh.ECHOE:   "echoe",
+	ssh.ECHOK:   "echok",
+	ssh.ECHONL:  "echonl",
+	ssh.NOFLSH:  "noflsh",
+	ssh.TOSTOP:  "tostop",
+	ssh.IEXTEN:  "iexten",
+	ssh.ECHOCTL: "echoctl",
+	ssh.ECHOKE:  "echoke",
+	ssh.OPOST:   "opost",
+	ssh.ONLCR:   "onlcr",
+	ssh.OCRNL:   "ocrnl",
+	ssh.ONOCR:   "onocr",
+	ssh.ONLRET:  "onlret",
+}
+
+// sttyArgs converts modes to stty arguments in opcode order, unknown opcodes are skipped
+func sttyArgs(modes ssh.TerminalModes) []string {
+	opcodes := make([]int, 0, len(modes))
+	for opcode := range modes {
+		opcodes = append(opcodes, int(opcode))
+	}
+	sort.Ints(opcodes)
+
+	var args []string
+	for _, o := range opcodes {
+		opcode := uint8(o)
+		value := modes[opcode]
+
+		if name, ok := sttyChars[opcode]; ok {
+			args = append(args, name, sttyChar(value))
+			continue
+		}
+
+		if name, ok := sttyFlags[opcode]; ok {
+			if value == 0 {
+				name = "-" + name
+			}
+			args = append(args, name)
+		}
+	}
+
+	return args
+}
+
+// sttyChar formats a special character in the ^X form understood by gnu and busybox stty
+// 0 disables the character on linux, bytes from 128 have no portable form and are disabled too
+func sttyChar(value uint32) string {
+	switch {
+	case value == 0 || value >= 128:
+		return "undef"
+	case value == 127:
+		return "^?"
+	case value < 32:
+		return "^" + string(rune(value+64))
+	default:
+		return string(rune(value))
+	}
+}
+
+// WithTerminalModes prefixes cmd with an stty prelude applying the modes of the client to the pty,
+// the command runs as is when there is nothing to apply. the target needs sh and stty, a failing stty is ignored
+func WithTerminalModes(cmd []string, modes ssh.TerminalModes) []string {
+	args := sttyArgs(modes)
+	if len(args) == 0 || len(cmd) == 0 {
+		return cmd
+	}
+
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+	}
+
+	script := "stty " + strings.Join(quoted, " ") + ` 2>/dev/null; exec "$@"`
+
+	return append([]string{"/bin/sh", "-c", script, "sh"}, cmd...)
+}
+
+// CmdWithTerminalModes is Cmd with the stty prelude for shell sessions with a pty, the default command being a shell
+// the target has sh. commands of exec requests run as is since the target may have no shell
+func (e ExecConfig) CmdWithTerminalModes() []string {
+	if !e.Tty || !e.Shell {
+		return e.Cmd
+	}
+
+	return WithTerminalModes(e.Cmd, e.Modes)
+}
@@ -0,0 +1,71 @@
+package bridge
+
+import (
+	"fmt"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestParseTerminalModes(t *testing.T) {
+	// encoded like ssh clients do, the speeds are followed by TTY_OP_END
+	encoded := string([]byte{
+		ssh.VERASE, 0, 0, 0, 127,
+		ssh.ECHO, 0, 0, 0, 1,
+		ssh.TTY_OP_ISPEED, 0, 0, 0x96, 0,
+		ttyOpEnd,
+		ssh.ICRNL, 0, 0, 0, 1,
+	})
+
+	modes := parseTerminalModes(encoded)
+
+	if len(modes) != 3 || modes[ssh.VERASE] != 127 || modes[ssh.ECHO] != 1 || modes[ssh.TTY_OP_ISPEED] != 38400 {
+		t.Fatalf("unexpected modes %v", modes)
+	}
+
+	if modes := parseTerminalModes(string([]byte{ssh.ECHO, 0, 0})); len(modes) != 0 {
+		t.Fatalf("expected truncated modes to be ignored, got %v", modes)
+	}
+}
+
+func TestWithTerminalModes(t *testing.T) {
+	tests := []struct {
+		modes    ssh.TerminalModes
+		expected string
+	}{
+		{nil, "[/bin/bash -l]"},
+		{ssh.TerminalModes{ssh.TTY_OP_ISPEED: 38400, ssh.CS8: 1}, "[/bin/bash -l]"},
+		{
+			ssh.TerminalModes{ssh.VINTR: 3, ssh.VERASE: 127, ssh.VEOL: 255, ssh.VSTART: 'q', ssh.ICRNL: 1, ssh.ECHO: 0, ssh.TTY_OP_ISPEED: 38400},
+			`[/bin/sh -c stty 'intr' '^C' 'erase' '^?' 'eol' 'undef' 'start' 'q' 'icrnl' '-echo' 2>/dev/null; exec "$@" sh /bin/bash -l]`,
+		},
+		{ssh.TerminalModes{ssh.VKILL: '\''}, `[/bin/sh -c stty 'kill' ''\''' 2>/dev/null; exec "$@" sh /bin/bash -l]`},
+	}
+
+	for _, tt := range tests {
+		if got := fmt.Sprint(WithTerminalModes([]string{"/bin/bash", "-l"}, tt.modes)); got != tt.expected {
+			t.Fatalf("WithTerminalModes(%v) = %v, expected %v", tt.modes, got, tt.expected)
+		}
+	}
+}
+
+func TestSttyChar(t *testing.T) {
+	tests := []struct {
+		value    uint32
+		expected string
+	}{
+		{0, "undef"},
+		{3, "^C"},
+		{'q', "q"},
+		{127, "^?"},
+		{128, "undef"},
+		{200, "undef"},
+		{255, "undef"},
+	}
+
+	for _, tt := range tests {
+		if got := sttyChar(tt.value); got != tt.expected {
+			t.Fatalf("sttyChar(%v) = %q, expected %q", tt.value, got, tt.expected)
+		}
+	}
+}
@@ -0,0 +1,325 @@
+package bridge
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tg123/docker-sshd/pkg/sshauth"
+)
+
+var _ SessionProvider = (*picker)(nil)
+
+// Target is an entry of the picker menu
+type Target struct {
+	Name        string
+	Description string
+}
+
+// TargetLister lists the targets the user may pick from
+type TargetLister func(ctx context.Context) ([]Target, error)
+
+// picker shows a menu in the ssh session and creates the real provider for the chosen target
+// the target is chosen once per connection, later sessions use it without the menu
+type picker struct {
+	list   TargetLister
+	create func(target string) (SessionProvider, error)
+
+	mu       sync.Mutex
+	provider SessionProvider
+}
+
+// NewPicker returns a provider which lets the user choose the target interactively before the first exec
+func NewPicker(list TargetLister, create func(target string) (SessionProvider, error)) SessionProvider {
+	return &picker{
+		list:   list,
+		create: create,
+	}
+}
+
+func (p *picker) NewSession() Session {
+	return &pickerSession{picker: p}
+}
+
+// Close closes the provider of the chosen target, nothing was created if no target was picked
+func (p *picker) Close() error {
+	p.mu.Lock()
+	provider := p.provider
+	p.mu.Unlock()
+
+	if provider == nil {
+		return nil
+	}
+
+	return provider.Close()
+}
+
+// Target is the target of the chosen provider, empty before a target is picked
+func (p *picker) Target() string {
+	p.mu.Lock()
+	provider := p.provider
+	p.mu.Unlock()
+
+	if provider == nil {
+		return ""
+	}
+
+	return TargetOf(provider)
+}
+
+// Dial uses the Dialer of the chosen provider, forwards before a target is picked are not supported
+func (p *picker) Dial(ctx context.Context, network, address string) (net.Conn, error) {
+	p.mu.Lock()
+	provider := p.provider
+	p.mu.Unlock()
+
+	if provider == nil {
+		return nil, fmt.Errorf("no target selected, %v cannot be forwarded", address)
+	}
+
+	return DialProvider(ctx, provider, network, address)
+}
+
+// chosen returns the provider of the connection, the first chosen target wins if menus of several sessions race
+func (p *picker) chosen(provider SessionProvider) SessionProvider {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.provider == nil {
+		p.provider = provider
+		return provider
+	}
+
+	if provider != nil {
+		log.Infof("picker target already chosen by another session")
+		_ = provider.Close()
+	}
+
+	return p.provider
+}
+
+// pickerSession is a session before and after its target is chosen
+type pickerSession struct {
+	picker *picker
+
+	mu      sync.Mutex
+	session Session
+	size    *ResizeOptions
+}
+
+func (s *pickerSession) Resize(ctx context.Context, size ResizeOptions) error {
+	s.mu.Lock()
+	session := s.session
+	if session == nil {
+		s.size = &size
+	}
+	s.mu.Unlock()
+
+	if session == nil {
+		return nil
+	}
+
+	return session.Resize(ctx, size)
+}
+
+// start creates the session of provider with the size received so far and execs
+func (s *pickerSession) start(ctx context.Context, provider SessionProvider, execconfig ExecConfig) (<-chan ExecResult, error) {
+	session := provider.NewSession()
+
+	s.mu.Lock()
+	s.session = session
+	size := s.size
+	s.mu.Unlock()
+
+	if size != nil {
+		if err := session.Resize(ctx, *size); err != nil {
+			return nil, err
+		}
+	}
+
+	return session.Exec(ctx, execconfig)
+}
+
+func (s *pickerSession) Exec(ctx context.Context, execconfig ExecConfig) (<-chan ExecResult, error) {
+	if provider := s.picker.chosen(nil); provider != nil {
+		return s.start(ctx, provider, execconfig)
+	}
+
+	if !execconfig.Tty {
+		return nil, fmt.Errorf("no target selected, connect with a terminal to pick one")
+	}
+
+	r := make(chan ExecResult, 1)
+
+	// menu runs in background, exec must return for window-change requests to be served
+	go func() {
+		result, err := s.pickAndExec(ctx, execconfig)
+		if err != nil {
+			_, _ = fmt.Fprintf(execconfig.Output, "%v\r\n", err)
+			r <- ExecResult{ExitCode: 1, Error: err}
+			return
+		}
+
+		select {
+		case res := <-result:
+			r <- res
+		case <-ctx.Done():
+		}
+	}()
+
+	return r, nil
+}
+
+func (s *pickerSession) pickAndExec(ctx context.Context, execconfig ExecConfig) (<-chan ExecResult, error) {
+	targets, err := s.picker.list(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list targets: %v", err)
+	}
+
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("no target available")
+	}
+
+	target, err := runMenu(execconfig.Input, execconfig.Output, targets)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Infof("picker selected target [%v]", target)
+
+	provider, err := s.picker.create(target)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.start(ctx, s.picker.chosen(provider), execconfig)
+}
+
+// runMenu prints targets matching the filter and reads a line until a number is chosen
+func runMenu(in io.Reader, out io.Writer, targets []Target) (string, error) {
+	filter := ""
+
+	for {
+		shown := make([]Target, 0, len(targets))
+		for _, t := range targets {
+			if strings.Contains(strings.ToLower(t.Name+" "+t.Description), strings.ToLower(filter)) {
+				shown = append(shown, t)
+			}
+		}
+
+		_, _ = fmt.Fprintf(out, "\r\n")
+		for i, t := range shown {
+			_, _ = fmt.Fprintf(out, "%3d) %-40s %s\r\n", i+1, t.Name, t.Description)
+		}
+
+		if len(shown) == 0 {
+			_, _ = fmt.Fprintf(out, "no target matches [%v]\r\n", filter)
+		}
+
+		_, _ = fmt.Fprintf(out, "\r\nnumber to connect, text to search, empty to list all, q to quit> ")
+
+		line, err := readLine(in, out)
+		if err != nil {
+			return "", err
+		}
+
+		line = strings.TrimSpace(line)
+
+		if line == "q" {
+			return "", fmt.Errorf("no target selected")
+		}
+
+		if n, err := strconv.Atoi(line); err == nil {
+			if n < 1 || n > len(shown) {
+				_, _ = fmt.Fprintf(out, "%v is out of range\r\n", n)
+				continue
+			}
+
+			return shown[n-1].Name, nil
+		}
+
+		filter = line
+	}
+}
+
+// readLine reads one byte at a time so nothing after enter is consumed, remote terminal is raw so echo is done here
+func readLine(in io.Reader, out io.Writer) (string, error) {
+	var line []byte
+	b := make([]byte, 1)
+
+	for {
+		if _, err := io.ReadFull(in, b); err != nil {
+			return "", err
+		}
+
+		switch c := b[0]; c {
+		case '\r', '\n':
+			_, _ = out.Write([]byte("\r\n"))
+			return string(line), nil
+		case 0x03, 0x04: // ctrl-c, ctrl-d
+			_, _ = out.Write([]byte("\r\n"))
+			return "", fmt.Errorf("no target selected")
+		case 0x7f, '\b':
+			if len(line) > 0 {
+				line = line[:len(line)-1]
+				_, _ = out.Write([]byte("\b \b"))
+			}
+		default:
+			if c >= 0x20 && c < 0x7f {
+				line = append(line, c)
+				_, _ = out.Write(b)
+			}
+		}
+	}
+}
+
+// AllowTargets returns a policy which allows targets matching any of the glob patterns, all targets are allowed if patterns is empty
+func AllowTargets(patterns []string) func(target string) bool {
+	return func(target string) bool {
+		if len(patterns) == 0 {
+			return true
+		}
+
+		for _, p := range patterns {
+			if ok, _ := path.Match(p, target); ok {
+				return true
+			}
+		}
+
+		return false
+	}
+}
+
+// TargetPolicy returns a policy which allows targets matching both patterns, see AllowTargets, and the allow-target option of the identity's key
+func TargetPolicy(patterns []string) func(id sshauth.Identity, target string) bool {
+	global := AllowTargets(patterns)
+
+	return func(id sshauth.Identity, target string) bool {
+		return global(target) && AllowTargets(id.Targets)(target)
+	}
+}
+
+// FilterTargets wraps list and keeps only the targets allowed by policy
+func FilterTargets(list TargetLister, allow func(target string) bool) TargetLister {
+	return func(ctx context.Context) ([]Target, error) {
+		targets, err := list(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		allowed := targets[:0]
+		for _, t := range targets {
+			if allow(t.Name) {
+				allowed = append(allowed, t)
+			}
+		}
+
+		return allowed, nil
+	}
+}
@@ -0,0 +1,217 @@
+package bridge
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tg123/docker-sshd/pkg/sshauth"
+)
+
+func TestRunMenuSearchAndSelect(t *testing.T) {
+	targets := []Target{
+		{Name: "web-1", Description: "nginx"},
+		{Name: "db-1", Description: "postgres"},
+		{Name: "web-2", Description: "nginx"},
+	}
+
+	var out bytes.Buffer
+	// search "web", backspace typo, then pick the second match
+	in := strings.NewReader("webx\x7f\r2\r")
+
+	target, err := runMenu(in, &out, targets)
+	if err != nil {
+		t.Fatalf("runMenu returned error: %v", err)
+	}
+
+	if target != "web-2" {
+		t.Fatalf("expected web-2, got %v", target)
+	}
+
+	if !strings.Contains(out.String(), "db-1") {
+		t.Fatalf("expected full list first, got %q", out.String())
+	}
+}
+
+func TestRunMenuQuit(t *testing.T) {
+	var out bytes.Buffer
+
+	if _, err := runMenu(strings.NewReader("\x03"), &out, []Target{{Name: "c1"}}); err == nil {
+		t.Fatal("expected ctrl-c to abort the menu")
+	}
+}
+
+func TestPickerDelegatesToChosenProvider(t *testing.T) {
+	provider := &fakeProvider{execResults: make(chan ExecResult, 1)}
+	created := ""
+
+	p := NewPicker(
+		FilterTargets(func(ctx context.Context) ([]Target, error) {
+			return []Target{{Name: "c1"}, {Name: "secret"}}, nil
+		}, AllowTargets([]string{"c*"})),
+		func(target string) (SessionProvider, error) {
+			created = target
+			return provider, nil
+		},
+	)
+
+	session := p.NewSession()
+
+	if err := session.Resize(context.Background(), ResizeOptions{Width: 80, Height: 24}); err != nil {
+		t.Fatalf("Resize returned error: %v", err)
+	}
+
+	var out bytes.Buffer
+	r, err := session.Exec(context.Background(), ExecConfig{
+		Input:  strings.NewReader("1\r"),
+		Output: &out,
+		Tty:    true,
+		Cmd:    []string{"/bin/sh"},
+	})
+	if err != nil {
+		t.Fatalf("Exec returned error: %v", err)
+	}
+
+	provider.execResults <- ExecResult{ExitCode: 7}
+
+	select {
+	case result := <-r:
+		if result.ExitCode != 7 {
+			t.Fatalf("expected exit code of chosen provider, got %v", result.ExitCode)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected exec result")
+	}
+
+	if created != "c1" {
+		t.Fatalf("expected c1 to be created, got %v", created)
+	}
+
+	if strings.Contains(out.String(), "secret") {
+		t.Fatalf("expected disallowed target to be hidden, got %q", out.String())
+	}
+
+	provider.mu.Lock()
+	defer provider.mu.Unlock()
+
+	if len(provider.resizeCalls) != 1 || provider.resizeCalls[0].Width != 80 {
+		t.Fatalf("expected pending size to be applied, got %#v", provider.resizeCalls)
+	}
+
+	if len(provider.execCalls) != 1 || provider.execCalls[0].Cmd[0] != "/bin/sh" {
+		t.Fatalf("unexpected exec calls %#v", provider.execCalls)
+	}
+}
+
+func TestPickerLaterSessionsUseChosenTarget(t *testing.T) {
+	provider := &fakeProvider{execResults: make(chan ExecResult, 2)}
+	creates := 0
+
+	p := NewPicker(
+		func(ctx context.Context) ([]Target, error) {
+			return []Target{{Name: "c1"}}, nil
+		},
+		func(target string) (SessionProvider, error) {
+			creates++
+			return provider, nil
+		},
+	)
+
+	var out bytes.Buffer
+	r, err := p.NewSession().Exec(context.Background(), ExecConfig{
+		Input:  strings.NewReader("1\r"),
+		Output: &out,
+		Tty:    true,
+		Cmd:    []string{"/bin/sh"},
+	})
+	if err != nil {
+		t.Fatalf("Exec returned error: %v", err)
+	}
+
+	provider.execResults <- ExecResult{}
+	<-r
+
+	// no terminal and no menu, the session goes to the target chosen by the first one
+	if _, err := p.NewSession().Exec(context.Background(), ExecConfig{Cmd: []string{"id"}}); err != nil {
+		t.Fatalf("Exec of second session returned error: %v", err)
+	}
+
+	if creates != 1 {
+		t.Fatalf("expected one provider for the connection, created %v", creates)
+	}
+
+	provider.mu.Lock()
+	defer provider.mu.Unlock()
+
+	if len(provider.execCalls) != 2 || provider.execCalls[1].Cmd[0] != "id" {
+		t.Fatalf("unexpected exec calls %#v", provider.execCalls)
+	}
+}
+
+func TestPickerDialsThroughChosenProvider(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	defer listener.Close()
+
+	go func() {
+		if c, err := listener.Accept(); err == nil {
+			_ = c.Close()
+		}
+	}()
+
+	p := NewPicker(nil, nil).(*picker)
+
+	if _, err := p.Dial(context.Background(), "tcp", "localhost:22"); err == nil {
+		t.Fatal("expected dial before a target is picked to fail")
+	}
+
+	p.chosen(&dialerProvider{addr: listener.Addr().String()})
+
+	conn, err := p.Dial(context.Background(), "tcp", "localhost:22")
+	if err != nil {
+		t.Fatalf("Dial returned error: %v", err)
+	}
+	_ = conn.Close()
+
+	// the chosen provider cannot reach it, direct-tcpip falls back to nc
+	if _, err := p.Dial(context.Background(), "tcp", "db:5432"); !errors.Is(err, errors.ErrUnsupported) {
+		t.Fatalf("expected ErrUnsupported, got %v", err)
+	}
+}
+
+func TestTargetPolicy(t *testing.T) {
+	allow := TargetPolicy([]string{"web-*", "db-*"})
+
+	alice := sshauth.Identity{Name: "alice"}
+	bob := sshauth.Identity{Name: "bob", Targets: []string{"db-*", "cache"}}
+
+	tests := []struct {
+		id     sshauth.Identity
+		target string
+		want   bool
+	}{
+		{alice, "web-1", true},
+		{alice, "db-1", true},
+		{alice, "cache", false},
+		{bob, "db-1", true},
+		{bob, "web-1", false},
+		// the key cannot widen --allow-target
+		{bob, "cache", false},
+	}
+
+	for _, tt := range tests {
+		if got := allow(tt.id, tt.target); got != tt.want {
+			t.Fatalf("%v to %v: expected %v, got %v", tt.id.Name, tt.target, tt.want, got)
+		}
+	}
+
+	if !TargetPolicy(nil)(bob, "cache") || TargetPolicy(nil)(bob, "web-1") {
+		t.Fatal("expected the key patterns alone to apply without --allow-target")
+	}
+}
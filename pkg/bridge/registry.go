@@ -0,0 +1,347 @@
+package bridge
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// Registry keeps live connections for the admin api and interactive sessions which can be joined by other connections
+type Registry struct {
+	mu       sync.Mutex
+	sessions map[string]*sharedSession
+
+	nextID atomic.Uint64
+	conns  map[string]tracked
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		sessions: make(map[string]*sharedSession),
+		conns:    make(map[string]tracked),
+	}
+}
+
+// tracked is a live connection of the registry, a Bridge or a Conn of another transport
+type tracked interface {
+	info() ConnectionInfo
+	matches(target string) bool
+	broadcast(message string) int
+	Stop() error
+}
+
+// Targeter is implemented by providers which know what the username resolved to, e.g. the container id behind an alias
+type Targeter interface {
+	Target() string
+}
+
+type ConnectionInfo struct {
+	ID         string    `json:"id"`
+	User       string    `json:"user"`
+	RemoteAddr string    `json:"remote_addr"`
+	Target     string    `json:"target"`
+	Resolved   string    `json:"resolved,omitempty"`
+	Started    time.Time `json:"started"`
+	BytesIn    int64     `json:"bytes_in"`
+	BytesOut   int64     `json:"bytes_out"`
+	Commands   []string  `json:"commands"`
+}
+
+func (r *Registry) newID() string {
+	return strconv.FormatUint(r.nextID.Add(1), 10)
+}
+
+func (r *Registry) add(id string, c tracked) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.conns[id] = c
+}
+
+func (r *Registry) remove(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.conns, id)
+}
+
+func (r *Registry) tracked() []tracked {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	conns := make([]tracked, 0, len(r.conns))
+	for _, c := range r.conns {
+		conns = append(conns, c)
+	}
+
+	return conns
+}
+
+// Connections lists live connections, sorted by start time
+func (r *Registry) Connections() []ConnectionInfo {
+	conns := r.tracked()
+
+	infos := make([]ConnectionInfo, 0, len(conns))
+	for _, c := range conns {
+		infos = append(infos, c.info())
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Started.Before(infos[j].Started)
+	})
+
+	return infos
+}
+
+// Kill closes the connection with id
+func (r *Registry) Kill(id string) error {
+	r.mu.Lock()
+	c, ok := r.conns[id]
+	r.mu.Unlock()
+
+	if !ok {
+		return fmt.Errorf("connection %v not found", id)
+	}
+
+	info := c.info()
+	log.Infof("killing connection %v from %v to [%v]", id, info.RemoteAddr, info.Target)
+	return c.Stop()
+}
+
+// KillTarget closes all connections to target and returns how many were closed
+// target is the username or what it resolved to, see Targeter
+func (r *Registry) KillTarget(target string) int {
+	n := 0
+
+	for _, c := range r.tracked() {
+		if !c.matches(target) {
+			continue
+		}
+
+		info := c.info()
+		log.Infof("killing connection %v from %v to [%v]", info.ID, info.RemoteAddr, info.Target)
+		if err := c.Stop(); err != nil {
+			log.Warnf("failed to close connection %v: %v", info.ID, err)
+		}
+		n++
+	}
+
+	return n
+}
+
+// Broadcast writes message to the stderr of every open session, limited to target if not empty
+// it returns how many sessions received the message
+func (r *Registry) Broadcast(target, message string) int {
+	n := 0
+
+	for _, c := range r.tracked() {
+		if target != "" && !c.matches(target) {
+			continue
+		}
+
+		n += c.broadcast(message)
+	}
+
+	return n
+}
+
+const broadcastFormat = "\r\n[broadcast] %v\r\n"
+
+// connStats is the per connection accounting used by the admin api
+type connStats struct {
+	bytesIn  atomic.Int64
+	bytesOut atomic.Int64
+
+	mu       sync.Mutex
+	commands []string
+	channels map[ssh.Channel]struct{}
+}
+
+func (c *connStats) addCommand(cmd string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.commands = append(c.commands, cmd)
+}
+
+func (c *connStats) addChannel(channel ssh.Channel) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.channels == nil {
+		c.channels = make(map[ssh.Channel]struct{})
+	}
+	c.channels[channel] = struct{}{}
+}
+
+func (c *connStats) removeChannel(channel ssh.Channel) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.channels, channel)
+}
+
+// countingReader counts bytes read from the client
+type countingReader struct {
+	io.Reader
+	n *atomic.Int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.Reader.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// countingWriter counts bytes written to the client
+type countingWriter struct {
+	io.Writer
+	n *atomic.Int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.Writer.Write(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+func (b *Bridge) info() ConnectionInfo {
+	b.stats.mu.Lock()
+	commands := append([]string{}, b.stats.commands...)
+	b.stats.mu.Unlock()
+
+	return ConnectionInfo{
+		ID:         b.id,
+		User:       b.sshConn.User(),
+		RemoteAddr: b.remoteAddr(),
+		Target:     b.target,
+		Resolved:   b.resolved(),
+		Started:    b.started,
+		BytesIn:    b.stats.bytesIn.Load(),
+		BytesOut:   b.stats.bytesOut.Load(),
+		Commands:   commands,
+	}
+}
+
+// TargetOf returns the target of provider, empty if it does not know it
+func TargetOf(provider SessionProvider) string {
+	if t, ok := provider.(Targeter); ok {
+		return t.Target()
+	}
+
+	return ""
+}
+
+// resolved is the target of the provider, the picker knows it once chosen
+func (b *Bridge) resolved() string {
+	return TargetOf(b.provider)
+}
+
+// matches reports whether target is the username or the resolved target of the connection
+func (b *Bridge) matches(target string) bool {
+	return matchTarget(target, b.target, b.resolved())
+}
+
+func matchTarget(target, username, resolved string) bool {
+	return target == username || (resolved != "" && target == resolved)
+}
+
+func (b *Bridge) remoteAddr() string {
+	return addrString(b.sshConn.RemoteAddr())
+}
+
+func (b *Bridge) broadcast(message string) int {
+	b.stats.mu.Lock()
+	channels := make([]ssh.Channel, 0, len(b.stats.channels))
+	for channel := range b.stats.channels {
+		channels = append(channels, channel)
+	}
+	b.stats.mu.Unlock()
+
+	for _, channel := range channels {
+		_, _ = fmt.Fprintf(channel.Stderr(), broadcastFormat, message)
+	}
+
+	return len(channels)
+}
+
+// Conn is a connection of another transport than ssh, e.g. the web terminal,
+// the admin api lists, kills and broadcasts to it like to ssh connections
+type Conn struct {
+	User       string
+	RemoteAddr string
+	Target     string
+
+	// Provider tells what the target resolved to, see Targeter
+	Provider SessionProvider
+
+	// Close ends the connection, broadcast messages are written to Terminal
+	Close    func() error
+	Terminal io.Writer
+
+	id      string
+	started time.Time
+	stats   connStats
+}
+
+// Register adds c to the live connections until Unregister
+func (r *Registry) Register(c *Conn) {
+	c.id = r.newID()
+	c.started = time.Now()
+	r.add(c.id, c)
+}
+
+func (r *Registry) Unregister(c *Conn) {
+	r.remove(c.id)
+}
+
+// CountInput counts what the client sends through in
+func (c *Conn) CountInput(in io.Reader) io.Reader {
+	return &countingReader{Reader: in, n: &c.stats.bytesIn}
+}
+
+// CountOutput counts what the client receives through out
+func (c *Conn) CountOutput(out io.Writer) io.Writer {
+	return &countingWriter{Writer: out, n: &c.stats.bytesOut}
+}
+
+// AddCommand records a command run by the connection
+func (c *Conn) AddCommand(cmd string) {
+	c.stats.addCommand(cmd)
+}
+
+func (c *Conn) Stop() error {
+	return c.Close()
+}
+
+func (c *Conn) info() ConnectionInfo {
+	c.stats.mu.Lock()
+	commands := append([]string{}, c.stats.commands...)
+	c.stats.mu.Unlock()
+
+	return ConnectionInfo{
+		ID:         c.id,
+		User:       c.User,
+		RemoteAddr: c.RemoteAddr,
+		Target:     c.Target,
+		Resolved:   TargetOf(c.Provider),
+		Started:    c.started,
+		BytesIn:    c.stats.bytesIn.Load(),
+		BytesOut:   c.stats.bytesOut.Load(),
+		Commands:   commands,
+	}
+}
+
+func (c *Conn) matches(target string) bool {
+	return matchTarget(target, c.Target, TargetOf(c.Provider))
+}
+
+func (c *Conn) broadcast(message string) int {
+	_, _ = fmt.Fprintf(c.Terminal, broadcastFormat, message)
+	return 1
+}
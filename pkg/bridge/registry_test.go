@@ -0,0 +1,172 @@
+package bridge
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// newTestBridge runs a bridge over loopback tcp and returns the connected client
+func newTestBridge(t *testing.T, user string, provider SessionProvider, config *BridgeConfig) (*Bridge, *ssh.Client) {
+	t.Helper()
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate host key: %v", err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatalf("failed to create signer: %v", err)
+	}
+
+	serverConfig := &ssh.ServerConfig{NoClientAuth: true}
+	serverConfig.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	defer listener.Close()
+
+	clientCh := make(chan *ssh.Client, 1)
+	go func() {
+		c, err := ssh.Dial("tcp", listener.Addr().String(), &ssh.ClientConfig{
+			User:            user,
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		})
+		if err != nil {
+			t.Errorf("client handshake failed: %v", err)
+			clientCh <- nil
+			return
+		}
+		clientCh <- c
+	}()
+
+	serverConn, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("accept failed: %v", err)
+	}
+
+	b, err := New(serverConn, serverConfig, config, func(*ssh.ServerConn) (SessionProvider, error) {
+		return provider, nil
+	})
+	if err != nil {
+		t.Fatalf("New returned error: %v", err)
+	}
+
+	client := <-clientCh
+	if client == nil {
+		t.FailNow()
+	}
+
+	go b.Start()
+
+	return b, client
+}
+
+func TestRegistryTracksAndKillsConnections(t *testing.T) {
+	registry := NewRegistry()
+	provider := &fakeProvider{execResults: make(chan ExecResult, 1)}
+
+	_, client := newTestBridge(t, "c1", provider, &BridgeConfig{Registry: registry})
+	defer client.Close()
+
+	conns := registry.Connections()
+	if len(conns) != 1 || conns[0].User != "c1" || conns[0].Target != "c1" || conns[0].ID == "" {
+		t.Fatalf("unexpected connections %#v", conns)
+	}
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("NewSession returned error: %v", err)
+	}
+
+	if err := session.Start("uptime"); err != nil {
+		t.Fatalf("Start returned error: %v", err)
+	}
+
+	if conns := registry.Connections(); len(conns[0].Commands) != 1 || conns[0].Commands[0] != "uptime" {
+		t.Fatalf("expected command to be recorded, got %#v", conns[0].Commands)
+	}
+
+	if n := registry.Broadcast("other", "maintenance"); n != 0 {
+		t.Fatalf("expected broadcast to other target to reach no session, got %v", n)
+	}
+
+	if n := registry.Broadcast("c1", "maintenance"); n != 1 {
+		t.Fatalf("expected broadcast to reach 1 session, got %v", n)
+	}
+
+	if err := registry.Kill("missing"); err == nil {
+		t.Fatal("expected error when killing unknown connection")
+	}
+
+	if n := registry.KillTarget("c1"); n != 1 {
+		t.Fatalf("expected 1 connection killed, got %v", n)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- client.Wait() }()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected client connection to be closed")
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for len(registry.Connections()) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected connection to be removed, got %#v", registry.Connections())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// targetedProvider resolved the username to a container id
+type targetedProvider struct {
+	fakeProvider
+	id string
+}
+
+func (p *targetedProvider) NewSession() Session {
+	return p
+}
+
+func (p *targetedProvider) Target() string {
+	return p.id
+}
+
+func TestRegistryMatchesResolvedTarget(t *testing.T) {
+	registry := NewRegistry()
+	provider := WithExecDefaults(&targetedProvider{id: "0123abcd"}, "app", "")
+
+	_, client := newTestBridge(t, "web", provider, &BridgeConfig{Registry: registry})
+	defer client.Close()
+
+	if conns := registry.Connections(); len(conns) != 1 || conns[0].Target != "web" || conns[0].Resolved != "0123abcd" {
+		t.Fatalf("unexpected connections %#v", conns)
+	}
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("NewSession returned error: %v", err)
+	}
+
+	if err := session.Start("uptime"); err != nil {
+		t.Fatalf("Start returned error: %v", err)
+	}
+
+	if n := registry.Broadcast("0123abcd", "maintenance"); n != 1 {
+		t.Fatalf("expected broadcast to the container id to reach 1 session, got %v", n)
+	}
+
+	if n := registry.KillTarget("0123abcd"); n != 1 {
+		t.Fatalf("expected connection to the container id to be killed, got %v", n)
+	}
+}
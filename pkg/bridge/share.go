@@ -0,0 +1,356 @@
+package bridge
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tg123/docker-sshd/pkg/sshauth"
+	"golang.org/x/crypto/ssh"
+)
+
+// JoinPrefix is the ssh username prefix to attach to a shared session, e.g. join+<id>
+const JoinPrefix = "join+"
+
+const viewerBufferSize = 256
+
+type ViewerInfo struct {
+	RemoteAddr string    `json:"remote_addr"`
+	ReadWrite  bool      `json:"read_write"`
+	Joined     time.Time `json:"joined"`
+}
+
+type SessionInfo struct {
+	ID         string       `json:"id"`
+	Target     string       `json:"target"`
+	RemoteAddr string       `json:"remote_addr"`
+	Started    time.Time    `json:"started"`
+	Viewers    []ViewerInfo `json:"viewers"`
+}
+
+// Sessions lists shared sessions and their viewers, sorted by start time
+func (r *Registry) Sessions() []SessionInfo {
+	r.mu.Lock()
+	sessions := make([]*sharedSession, 0, len(r.sessions))
+	for id, s := range r.sessions {
+		if id == s.id {
+			sessions = append(sessions, s)
+		}
+	}
+	r.mu.Unlock()
+
+	infos := make([]SessionInfo, 0, len(sessions))
+	for _, s := range sessions {
+		infos = append(infos, s.info())
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Started.Before(infos[j].Started)
+	})
+
+	return infos
+}
+
+func newShareID() string {
+	b := make([]byte, 6)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// register creates a shared session, id grants read-only access and driveID grants input
+// perms are the permissions of the owner's connection, see mayJoin
+func (r *Registry) registerShared(target string, perms *ssh.Permissions, remote net.Addr, owner io.Writer) *sharedSession {
+	s := &sharedSession{
+		registry:   r,
+		id:         newShareID(),
+		driveID:    newShareID(),
+		target:     target,
+		remoteAddr: addrString(remote),
+		started:    time.Now(),
+		owner:      owner,
+		viewers:    make(map[*viewer]struct{}),
+		done:       make(chan struct{}),
+	}
+
+	s.identity, s.authenticated = sshauth.FromPermissions(perms)
+
+	s.input, s.inputWriter = io.Pipe()
+
+	r.mu.Lock()
+	r.sessions[s.id] = s
+	r.sessions[s.driveID] = s
+	r.mu.Unlock()
+
+	return s
+}
+
+// lookup returns the session and whether the id grants input
+// sessions perms may not join are reported as not found, the id alone is not enough
+func (r *Registry) lookupShared(id string, perms *ssh.Permissions) (*sharedSession, bool, error) {
+	r.mu.Lock()
+	s, ok := r.sessions[id]
+	r.mu.Unlock()
+
+	if !ok {
+		return nil, false, fmt.Errorf("shared session %v not found", id)
+	}
+
+	if !s.mayJoin(perms) {
+		joiner, _ := sshauth.FromPermissions(perms)
+		log.Warnf("[%v] may not join shared session %v of [%v]", joiner.Name, s.id, s.identity.Name)
+		return nil, false, fmt.Errorf("shared session %v not found", id)
+	}
+
+	return s, id == s.driveID, nil
+}
+
+func (r *Registry) unregisterShared(s *sharedSession) {
+	r.mu.Lock()
+	delete(r.sessions, s.id)
+	delete(r.sessions, s.driveID)
+	r.mu.Unlock()
+}
+
+type viewer struct {
+	remoteAddr string
+	readWrite  bool
+	joined     time.Time
+
+	output io.Writer
+	buf    chan []byte
+}
+
+func (v *viewer) run() {
+	for p := range v.buf {
+		if _, err := v.output.Write(p); err != nil {
+			log.Debugf("viewer %v write failed: %v", v.remoteAddr, err)
+		}
+	}
+}
+
+// sharedSession fans out exec output to viewers and merges input of the owner and co-drivers
+type sharedSession struct {
+	registry *Registry
+
+	id         string
+	driveID    string
+	target     string
+	remoteAddr string
+	started    time.Time
+
+	owner io.Writer
+
+	// identity of the owner, authenticated is false for connections without --authorized-keys
+	identity      sshauth.Identity
+	authenticated bool
+
+	input       *io.PipeReader
+	inputWriter *io.PipeWriter
+
+	mu      sync.Mutex
+	viewers map[*viewer]struct{}
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (s *sharedSession) Write(p []byte) (int, error) {
+	n, err := s.owner.Write(p)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for v := range s.viewers {
+		select {
+		case v.buf <- append([]byte(nil), p...):
+		default:
+			log.Warnf("viewer %v of shared session %v is too slow, output dropped", v.remoteAddr, s.id)
+		}
+	}
+
+	return n, err
+}
+
+// mayJoin reports whether a connection with perms may join, it must be the owner's identity or share a group with it
+// sessions of unauthenticated owners can be joined by anyone, who could connect to their target as well
+func (s *sharedSession) mayJoin(perms *ssh.Permissions) bool {
+	if !s.authenticated {
+		return true
+	}
+
+	id, ok := sshauth.FromPermissions(perms)
+	if !ok {
+		return false
+	}
+
+	if id.Name == s.identity.Name {
+		return true
+	}
+
+	for _, g := range s.identity.Groups {
+		if id.InGroup(g) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// feed copies r into the session input until r is drained
+func (s *sharedSession) feed(r io.Reader) {
+	_, _ = io.Copy(s.inputWriter, r)
+}
+
+func (s *sharedSession) join(output io.Writer, remote net.Addr, readWrite bool) *viewer {
+	v := &viewer{
+		remoteAddr: addrString(remote),
+		readWrite:  readWrite,
+		joined:     time.Now(),
+		output:     output,
+		buf:        make(chan []byte, viewerBufferSize),
+	}
+
+	s.mu.Lock()
+	s.viewers[v] = struct{}{}
+	s.mu.Unlock()
+
+	go v.run()
+
+	return v
+}
+
+func (s *sharedSession) leave(v *viewer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.viewers[v]; !ok {
+		return
+	}
+
+	delete(s.viewers, v)
+	close(v.buf)
+}
+
+func (s *sharedSession) close() {
+	s.closeOnce.Do(func() {
+		s.registry.unregisterShared(s)
+		_ = s.inputWriter.Close()
+		close(s.done)
+	})
+}
+
+func (s *sharedSession) info() SessionInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	info := SessionInfo{
+		ID:         s.id,
+		Target:     s.target,
+		RemoteAddr: s.remoteAddr,
+		Started:    s.started,
+		Viewers:    make([]ViewerInfo, 0, len(s.viewers)),
+	}
+
+	for v := range s.viewers {
+		info.Viewers = append(info.Viewers, ViewerInfo{
+			RemoteAddr: v.remoteAddr,
+			ReadWrite:  v.readWrite,
+			Joined:     v.joined,
+		})
+	}
+
+	sort.Slice(info.Viewers, func(i, j int) bool {
+		return info.Viewers[i].Joined.Before(info.Viewers[j].Joined)
+	})
+
+	return info
+}
+
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
+
+// joinID returns the session id from a join+<id> username
+func joinID(user string) (string, bool) {
+	if !strings.HasPrefix(user, JoinPrefix) {
+		return "", false
+	}
+
+	return strings.TrimPrefix(user, JoinPrefix), true
+}
+
+// handleJoinedSession attaches a session channel of a joining connection to the shared session
+func (b *Bridge) handleJoinedSession(channel ssh.Channel, requests <-chan *ssh.Request, _ []byte) {
+	defer channel.Close()
+
+	started := false
+	left := make(chan struct{})
+	defer close(left)
+
+	b.stats.addChannel(channel)
+	defer b.stats.removeChannel(channel)
+
+	for req := range requests {
+		var err error
+
+		switch req.Type {
+		case "pty-req", "env", "window-change":
+			// the owner controls the terminal
+		case "shell":
+			if started {
+				err = fmt.Errorf("already attached")
+				break
+			}
+			started = true
+			go b.attach(channel, left)
+		default:
+			err = fmt.Errorf("%v is not supported when joining a shared session", req.Type)
+		}
+
+		if err != nil {
+			log.Warnf("failed to handle %v request: %v", req.Type, err)
+		}
+
+		if req.WantReply {
+			_ = req.Reply(err == nil, nil)
+		}
+	}
+}
+
+func (b *Bridge) attach(channel ssh.Channel, left <-chan struct{}) {
+	s := b.joined
+	remote := b.sshConn.RemoteAddr()
+
+	v := s.join(&countingWriter{Writer: channel, n: &b.stats.bytesOut}, remote, b.joinedReadWrite)
+	defer s.leave(v)
+
+	mode := "read-only"
+	if b.joinedReadWrite {
+		mode = "read-write"
+		go s.feed(&countingReader{Reader: channel, n: &b.stats.bytesIn})
+	} else {
+		go func() { _, _ = io.Copy(io.Discard, channel) }()
+	}
+
+	log.Infof("%v joined shared session %v to [%v] %v", addrString(remote), s.id, s.target, mode)
+	_, _ = fmt.Fprintf(channel.Stderr(), "joined shared session %v to [%v] %v\r\n", s.id, s.target, mode)
+
+	select {
+	case <-s.done:
+	case <-left:
+		return
+	}
+
+	_, _ = channel.SendRequest("exit-status", false, ssh.Marshal(&struct{ uint32 }{0}))
+	_ = channel.Close()
+}
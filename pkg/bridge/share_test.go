@@ -0,0 +1,211 @@
+package bridge
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tg123/docker-sshd/pkg/sshauth"
+	"golang.org/x/crypto/ssh"
+)
+
+type recordingChannel struct {
+	*fakeChannel
+
+	mu  sync.Mutex
+	out bytes.Buffer
+}
+
+func newRecordingChannel() *recordingChannel {
+	return &recordingChannel{fakeChannel: newFakeChannel()}
+}
+
+func (c *recordingChannel) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.out.Write(p)
+}
+
+func (c *recordingChannel) output() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.out.String()
+}
+
+func TestRegistryLookupPermissions(t *testing.T) {
+	r := NewRegistry()
+	s := r.registerShared("c1", nil, nil, io.Discard)
+
+	got, rw, err := r.lookupShared(s.id, nil)
+	if err != nil || got != s || rw {
+		t.Fatalf("expected read-only lookup by id, got %v %v %v", got, rw, err)
+	}
+
+	got, rw, err = r.lookupShared(s.driveID, nil)
+	if err != nil || got != s || !rw {
+		t.Fatalf("expected read-write lookup by drive id, got %v %v %v", got, rw, err)
+	}
+
+	if sessions := r.Sessions(); len(sessions) != 1 || sessions[0].ID != s.id || sessions[0].Target != "c1" {
+		t.Fatalf("unexpected sessions %#v", sessions)
+	}
+
+	s.close()
+
+	if _, _, err := r.lookupShared(s.id, nil); err == nil {
+		t.Fatal("expected closed session to be unregistered")
+	}
+
+	if sessions := r.Sessions(); len(sessions) != 0 {
+		t.Fatalf("expected no sessions, got %#v", sessions)
+	}
+}
+
+func TestRegistryLookupSharedOfIdentity(t *testing.T) {
+	r := NewRegistry()
+	owner := sshauth.Identity{Name: "alice", Groups: []string{"dev"}}
+	s := r.registerShared("c1", owner.Permissions(), nil, io.Discard)
+	defer s.close()
+
+	for _, tc := range []struct {
+		joiner *sshauth.Identity
+		ok     bool
+	}{
+		{&sshauth.Identity{Name: "alice"}, true},
+		{&sshauth.Identity{Name: "bob", Groups: []string{"ops", "dev"}}, true},
+		{&sshauth.Identity{Name: "carol", Groups: []string{"ops"}}, false},
+		{nil, false},
+	} {
+		var perms *ssh.Permissions
+		if tc.joiner != nil {
+			perms = tc.joiner.Permissions()
+		}
+
+		// the drive id grants write access to the shell of alice, knowing it is not enough
+		_, _, err := r.lookupShared(s.driveID, perms)
+		if (err == nil) != tc.ok {
+			t.Fatalf("joiner %#v: expected ok %v, got %v", tc.joiner, tc.ok, err)
+		}
+	}
+}
+
+func TestSharedSessionFanout(t *testing.T) {
+	r := NewRegistry()
+	owner := newRecordingChannel()
+	s := r.registerShared("c1", nil, nil, owner)
+	defer s.close()
+
+	viewerChannel := newRecordingChannel()
+	v := s.join(viewerChannel, nil, false)
+
+	if _, err := s.Write([]byte("hello")); err != nil {
+		t.Fatalf("write returned error: %v", err)
+	}
+
+	if owner.output() != "hello" {
+		t.Fatalf("unexpected owner output %q", owner.output())
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for viewerChannel.output() != "hello" {
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected viewer output %q", viewerChannel.output())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if info := s.info(); len(info.Viewers) != 1 || info.Viewers[0].ReadWrite {
+		t.Fatalf("unexpected viewers %#v", info.Viewers)
+	}
+
+	s.leave(v)
+
+	if info := s.info(); len(info.Viewers) != 0 {
+		t.Fatalf("expected viewer to leave, got %#v", info.Viewers)
+	}
+}
+
+func TestSharedSessionMergesInput(t *testing.T) {
+	r := NewRegistry()
+	s := r.registerShared("c1", nil, nil, io.Discard)
+
+	go s.feed(bytes.NewBufferString("ls\n"))
+
+	buf := make([]byte, 3)
+	if _, err := io.ReadFull(s.input, buf); err != nil {
+		t.Fatalf("read returned error: %v", err)
+	}
+
+	if string(buf) != "ls\n" {
+		t.Fatalf("unexpected input %q", buf)
+	}
+
+	s.close()
+
+	if _, err := s.input.Read(buf); err != io.EOF {
+		t.Fatalf("expected EOF after close, got %v", err)
+	}
+}
+
+func TestJoinID(t *testing.T) {
+	if id, ok := joinID("join+abc"); !ok || id != "abc" {
+		t.Fatalf("unexpected join id %v %v", id, ok)
+	}
+
+	if _, ok := joinID("container1"); ok {
+		t.Fatal("expected container name not to be a join")
+	}
+}
+
+func TestSharedSessionOwnerInput(t *testing.T) {
+	provider := &echoProvider{}
+
+	_, client := newTestBridge(t, "c1", provider, &BridgeConfig{Registry: NewRegistry(), ShareSessions: true})
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("NewSession returned error: %v", err)
+	}
+	defer session.Close()
+
+	if err := session.RequestPty("xterm", 24, 80, nil); err != nil {
+		t.Fatalf("RequestPty returned error: %v", err)
+	}
+
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		t.Fatalf("StdinPipe returned error: %v", err)
+	}
+
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		t.Fatalf("StdoutPipe returned error: %v", err)
+	}
+
+	if err := session.Shell(); err != nil {
+		t.Fatalf("Shell returned error: %v", err)
+	}
+
+	if _, err := stdin.Write([]byte("hello")); err != nil {
+		t.Fatalf("Write returned error: %v", err)
+	}
+
+	echoed := make(chan string, 1)
+	go func() {
+		buf := make([]byte, 5)
+		_, _ = io.ReadFull(stdout, buf)
+		echoed <- string(buf)
+	}()
+
+	select {
+	case got := <-echoed:
+		if got != "hello" {
+			t.Fatalf("unexpected echo %q", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected input of the owner to reach the exec")
+	}
+}
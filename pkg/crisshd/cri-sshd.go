@@ -0,0 +1,202 @@
+package crisshd
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tg123/docker-sshd/pkg/bridge"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	restclient "k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/remotecommand"
+	"k8s.io/client-go/util/exec"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+var _ bridge.SessionProvider = (*crisshdconn)(nil)
+
+// DefaultEndpoint is the containerd cri socket, cri-o listens at unix:///var/run/crio/crio.sock
+const DefaultEndpoint = "unix:///run/containerd/containerd.sock"
+
+// Dial connects to the cri runtime service at endpoint, e.g. unix:///run/containerd/containerd.sock
+func Dial(endpoint string) (*grpc.ClientConn, error) {
+	return grpc.NewClient(endpoint, grpc.WithTransportCredentials(insecure.NewCredentials()))
+}
+
+// Options of the cri provider
+type Options struct {
+	// SyncExec runs commands without a pty with ExecSync, stdin is not forwarded
+	// useful when the streaming server of the runtime is not reachable
+	SyncExec bool
+}
+
+type crisshdconn struct {
+	runtime     runtimeapi.RuntimeServiceClient
+	containerID string
+	opts        Options
+
+	// closed is cancelled by Close, it ends running streams
+	closed context.Context
+	cancel context.CancelFunc
+}
+
+func (c *crisshdconn) Close() error {
+	c.cancel()
+	return nil
+}
+
+// Target is the container id the provider was created for
+func (c *crisshdconn) Target() string {
+	return c.containerID
+}
+
+func (c *crisshdconn) NewSession() bridge.Session {
+	return &crisession{
+		crisshdconn: c,
+		resizeQueue: make(chan *remotecommand.TerminalSize, 1),
+	}
+}
+
+// crisession is one exec in the container, each session channel has its own
+type crisession struct {
+	*crisshdconn
+
+	resizeQueue chan *remotecommand.TerminalSize
+	done        <-chan struct{}
+}
+
+// Next is the TerminalSizeQueue of the stream, it ends with the stream
+func (c *crisession) Next() *remotecommand.TerminalSize {
+	select {
+	case size := <-c.resizeQueue:
+		return size
+	case <-c.done:
+		return nil
+	}
+}
+
+func (c *crisession) Exec(ctx context.Context, execconfig bridge.ExecConfig) (<-chan bridge.ExecResult, error) {
+	if execconfig.User != "" || execconfig.WorkingDir != "" {
+		return nil, fmt.Errorf("cri exec cannot set the user or working directory")
+	}
+
+	if c.opts.SyncExec && !execconfig.Tty && !execconfig.Forward {
+		return c.execSync(ctx, execconfig)
+	}
+
+	resp, err := c.runtime.Exec(ctx, &runtimeapi.ExecRequest{
+		ContainerId: c.containerID,
+		Cmd:         execconfig.CmdWithTerminalModes(),
+		Tty:         execconfig.Tty,
+		Stdin:       true,
+		Stdout:      true,
+		Stderr:      !execconfig.Tty, // the runtime rejects stderr with tty
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	u, err := url.Parse(resp.Url)
+	if err != nil {
+		return nil, err
+	}
+
+	// the streaming server of the runtime is not authenticated, the url holds a one time token
+	executor, err := remotecommand.NewSPDYExecutor(&restclient.Config{}, "POST", u)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debugf("cri exec [%v] in container [%v] started", execconfig.Cmd, c.containerID)
+
+	// the stream ends with the channel or the provider
+	ctx, cancel := context.WithCancel(ctx)
+	stop := context.AfterFunc(c.closed, cancel)
+	c.done = ctx.Done()
+
+	r := make(chan bridge.ExecResult, 1)
+
+	go func() {
+		defer stop()
+		defer cancel()
+
+		err := executor.StreamWithContext(ctx, remotecommand.StreamOptions{
+			Stdin:             execconfig.Input,
+			Stdout:            execconfig.Output,
+			Stderr:            execconfig.Output,
+			Tty:               execconfig.Tty,
+			TerminalSizeQueue: c,
+		})
+
+		exitCode := 0
+
+		if exitErr, ok := err.(exec.CodeExitError); ok {
+			exitCode = exitErr.ExitStatus()
+		}
+
+		r <- bridge.ExecResult{
+			ExitCode: exitCode,
+			Error:    err,
+		}
+	}()
+
+	return r, nil
+}
+
+// execSync runs the command to completion and writes its output afterwards
+func (c *crisshdconn) execSync(ctx context.Context, execconfig bridge.ExecConfig) (<-chan bridge.ExecResult, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	stop := context.AfterFunc(c.closed, cancel)
+
+	r := make(chan bridge.ExecResult, 1)
+
+	go func() {
+		defer stop()
+		defer cancel()
+
+		resp, err := c.runtime.ExecSync(ctx, &runtimeapi.ExecSyncRequest{
+			ContainerId: c.containerID,
+			Cmd:         execconfig.Cmd,
+		})
+
+		if err != nil {
+			r <- bridge.ExecResult{ExitCode: -1, Error: err}
+			return
+		}
+
+		_, _ = execconfig.Output.Write(resp.Stdout)
+		_, _ = execconfig.Output.Write(resp.Stderr)
+
+		r <- bridge.ExecResult{ExitCode: int(resp.ExitCode)}
+	}()
+
+	return r, nil
+}
+
+func (c *crisession) Resize(ctx context.Context, size bridge.ResizeOptions) error {
+	select {
+	case c.resizeQueue <- &remotecommand.TerminalSize{
+		Height: uint16(size.Height),
+		Width:  uint16(size.Width),
+	}:
+		return nil
+	default:
+	}
+
+	return fmt.Errorf("resize failed")
+}
+
+// New creates a provider of the container with id, see Resolve
+func New(runtime runtimeapi.RuntimeServiceClient, containerID string, opts Options) (bridge.SessionProvider, error) {
+	closed, cancel := context.WithCancel(context.Background())
+
+	return &crisshdconn{
+		runtime:     runtime,
+		containerID: containerID,
+		opts:        opts,
+		closed:      closed,
+		cancel:      cancel,
+	}, nil
+}
@@ -0,0 +1,384 @@
+package crisshd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tg123/docker-sshd/pkg/bridge"
+	"google.golang.org/grpc"
+	"k8s.io/client-go/tools/remotecommand"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+	"k8s.io/kubelet/pkg/cri/streaming"
+	utilexec "k8s.io/utils/exec"
+)
+
+// fakeRuntime is a cri runtime service with a real streaming server, exec echoes one line and exits with 3
+// exec of hang runs until the client closes the stream
+type fakeRuntime struct {
+	runtimeapi.UnimplementedRuntimeServiceServer
+
+	streaming  streaming.Server
+	containers []*runtimeapi.Container
+
+	mu      sync.Mutex
+	cmd     []string
+	sizes   []remotecommand.TerminalSize
+	resized chan struct{}
+	hungup  chan struct{}
+}
+
+func (f *fakeRuntime) ListContainers(ctx context.Context, req *runtimeapi.ListContainersRequest) (*runtimeapi.ListContainersResponse, error) {
+	var list []*runtimeapi.Container
+
+next:
+	for _, c := range f.containers {
+		if state := req.Filter.GetState(); state != nil && c.State != state.State {
+			continue
+		}
+
+		for k, v := range req.Filter.GetLabelSelector() {
+			if c.Labels[k] != v {
+				continue next
+			}
+		}
+
+		list = append(list, c)
+	}
+
+	return &runtimeapi.ListContainersResponse{Containers: list}, nil
+}
+
+func (f *fakeRuntime) Exec(ctx context.Context, req *runtimeapi.ExecRequest) (*runtimeapi.ExecResponse, error) {
+	return f.streaming.GetExec(req)
+}
+
+func (f *fakeRuntime) ExecSync(ctx context.Context, req *runtimeapi.ExecSyncRequest) (*runtimeapi.ExecSyncResponse, error) {
+	return &runtimeapi.ExecSyncResponse{
+		Stdout:   []byte(strings.Join(req.Cmd, " ") + "\n"),
+		Stderr:   []byte("sync\n"),
+		ExitCode: 2,
+	}, nil
+}
+
+// execStream serves the exec of the streaming server
+func (f *fakeRuntime) execStream(ctx context.Context, containerID string, cmd []string, in io.Reader, out, stderr io.WriteCloser, tty bool, resize <-chan remotecommand.TerminalSize) error {
+	f.mu.Lock()
+	f.cmd = cmd
+	f.mu.Unlock()
+
+	if resize != nil {
+		go func() {
+			for size := range resize {
+				f.mu.Lock()
+				f.sizes = append(f.sizes, size)
+				f.mu.Unlock()
+				f.resized <- struct{}{}
+			}
+		}()
+	}
+
+	if len(cmd) == 1 && cmd[0] == "hang" {
+		_, _ = io.WriteString(out, "hanging\n")
+		_, _ = io.Copy(io.Discard, in)
+		f.hungup <- struct{}{}
+		return nil
+	}
+
+	line, _ := bufio.NewReader(in).ReadString('\n')
+	_, _ = io.WriteString(out, "echo:"+line)
+
+	return utilexec.CodeExitError{Err: errors.New("exit status 3"), Code: 3}
+}
+
+// streamingRuntime is the streaming.Runtime of fakeRuntime, its Exec clashes with the grpc method
+type streamingRuntime struct {
+	*fakeRuntime
+}
+
+func (s streamingRuntime) Exec(ctx context.Context, containerID string, cmd []string, in io.Reader, out, stderr io.WriteCloser, tty bool, resize <-chan remotecommand.TerminalSize) error {
+	return s.execStream(ctx, containerID, cmd, in, out, stderr, tty, resize)
+}
+
+func (s streamingRuntime) Attach(ctx context.Context, containerID string, in io.Reader, out, stderr io.WriteCloser, tty bool, resize <-chan remotecommand.TerminalSize) error {
+	return errors.New("not implemented")
+}
+
+func (s streamingRuntime) PortForward(ctx context.Context, podSandboxID string, port int32, stream io.ReadWriteCloser) error {
+	return errors.New("not implemented")
+}
+
+func container(id, namespace, pod, name string, state runtimeapi.ContainerState) *runtimeapi.Container {
+	return &runtimeapi.Container{
+		Id:    id,
+		State: state,
+		Labels: map[string]string{
+			podNamespaceLabel:  namespace,
+			podNameLabel:       pod,
+			containerNameLabel: name,
+		},
+	}
+}
+
+func newFakeRuntime(t *testing.T) (*fakeRuntime, runtimeapi.RuntimeServiceClient) {
+	t.Helper()
+
+	f := &fakeRuntime{
+		resized: make(chan struct{}, 10),
+		hungup:  make(chan struct{}, 1),
+		containers: []*runtimeapi.Container{
+			container("c1", "default", "web", "nginx", runtimeapi.ContainerState_CONTAINER_RUNNING),
+			container("c2", "default", "web", "istio-proxy", runtimeapi.ContainerState_CONTAINER_RUNNING),
+			container("c3", "prod", "db", "postgres", runtimeapi.ContainerState_CONTAINER_RUNNING),
+			container("c4", "prod", "job", "migrate", runtimeapi.ContainerState_CONTAINER_EXITED),
+		},
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+
+	config := streaming.DefaultConfig
+	config.Addr = l.Addr().String()
+	config.BaseURL = &url.URL{Scheme: "http", Host: l.Addr().String()}
+
+	f.streaming, err = streaming.NewServer(config, streamingRuntime{f})
+	if err != nil {
+		t.Fatalf("streaming server failed: %v", err)
+	}
+
+	httpsrv := &http.Server{Handler: f.streaming}
+	go func() { _ = httpsrv.Serve(l) }()
+	t.Cleanup(func() { _ = httpsrv.Close() })
+
+	socket := filepath.Join(t.TempDir(), "cri.sock")
+	gl, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+
+	grpcsrv := grpc.NewServer()
+	runtimeapi.RegisterRuntimeServiceServer(grpcsrv, f)
+	go func() { _ = grpcsrv.Serve(gl) }()
+	t.Cleanup(grpcsrv.Stop)
+
+	conn, err := Dial("unix://" + socket)
+	if err != nil {
+		t.Fatalf("Dial returned error: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	return f, runtimeapi.NewRuntimeServiceClient(conn)
+}
+
+func TestResolve(t *testing.T) {
+	_, runtime := newFakeRuntime(t)
+
+	tests := []struct {
+		target string
+		id     string
+		err    string
+	}{
+		{"db", "c3", ""},
+		{"web/nginx", "c1", ""},
+		{"prod/db/postgres", "c3", ""},
+		{"web", "", "ambiguous"},
+		{"job", "", "no container matches"},
+		{"prod/web/nginx", "", "no container matches"},
+		{"a/b/c/d", "", "invalid target"},
+	}
+
+	for _, tt := range tests {
+		c, err := Resolve(context.Background(), runtime, tt.target)
+
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("Resolve(%q) expected error %q, got %v", tt.target, tt.err, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("Resolve(%q) returned error: %v", tt.target, err)
+			continue
+		}
+
+		if c.ID != tt.id {
+			t.Errorf("Resolve(%q) = %v, want %v", tt.target, c.ID, tt.id)
+		}
+	}
+}
+
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func waitResult(t *testing.T, r <-chan bridge.ExecResult) bridge.ExecResult {
+	t.Helper()
+
+	select {
+	case result := <-r:
+		return result
+	case <-time.After(10 * time.Second):
+		t.Fatal("expected exec result")
+	}
+
+	return bridge.ExecResult{}
+}
+
+func TestExecStreaming(t *testing.T) {
+	f, runtime := newFakeRuntime(t)
+
+	p, err := New(runtime, "c1", Options{})
+	if err != nil {
+		t.Fatalf("New returned error: %v", err)
+	}
+	session := p.NewSession()
+
+	if err := session.Resize(context.Background(), bridge.ResizeOptions{Width: 80, Height: 24}); err != nil {
+		t.Fatalf("Resize returned error: %v", err)
+	}
+
+	inr, inw := io.Pipe()
+	defer inw.Close()
+
+	var out lockedBuffer
+	r, err := session.Exec(context.Background(), bridge.ExecConfig{
+		Input:  inr,
+		Output: &out,
+		Cmd:    []string{"/bin/sh"},
+		Tty:    true,
+	})
+	if err != nil {
+		t.Fatalf("Exec returned error: %v", err)
+	}
+
+	select {
+	case <-f.resized:
+	case <-time.After(10 * time.Second):
+		t.Fatal("expected initial size")
+	}
+
+	_, _ = io.WriteString(inw, "hello\n")
+
+	result := waitResult(t, r)
+	if result.ExitCode != 3 {
+		t.Fatalf("expected exit code 3, got %v (%v)", result.ExitCode, result.Error)
+	}
+
+	if out.String() != "echo:hello\n" {
+		t.Fatalf("unexpected output %q", out.String())
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if len(f.cmd) != 1 || f.cmd[0] != "/bin/sh" {
+		t.Fatalf("unexpected command %v", f.cmd)
+	}
+
+	if len(f.sizes) == 0 || f.sizes[0] != (remotecommand.TerminalSize{Width: 80, Height: 24}) {
+		t.Fatalf("unexpected sizes %v", f.sizes)
+	}
+}
+
+func TestExecSync(t *testing.T) {
+	_, runtime := newFakeRuntime(t)
+
+	p, err := New(runtime, "c1", Options{SyncExec: true})
+	if err != nil {
+		t.Fatalf("New returned error: %v", err)
+	}
+	session := p.NewSession()
+
+	var out lockedBuffer
+	r, err := session.Exec(context.Background(), bridge.ExecConfig{
+		Input:  strings.NewReader(""),
+		Output: &out,
+		Cmd:    []string{"cat", "/etc/hostname"},
+	})
+	if err != nil {
+		t.Fatalf("Exec returned error: %v", err)
+	}
+
+	result := waitResult(t, r)
+	if result.ExitCode != 2 {
+		t.Fatalf("expected exit code 2, got %v (%v)", result.ExitCode, result.Error)
+	}
+
+	if out.String() != "cat /etc/hostname\nsync\n" {
+		t.Fatalf("unexpected output %q", out.String())
+	}
+}
+
+func TestExecStopsWithContext(t *testing.T) {
+	f, runtime := newFakeRuntime(t)
+
+	p, err := New(runtime, "c1", Options{})
+	if err != nil {
+		t.Fatalf("New returned error: %v", err)
+	}
+	session := p.NewSession()
+	defer p.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	inr, inw := io.Pipe()
+	defer inw.Close()
+
+	var out lockedBuffer
+	r, err := session.Exec(ctx, bridge.ExecConfig{
+		Input:  inr,
+		Output: &out,
+		Cmd:    []string{"hang"},
+		Tty:    true,
+	})
+	if err != nil {
+		t.Fatalf("Exec returned error: %v", err)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for out.String() != "hanging\n" {
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected output %q", out.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+
+	if result := waitResult(t, r); result.Error == nil {
+		t.Fatal("expected cancelled stream to fail")
+	}
+
+	select {
+	case <-f.hungup:
+	case <-time.After(10 * time.Second):
+		t.Fatal("expected the exec stream to be closed")
+	}
+}
@@ -0,0 +1,144 @@
+package crisshd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/tg123/docker-sshd/pkg/bridge"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+const (
+	podNameLabel       = "io.kubernetes.pod.name"
+	podNamespaceLabel  = "io.kubernetes.pod.namespace"
+	containerNameLabel = "io.kubernetes.container.name"
+)
+
+// ErrNotFound is returned by Resolve when no running container matches the target
+var ErrNotFound = errors.New("no container matches")
+
+// Container is a resolved target
+type Container struct {
+	ID        string
+	Namespace string
+	Pod       string
+	Name      string
+}
+
+// String is the namespace/pod/container form accepted by Resolve
+func (c Container) String() string {
+	return c.Namespace + "/" + c.Pod + "/" + c.Name
+}
+
+// parseTarget splits pod, pod/container or namespace/pod/container, empty namespace or container match any
+func parseTarget(target string) (namespace, pod, container string, err error) {
+	parts := strings.Split(target, "/")
+
+	switch len(parts) {
+	case 1:
+		pod = parts[0]
+	case 2:
+		pod, container = parts[0], parts[1]
+	case 3:
+		namespace, pod, container = parts[0], parts[1], parts[2]
+	default:
+		return "", "", "", fmt.Errorf("invalid target [%v], use pod, pod/container or namespace/pod/container", target)
+	}
+
+	if pod == "" {
+		return "", "", "", fmt.Errorf("invalid target [%v], pod name is empty", target)
+	}
+
+	return namespace, pod, container, nil
+}
+
+// Resolve finds the running container of target by the pod labels set by the kubelet
+func Resolve(ctx context.Context, runtime runtimeapi.RuntimeServiceClient, target string) (Container, error) {
+	namespace, pod, container, err := parseTarget(target)
+	if err != nil {
+		return Container{}, err
+	}
+
+	selector := map[string]string{podNameLabel: pod}
+	if namespace != "" {
+		selector[podNamespaceLabel] = namespace
+	}
+
+	if container != "" {
+		selector[containerNameLabel] = container
+	}
+
+	list, err := listRunning(ctx, runtime, selector)
+	if err != nil {
+		return Container{}, err
+	}
+
+	switch len(list) {
+	case 0:
+		return Container{}, fmt.Errorf("%w [%v]", ErrNotFound, target)
+	case 1:
+		return list[0], nil
+	}
+
+	names := make([]string, 0, len(list))
+	for _, c := range list {
+		names = append(names, c.String())
+	}
+
+	return Container{}, fmt.Errorf("target [%v] is ambiguous, choose one of: %v", target, strings.Join(names, ", "))
+}
+
+// ListTargets lists running kubernetes containers for the picker
+func ListTargets(ctx context.Context, runtime runtimeapi.RuntimeServiceClient) ([]bridge.Target, error) {
+	list, err := listRunning(ctx, runtime, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	targets := make([]bridge.Target, 0, len(list))
+	for _, c := range list {
+		targets = append(targets, bridge.Target{
+			Name:        c.String(),
+			Description: c.ID[:min(12, len(c.ID))],
+		})
+	}
+
+	return targets, nil
+}
+
+// listRunning lists running containers created by the kubelet, sorted by namespace/pod/container
+func listRunning(ctx context.Context, runtime runtimeapi.RuntimeServiceClient, selector map[string]string) ([]Container, error) {
+	resp, err := runtime.ListContainers(ctx, &runtimeapi.ListContainersRequest{
+		Filter: &runtimeapi.ContainerFilter{
+			State:         &runtimeapi.ContainerStateValue{State: runtimeapi.ContainerState_CONTAINER_RUNNING},
+			LabelSelector: selector,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var list []Container
+	for _, c := range resp.Containers {
+		pod := c.Labels[podNameLabel]
+		if pod == "" {
+			continue
+		}
+
+		list = append(list, Container{
+			ID:        c.Id,
+			Namespace: c.Labels[podNamespaceLabel],
+			Pod:       pod,
+			Name:      c.Labels[containerNameLabel],
+		})
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].String() < list[j].String()
+	})
+
+	return list, nil
+}
@@ -0,0 +1,200 @@
+package dockersshd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+	log "github.com/sirupsen/logrus"
+	"github.com/tg123/docker-sshd/pkg/bridge"
+)
+
+// AttachSuffix on the username attaches to the main process of the container instead of exec, e.g. web+attach
+const AttachSuffix = "+attach"
+
+// DefaultDetachKeys ends the ssh session without stopping the container, same as docker attach
+const DefaultDetachKeys = "ctrl-p,ctrl-q"
+
+var _ bridge.SessionProvider = (*attachconn)(nil)
+var _ bridge.Session = (*attachsession)(nil)
+
+// attachconn connects to the stdio of PID 1, like docker attach
+type attachconn struct {
+	containerName string
+	dockercli     *client.Client
+	detachKeys    string
+	autoStart     bool
+
+	// closed is cancelled by Close, which detaches a running attach
+	closed context.Context
+	cancel context.CancelFunc
+}
+
+// NewAttach returns a provider which attaches to the main process of the container, only shell requests are accepted
+func NewAttach(dockercli *client.Client, containerName string, opts Options) (bridge.SessionProvider, error) {
+	detachKeys := opts.DetachKeys
+	if detachKeys == "" {
+		detachKeys = DefaultDetachKeys
+	}
+
+	closed, cancel := context.WithCancel(context.Background())
+
+	return &attachconn{
+		containerName: containerName,
+		dockercli:     dockercli,
+		detachKeys:    detachKeys,
+		autoStart:     opts.AutoStart,
+		closed:        closed,
+		cancel:        cancel,
+	}, nil
+}
+
+// Close detaches, the container keeps running
+func (a *attachconn) Close() error {
+	a.cancel()
+	return nil
+}
+
+// Target is the container id or name the provider was created for
+func (a *attachconn) Target() string {
+	return a.containerName
+}
+
+func (a *attachconn) NewSession() bridge.Session {
+	return &attachsession{attachconn: a}
+}
+
+// attachsession is one attach to the main process, sessions of a connection share its stdio like docker attach does
+type attachsession struct {
+	*attachconn
+
+	mu       sync.Mutex
+	attached bool
+	initSize *bridge.ResizeOptions
+}
+
+func (a *attachsession) Exec(ctx context.Context, execconfig bridge.ExecConfig) (<-chan bridge.ExecResult, error) {
+	// the main process runs as whoever started it, an exec-user policy cannot be honored
+	if execconfig.User != "" {
+		return nil, fmt.Errorf("attach cannot run as %v, it joins the main process of the container", execconfig.User)
+	}
+
+	// forwarded bytes or a command would end up in the stdin of the main process
+	if execconfig.Forward {
+		return nil, fmt.Errorf("port forwarding is not available when attached to the container")
+	}
+
+	if !execconfig.Shell {
+		return nil, fmt.Errorf("attach runs no command, connect without [%v]", strings.Join(execconfig.Cmd, " "))
+	}
+
+	if err := ensureRunning(ctx, a.dockercli, a.containerName, a.autoStart); err != nil {
+		return nil, err
+	}
+
+	info, err := a.dockercli.ContainerInspect(ctx, a.containerName)
+	if err != nil {
+		return nil, err
+	}
+
+	attach, err := a.dockercli.ContainerAttach(ctx, a.containerName, container.AttachOptions{
+		Stream:     true,
+		Stdin:      info.Config.OpenStdin,
+		Stdout:     true,
+		Stderr:     true,
+		DetachKeys: a.detachKeys,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	a.mu.Lock()
+	a.attached = true
+	initSize := a.initSize
+	a.mu.Unlock()
+
+	if initSize != nil {
+		if err := a.Resize(ctx, *initSize); err != nil {
+			log.Warnf("resize container [%v] failed: %v", a.containerName, err)
+		}
+	}
+
+	log.Debugf("docker attach to container [%v] started", a.containerName)
+
+	r := make(chan bridge.ExecResult, 1)
+
+	go func() {
+		defer attach.Close()
+
+		if info.Config.OpenStdin {
+			go func() {
+				_, _ = io.Copy(attach.Conn, execconfig.Input)
+			}()
+		}
+
+		done := make(chan error, 1)
+
+		go func() {
+			var err error
+			if info.Config.Tty {
+				_, err = io.Copy(execconfig.Output, attach.Reader)
+			} else {
+				_, err = stdcopy.StdCopy(execconfig.Output, execconfig.Output, attach.Reader)
+			}
+			done <- err
+		}()
+
+		var err error
+		select {
+		case err = <-done:
+		case <-ctx.Done():
+			log.Warningf("attach to container [%v] context cancelled", a.containerName)
+			r <- bridge.ExecResult{ExitCode: -1, Error: ctx.Err()}
+			return
+		case <-a.closed.Done():
+			log.Warningf("attach to container [%v] closed", a.containerName)
+			r <- bridge.ExecResult{ExitCode: -1, Error: a.closed.Err()}
+			return
+		}
+
+		// the stream ends when detached or when the container stops
+		exitCode := 0
+
+		if state, inspectErr := a.dockercli.ContainerInspect(context.Background(), a.containerName); inspectErr != nil {
+			log.Warningf("inspect container [%v] failed %v", a.containerName, inspectErr)
+			exitCode = -1
+		} else if !state.State.Running {
+			exitCode = state.State.ExitCode
+			log.Debugf("container [%v] exited with %v", a.containerName, exitCode)
+		} else {
+			log.Debugf("detached from container [%v]", a.containerName)
+		}
+
+		r <- bridge.ExecResult{
+			ExitCode: exitCode,
+			Error:    err,
+		}
+	}()
+
+	return r, nil
+}
+
+func (a *attachsession) Resize(ctx context.Context, size bridge.ResizeOptions) error {
+	a.mu.Lock()
+	if !a.attached {
+		a.initSize = &size
+		a.mu.Unlock()
+		return nil
+	}
+	a.mu.Unlock()
+
+	return a.dockercli.ContainerResize(ctx, a.containerName, container.ResizeOptions{
+		Height: size.Height,
+		Width:  size.Width,
+	})
+}
@@ -0,0 +1,45 @@
+package dockersshd
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/tg123/docker-sshd/pkg/bridge"
+)
+
+func TestAttachRejectsExecUser(t *testing.T) {
+	p, err := NewAttach(nil, "c1", Options{})
+	if err != nil {
+		t.Fatalf("NewAttach returned error: %v", err)
+	}
+	defer p.Close()
+
+	_, err = p.NewSession().Exec(context.Background(), bridge.ExecConfig{Cmd: []string{"/bin/sh"}, Shell: true, User: "app"})
+	if err == nil || !strings.Contains(err.Error(), "app") {
+		t.Fatalf("expected exec user to be rejected, got %v", err)
+	}
+}
+
+func TestAttachOnlyAcceptsShell(t *testing.T) {
+	p, err := NewAttach(nil, "c1", Options{})
+	if err != nil {
+		t.Fatalf("NewAttach returned error: %v", err)
+	}
+	defer p.Close()
+
+	tests := []struct {
+		execconfig bridge.ExecConfig
+		err        string
+	}{
+		{bridge.ExecConfig{Cmd: []string{"nc", "localhost", "80"}, Forward: true}, "port forwarding"},
+		{bridge.ExecConfig{Cmd: []string{"uptime"}}, "connect without [uptime]"},
+	}
+
+	for _, tt := range tests {
+		_, err := p.NewSession().Exec(context.Background(), tt.execconfig)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Fatalf("Exec(%v) = %v, expected error %q", tt.execconfig.Cmd, err, tt.err)
+		}
+	}
+}
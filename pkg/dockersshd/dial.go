@@ -0,0 +1,81 @@
+package dockersshd
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+)
+
+// Dial connects from the bridge host to a port of the container itself at its ip,
+// other addresses are left to nc inside the container
+func (d *dockersshdconn) Dial(ctx context.Context, network, address string) (net.Conn, error) {
+	c, err := d.dockercli.ContainerInspect(ctx, d.containerName)
+	if err != nil {
+		return nil, err
+	}
+
+	target, err := containerAddress(c, address)
+	if err != nil {
+		return nil, err
+	}
+
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, network, target)
+}
+
+// containerAddress maps an address of the container as seen from inside, e.g. localhost:22, to one reachable from the host
+func containerAddress(c container.InspectResponse, address string) (string, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", err
+	}
+
+	var ips []string
+	if c.NetworkSettings != nil {
+		names := make([]string, 0, len(c.NetworkSettings.Networks))
+		for name := range c.NetworkSettings.Networks {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			if n := c.NetworkSettings.Networks[name]; n != nil && n.IPAddress != "" {
+				ips = append(ips, n.IPAddress)
+			}
+		}
+	}
+
+	self := host == "localhost" || host == strings.TrimPrefix(c.Name, "/")
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		self = true
+	}
+
+	if c.Config != nil && host == c.Config.Hostname {
+		self = true
+	}
+
+	for _, ip := range ips {
+		if host == ip {
+			self = true
+		}
+	}
+
+	if !self {
+		return "", errors.ErrUnsupported
+	}
+
+	if c.HostConfig != nil && c.HostConfig.NetworkMode.IsHost() {
+		return net.JoinHostPort("127.0.0.1", port), nil
+	}
+
+	if len(ips) == 0 {
+		// e.g. network none, nc inside the container still works
+		return "", errors.ErrUnsupported
+	}
+
+	return net.JoinHostPort(ips[0], port), nil
+}
@@ -0,0 +1,58 @@
+package dockersshd
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+)
+
+func TestContainerAddress(t *testing.T) {
+	bridged := container.InspectResponse{
+		ContainerJSONBase: &container.ContainerJSONBase{Name: "/web", HostConfig: &container.HostConfig{NetworkMode: "bridge"}},
+		Config:            &container.Config{Hostname: "abc123"},
+		NetworkSettings: &container.NetworkSettings{Networks: map[string]*network.EndpointSettings{
+			"bridge":  {IPAddress: "172.17.0.2"},
+			"backend": {IPAddress: "10.0.0.5"},
+		}},
+	}
+
+	host := container.InspectResponse{
+		ContainerJSONBase: &container.ContainerJSONBase{Name: "/agent", HostConfig: &container.HostConfig{NetworkMode: "host"}},
+	}
+
+	none := container.InspectResponse{
+		ContainerJSONBase: &container.ContainerJSONBase{Name: "/offline", HostConfig: &container.HostConfig{NetworkMode: "none"}},
+	}
+
+	tests := []struct {
+		c        container.InspectResponse
+		address  string
+		expected string
+	}{
+		{bridged, "localhost:22", "10.0.0.5:22"},
+		{bridged, "127.0.0.1:22", "10.0.0.5:22"},
+		{bridged, "web:8080", "10.0.0.5:8080"},
+		{bridged, "abc123:22", "10.0.0.5:22"},
+		{bridged, "172.17.0.2:22", "10.0.0.5:22"},
+		{bridged, "db:5432", ""},
+		{host, "localhost:22", "127.0.0.1:22"},
+		{none, "localhost:22", ""},
+	}
+
+	for _, tt := range tests {
+		address, err := containerAddress(tt.c, tt.address)
+
+		if tt.expected == "" {
+			if !errors.Is(err, errors.ErrUnsupported) {
+				t.Errorf("containerAddress(%v, %v) expected ErrUnsupported, got %v %v", tt.c.Name, tt.address, address, err)
+			}
+			continue
+		}
+
+		if err != nil || address != tt.expected {
+			t.Errorf("containerAddress(%v, %v) = %v %v, want %v", tt.c.Name, tt.address, address, err, tt.expected)
+		}
+	}
+}
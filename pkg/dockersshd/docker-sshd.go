@@ -3,37 +3,80 @@ package dockersshd
 import (
 	"context"
 	"io"
+	"strconv"
 	"time"
 
 	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/client"
 	log "github.com/sirupsen/logrus"
 	"github.com/tg123/docker-sshd/pkg/bridge"
 )
 
 var _ bridge.SessionProvider = (*dockersshdconn)(nil)
+var _ bridge.Session = (*dockersession)(nil)
 
-const execTimeout = 10 * time.Second
+// DefaultExecTimeout is how long to wait for the exit code after the output of an exec ends
+const DefaultExecTimeout = 10 * time.Second
 
 type dockersshdconn struct {
 	containerName string
 	dockercli     *client.Client
-	execId        string
-	initSize      bridge.ResizeOptions
+	autoStart     bool
+
+	// closed is cancelled by Close, running execs stop and their hijacked connections are closed
+	closed context.Context
+	cancel context.CancelFunc
+}
+
+func newDockersshdconn(dockercli *client.Client, containerName string, autoStart bool) *dockersshdconn {
+	closed, cancel := context.WithCancel(context.Background())
+
+	return &dockersshdconn{
+		containerName: containerName,
+		dockercli:     dockercli,
+		autoStart:     autoStart,
+		closed:        closed,
+		cancel:        cancel,
+	}
 }
 
 func (d *dockersshdconn) Close() error {
+	d.cancel()
 	return nil
 }
 
-func (d *dockersshdconn) Exec(ctx context.Context, execconfig bridge.ExecConfig) (<-chan bridge.ExecResult, error) {
+// Target is the container id or name the provider was created for
+func (d *dockersshdconn) Target() string {
+	return d.containerName
+}
+
+func (d *dockersshdconn) NewSession() bridge.Session {
+	return &dockersession{dockersshdconn: d}
+}
+
+// dockersession is one exec in the container, each session channel has its own
+type dockersession struct {
+	*dockersshdconn
+	execId   string
+	initSize bridge.ResizeOptions
+}
+
+func (d *dockersession) Exec(ctx context.Context, execconfig bridge.ExecConfig) (<-chan bridge.ExecResult, error) {
+	if err := ensureRunning(ctx, d.dockercli, d.containerName, d.autoStart); err != nil {
+		return nil, err
+	}
+
 	exec, err := d.dockercli.ContainerExecCreate(ctx, d.containerName, container.ExecOptions{
 		AttachStdin:  true,
 		AttachStdout: true,
 		AttachStderr: execconfig.Tty, // only attach stderr if tty is enabled
 		Tty:          execconfig.Tty,
 		Env:          execconfig.Env,
-		Cmd:          execconfig.Cmd,
+		Cmd:          execconfig.CmdWithTerminalModes(),
+		User:         execconfig.User,
+		WorkingDir:   execconfig.WorkingDir,
 		ConsoleSize:  &[2]uint{d.initSize.Height, d.initSize.Width},
 	})
 
@@ -44,21 +87,38 @@ func (d *dockersshdconn) Exec(ctx context.Context, execconfig bridge.ExecConfig)
 	execID := exec.ID
 	d.execId = exec.ID
 
+	// subscribe before the exec starts, exec_die carries the exit code
+	eventsCtx, cancelEvents := context.WithCancel(ctx)
+	messages, errs := d.dockercli.Events(eventsCtx, events.ListOptions{
+		Filters: filters.NewArgs(
+			filters.Arg("type", string(events.ContainerEventType)),
+			filters.Arg("event", string(events.ActionExecDie)),
+			filters.Arg("container", d.containerName),
+		),
+	})
+
 	attach, err := d.dockercli.ContainerExecAttach(ctx, execID, container.ExecAttachOptions{
 		Detach: false,
 		Tty:    true,
 	})
 
 	if err != nil {
+		cancelEvents()
 		return nil, err
 	}
 
 	log.Debugf("docker exec [%v] in container [%v] started", execconfig.Cmd, d.containerName)
 
-	r := make(chan bridge.ExecResult)
+	timeout := execconfig.ExitTimeout
+	if timeout <= 0 {
+		timeout = DefaultExecTimeout
+	}
+
+	r := make(chan bridge.ExecResult, 1)
 
 	go func() {
 		defer attach.Close()
+		defer cancelEvents()
 
 		done := make(chan error, 2)
 
@@ -77,35 +137,21 @@ func (d *dockersshdconn) Exec(ctx context.Context, execconfig bridge.ExecConfig)
 		case err = <-done:
 		case <-ctx.Done():
 			log.Warningf("exec [%v] in container [%v] context cancelled", execconfig.Cmd, d.containerName)
+			r <- bridge.ExecResult{ExitCode: -1, Error: ctx.Err()}
+			return
+		case <-d.closed.Done():
+			log.Warningf("exec [%v] in container [%v] closed", execconfig.Cmd, d.containerName)
+			r <- bridge.ExecResult{ExitCode: -1, Error: d.closed.Err()}
 			return
 		}
 
 		log.Debugf("docker exec [%v] in container [%v] done error [%v]", execconfig.Cmd, d.containerName, err)
 
-		exitCode := -1
-		st := time.Now()
-
-		for {
-			if time.Since(st) > execTimeout {
-				log.Warningf("exec [%v] is still running or inspect error after %v timeout", execID, execTimeout)
-				break
-			}
+		deadline := time.Now().Add(timeout)
 
-			exec, err := d.dockercli.ContainerExecInspect(context.Background(), execID)
-			if err != nil {
-				log.Warningf("inspect exec %v failed %v", execID, err)
-				time.Sleep(1 * time.Second)
-				continue
-			}
-
-			if exec.Running { // this should not happen
-				log.Warnf("exec %v is still running in container %v", execID, exec.ContainerID)
-				time.Sleep(1 * time.Second)
-				continue
-			}
-
-			exitCode = exec.ExitCode
-			break
+		exitCode, ok := waitExecDie(messages, errs, execID, deadline)
+		if !ok {
+			exitCode = d.inspectExitCode(execID, deadline)
 		}
 
 		if exitCode == 0 {
@@ -122,7 +168,58 @@ func (d *dockersshdconn) Exec(ctx context.Context, execconfig bridge.ExecConfig)
 	return r, nil
 }
 
-func (d *dockersshdconn) Resize(ctx context.Context, size bridge.ResizeOptions) error {
+// waitExecDie returns the exit code of the exec_die event of execID, false if the events stream fails or deadline passes
+func waitExecDie(messages <-chan events.Message, errs <-chan error, execID string, deadline time.Time) (int, bool) {
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+
+	for {
+		select {
+		case msg := <-messages:
+			if msg.Action != events.ActionExecDie || msg.Actor.Attributes["execID"] != execID {
+				continue
+			}
+
+			exitCode, err := strconv.Atoi(msg.Actor.Attributes["exitCode"])
+			if err != nil {
+				log.Warningf("exec_die event of %v has invalid exit code %q", execID, msg.Actor.Attributes["exitCode"])
+				return -1, false
+			}
+
+			return exitCode, true
+		case err := <-errs:
+			log.Warningf("docker events failed, falling back to inspect: %v", err)
+			return -1, false
+		case <-timer.C:
+			log.Warningf("no exec_die event of %v before timeout, falling back to inspect", execID)
+			return -1, false
+		}
+	}
+}
+
+// inspectExitCode polls ContainerExecInspect until the exec stops, -1 if it is still running at deadline
+func (d *dockersshdconn) inspectExitCode(execID string, deadline time.Time) int {
+	for {
+		exec, err := d.dockercli.ContainerExecInspect(context.Background(), execID)
+		switch {
+		case err != nil:
+			log.Warningf("inspect exec %v failed %v", execID, err)
+		case exec.Running:
+			log.Warnf("exec %v is still running in container %v", execID, exec.ContainerID)
+		default:
+			return exec.ExitCode
+		}
+
+		if time.Now().After(deadline) {
+			log.Warningf("exec [%v] is still running or inspect error after timeout", execID)
+			return -1
+		}
+
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+func (d *dockersession) Resize(ctx context.Context, size bridge.ResizeOptions) error {
 	if d.execId == "" {
 		d.initSize = size
 		return nil
@@ -134,9 +231,6 @@ func (d *dockersshdconn) Resize(ctx context.Context, size bridge.ResizeOptions)
 	})
 }
 
-func New(dockercli *client.Client, containerName string) (bridge.SessionProvider, error) {
-	return &dockersshdconn{
-		containerName: containerName,
-		dockercli:     dockercli,
-	}, nil
+func New(dockercli *client.Client, containerName string, opts Options) (bridge.SessionProvider, error) {
+	return newDockersshdconn(dockercli, containerName, opts.AutoStart), nil
 }
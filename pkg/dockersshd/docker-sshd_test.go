@@ -0,0 +1,46 @@
+package dockersshd
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/events"
+)
+
+func execDie(execID, exitCode string) events.Message {
+	return events.Message{
+		Type:   events.ContainerEventType,
+		Action: events.ActionExecDie,
+		Actor:  events.Actor{ID: "c1", Attributes: map[string]string{"execID": execID, "exitCode": exitCode}},
+	}
+}
+
+func TestWaitExecDie(t *testing.T) {
+	messages := make(chan events.Message, 2)
+	messages <- execDie("other", "1")
+	messages <- execDie("e1", "42")
+
+	exitCode, ok := waitExecDie(messages, make(chan error), "e1", time.Now().Add(time.Second))
+	if !ok || exitCode != 42 {
+		t.Fatalf("expected exit code 42 of e1, got %v %v", exitCode, ok)
+	}
+}
+
+func TestWaitExecDieFallsBack(t *testing.T) {
+	errs := make(chan error, 1)
+	errs <- errors.New("events unsupported")
+
+	if _, ok := waitExecDie(make(chan events.Message), errs, "e1", time.Now().Add(time.Second)); ok {
+		t.Fatal("expected fallback when events fail")
+	}
+
+	start := time.Now()
+	if _, ok := waitExecDie(make(chan events.Message), make(chan error), "e1", start.Add(50*time.Millisecond)); ok {
+		t.Fatal("expected fallback on timeout")
+	}
+
+	if time.Since(start) > time.Second {
+		t.Fatal("expected timeout to be honored")
+	}
+}
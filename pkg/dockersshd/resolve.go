@@ -0,0 +1,193 @@
+package dockersshd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	cerrdefs "github.com/containerd/errdefs"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+)
+
+const (
+	composeProjectLabel = "com.docker.compose.project"
+	composeServiceLabel = "com.docker.compose.service"
+	composeNumberLabel  = "com.docker.compose.container-number"
+
+	labelPrefix = "label:"
+)
+
+// ErrNotFound is returned by Resolve when no container matches the target
+var ErrNotFound = errors.New("no container matches")
+
+// ContainerLister is the part of docker client used to resolve targets
+type ContainerLister interface {
+	ContainerList(ctx context.Context, options container.ListOptions) ([]container.Summary, error)
+	ContainerInspect(ctx context.Context, containerID string) (container.InspectResponse, error)
+}
+
+// Container is a resolved target
+type Container struct {
+	ID   string
+	Name string
+}
+
+// Resolve finds the container for target, supported forms are
+//
+//	name or id, unique id prefix
+//	label:key=value[,key=value]
+//	compose-project.service[.index]
+//	image name, e.g. nginx or redis:7
+func Resolve(ctx context.Context, dockercli ContainerLister, target string) (Container, error) {
+	if selector, ok := strings.CutPrefix(target, labelPrefix); ok {
+		args := filters.NewArgs()
+		for _, l := range strings.Split(selector, ",") {
+			args.Add("label", strings.TrimSpace(l))
+		}
+
+		return resolveList(ctx, dockercli, target, args, nil)
+	}
+
+	// only a missing container falls through to the other forms, daemon errors are not hidden behind ErrNotFound
+	c, err := dockercli.ContainerInspect(ctx, target)
+	switch {
+	case err == nil:
+		return Container{ID: c.ID, Name: strings.TrimPrefix(c.Name, "/")}, nil
+	case cerrdefs.IsInvalidArgument(err):
+		// the daemon refuses an id prefix of several containers
+		if err := ambiguousPrefix(ctx, dockercli, target); err != nil {
+			return Container{}, err
+		}
+
+		return Container{}, err
+	case !cerrdefs.IsNotFound(err):
+		return Container{}, err
+	}
+
+	if project, service, index, ok := parseCompose(target); ok {
+		args := filters.NewArgs(
+			filters.Arg("label", composeProjectLabel+"="+project),
+			filters.Arg("label", composeServiceLabel+"="+service),
+		)
+
+		if index != "" {
+			args.Add("label", composeNumberLabel+"="+index)
+		}
+
+		c, err := resolveList(ctx, dockercli, target, args, nil)
+		if !errors.Is(err, ErrNotFound) {
+			return c, err
+		}
+	}
+
+	return resolveList(ctx, dockercli, target, filters.NewArgs(), func(c container.Summary) bool {
+		return matchImage(c.Image, target)
+	})
+}
+
+// parseCompose splits project.service[.index]
+func parseCompose(target string) (project, service, index string, ok bool) {
+	parts := strings.Split(target, ".")
+
+	switch len(parts) {
+	case 2:
+		project, service = parts[0], parts[1]
+	case 3:
+		if _, err := strconv.Atoi(parts[2]); err != nil {
+			return "", "", "", false
+		}
+		project, service, index = parts[0], parts[1], parts[2]
+	default:
+		return "", "", "", false
+	}
+
+	return project, service, index, project != "" && service != ""
+}
+
+// matchImage matches image with or without tag and registry, e.g. nginx matches docker.io/library/nginx:latest
+func matchImage(image, target string) bool {
+	if image == target {
+		return true
+	}
+
+	name, tag, hasTag := strings.Cut(image, ":")
+	if strings.Contains(tag, "/") { // registry port, not a tag
+		name, hasTag = image, false
+	}
+
+	short := name[strings.LastIndex(name, "/")+1:]
+
+	if !strings.Contains(target, ":") {
+		return name == target || short == target
+	}
+
+	return hasTag && (name+":"+tag == target || short+":"+tag == target)
+}
+
+func resolveList(ctx context.Context, dockercli ContainerLister, target string, args filters.Args, match func(container.Summary) bool) (Container, error) {
+	list, err := dockercli.ContainerList(ctx, container.ListOptions{All: true, Filters: args})
+	if err != nil {
+		return Container{}, err
+	}
+
+	var matched, running []container.Summary
+	for _, c := range list {
+		if match != nil && !match(c) {
+			continue
+		}
+
+		matched = append(matched, c)
+		if c.State == container.StateRunning {
+			running = append(running, c)
+		}
+	}
+
+	switch {
+	case len(matched) == 0:
+		return Container{}, fmt.Errorf("%w [%v]", ErrNotFound, target)
+	case len(matched) == 1:
+		return summaryToContainer(matched[0]), nil
+	case len(running) == 1:
+		return summaryToContainer(running[0]), nil
+	}
+
+	candidates := make([]string, 0, len(matched))
+	for _, c := range matched {
+		candidates = append(candidates, fmt.Sprintf("%v (%v)", summaryToContainer(c).Name, c.State))
+	}
+
+	return Container{}, fmt.Errorf("[%v] is ambiguous, matches %v containers: %v", target, len(matched), strings.Join(candidates, ", "))
+}
+
+// ambiguousPrefix returns an error listing the containers whose id starts with prefix, nil unless there are several
+func ambiguousPrefix(ctx context.Context, dockercli ContainerLister, prefix string) error {
+	list, err := dockercli.ContainerList(ctx, container.ListOptions{All: true})
+	if err != nil {
+		return err
+	}
+
+	var candidates []string
+	for _, c := range list {
+		if strings.HasPrefix(c.ID, prefix) {
+			candidates = append(candidates, fmt.Sprintf("%v (%v)", summaryToContainer(c).Name, c.ID[:min(len(c.ID), 12)]))
+		}
+	}
+
+	if len(candidates) < 2 {
+		return nil
+	}
+
+	return fmt.Errorf("[%v] is an ambiguous id prefix, matches %v containers: %v", prefix, len(candidates), strings.Join(candidates, ", "))
+}
+
+func summaryToContainer(c container.Summary) Container {
+	name := c.ID
+	if len(c.Names) > 0 {
+		name = strings.TrimPrefix(c.Names[0], "/")
+	}
+
+	return Container{ID: c.ID, Name: name}
+}
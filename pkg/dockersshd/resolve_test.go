@@ -0,0 +1,164 @@
+package dockersshd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	cerrdefs "github.com/containerd/errdefs"
+	"github.com/docker/docker/api/types/container"
+)
+
+type fakeLister struct {
+	containers []container.Summary
+
+	// inspectErr fails every inspect, like a daemon which cannot be reached
+	inspectErr error
+}
+
+func (f *fakeLister) ContainerList(ctx context.Context, options container.ListOptions) ([]container.Summary, error) {
+	var list []container.Summary
+
+	for _, c := range f.containers {
+		ok := true
+		for _, l := range options.Filters.Get("label") {
+			k, v, _ := strings.Cut(l, "=")
+			if c.Labels[k] != v {
+				ok = false
+			}
+		}
+
+		if ok {
+			list = append(list, c)
+		}
+	}
+
+	return list, nil
+}
+
+// ContainerInspect finds containers by name, id or unique id prefix like the daemon
+func (f *fakeLister) ContainerInspect(ctx context.Context, containerID string) (container.InspectResponse, error) {
+	if f.inspectErr != nil {
+		return container.InspectResponse{}, f.inspectErr
+	}
+
+	var prefixed []container.Summary
+	for _, c := range f.containers {
+		if c.ID == containerID || strings.TrimPrefix(c.Names[0], "/") == containerID {
+			return inspectResponse(c), nil
+		}
+
+		if strings.HasPrefix(c.ID, containerID) {
+			prefixed = append(prefixed, c)
+		}
+	}
+
+	switch len(prefixed) {
+	case 0:
+		return container.InspectResponse{}, fmt.Errorf("%w: no such container: %v", cerrdefs.ErrNotFound, containerID)
+	case 1:
+		return inspectResponse(prefixed[0]), nil
+	}
+
+	return container.InspectResponse{}, fmt.Errorf("%w: multiple IDs found with provided prefix: %v", cerrdefs.ErrInvalidArgument, containerID)
+}
+
+func inspectResponse(c container.Summary) container.InspectResponse {
+	return container.InspectResponse{
+		ContainerJSONBase: &container.ContainerJSONBase{ID: c.ID, Name: c.Names[0]},
+	}
+}
+
+func newFakeLister() *fakeLister {
+	compose := func(id, name, service, number, state string) container.Summary {
+		return container.Summary{
+			ID:    id,
+			Names: []string{"/" + name},
+			Image: "shop-" + service,
+			State: state,
+			Labels: map[string]string{
+				composeProjectLabel: "shop",
+				composeServiceLabel: service,
+				composeNumberLabel:  number,
+			},
+		}
+	}
+
+	return &fakeLister{containers: []container.Summary{
+		compose("aaa1", "shop-web-1", "web", "1", container.StateRunning),
+		compose("aaa2", "shop-web-2", "web", "2", container.StateRunning),
+		compose("bbb1", "shop-db-1", "db", "1", container.StateRunning),
+		{ID: "ccc1", Names: []string{"/cache"}, Image: "docker.io/library/redis:7", State: container.StateRunning, Labels: map[string]string{"tier": "cache"}},
+		{ID: "ddd1", Names: []string{"/old-cache"}, Image: "redis:6", State: container.StateExited},
+	}}
+}
+
+func TestResolve(t *testing.T) {
+	lister := newFakeLister()
+
+	tests := []struct {
+		target string
+		id     string
+	}{
+		{"shop-db-1", "bbb1"},
+		{"aaa2", "aaa2"},
+		{"bb", "bbb1"}, // unique id prefix
+		{"shop.db", "bbb1"},
+		{"shop.web.2", "aaa2"},
+		{"label:tier=cache", "ccc1"},
+		{"redis:7", "ccc1"},
+		{"redis", "ccc1"}, // only one running
+	}
+
+	for _, tt := range tests {
+		c, err := Resolve(context.Background(), lister, tt.target)
+		if err != nil {
+			t.Fatalf("Resolve(%v) returned error: %v", tt.target, err)
+		}
+
+		if c.ID != tt.id {
+			t.Fatalf("Resolve(%v) = %v, expected %v", tt.target, c.ID, tt.id)
+		}
+	}
+}
+
+func TestResolveAmbiguous(t *testing.T) {
+	_, err := Resolve(context.Background(), newFakeLister(), "shop.web")
+	if err == nil {
+		t.Fatal("expected error for ambiguous compose service")
+	}
+
+	if !strings.Contains(err.Error(), "shop-web-1") || !strings.Contains(err.Error(), "shop-web-2") {
+		t.Fatalf("expected candidates in error, got %v", err)
+	}
+}
+
+func TestResolveAmbiguousPrefix(t *testing.T) {
+	_, err := Resolve(context.Background(), newFakeLister(), "aaa")
+	if err == nil || errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ambiguity error, got %v", err)
+	}
+
+	if !strings.Contains(err.Error(), "ambiguous id prefix") || !strings.Contains(err.Error(), "shop-web-1") || !strings.Contains(err.Error(), "shop-web-2") {
+		t.Fatalf("expected candidates in error, got %v", err)
+	}
+}
+
+func TestResolveDaemonError(t *testing.T) {
+	lister := newFakeLister()
+	lister.inspectErr = fmt.Errorf("%w: permission denied", cerrdefs.ErrPermissionDenied)
+
+	// the image form would match, but the daemon error must not turn into another container or the picker
+	if _, err := Resolve(context.Background(), lister, "redis"); err == nil || errors.Is(err, ErrNotFound) || !strings.Contains(err.Error(), "permission denied") {
+		t.Fatalf("expected the daemon error, got %v", err)
+	}
+}
+
+func TestResolveNotFound(t *testing.T) {
+	_, err := Resolve(context.Background(), newFakeLister(), "missing")
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
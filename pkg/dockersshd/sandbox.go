@@ -0,0 +1,212 @@
+package dockersshd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	cerrdefs "github.com/containerd/errdefs"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/client"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	log "github.com/sirupsen/logrus"
+	"github.com/tg123/docker-sshd/pkg/bridge"
+)
+
+// SandboxPrefix on the username creates a fresh container from a template for the connection, e.g. sandbox:python
+const SandboxPrefix = "sandbox:"
+
+// SandboxLabel marks containers created for sandboxes, leftovers can be removed with docker rm -f $(docker ps -aq -f label=docker-sshd.sandbox)
+const SandboxLabel = "docker-sshd.sandbox"
+
+// SandboxTemplate describes the container created for a sandbox
+type SandboxTemplate struct {
+	Image      string   `json:"image"`
+	Cmd        []string `json:"cmd,omitempty"`
+	Env        []string `json:"env,omitempty"`
+	User       string   `json:"user,omitempty"`
+	WorkingDir string   `json:"workdir,omitempty"`
+
+	// Memory limit in bytes
+	Memory    int64   `json:"memory,omitempty"`
+	CPUs      float64 `json:"cpus,omitempty"`
+	PidsLimit int64   `json:"pids_limit,omitempty"`
+
+	// Network is the network mode, e.g. none, bridge or a network name
+	Network  string `json:"network,omitempty"`
+	ReadOnly bool   `json:"read_only,omitempty"`
+
+	// Mounts are binds in docker -v form, e.g. /data:/data:ro
+	Mounts []string `json:"mounts,omitempty"`
+}
+
+// SandboxTemplates maps template names to templates
+type SandboxTemplates map[string]SandboxTemplate
+
+// LoadSandboxTemplates reads templates from a json file
+func LoadSandboxTemplates(path string) (SandboxTemplates, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var templates SandboxTemplates
+	if err := json.Unmarshal(data, &templates); err != nil {
+		return nil, fmt.Errorf("%v: %w", path, err)
+	}
+
+	for name, t := range templates {
+		if t.Image == "" {
+			return nil, fmt.Errorf("%v: template %v has no image", path, name)
+		}
+	}
+
+	return templates, nil
+}
+
+// Lookup returns the template of name
+// other names are taken as image of the imageTemplate template, any image may be run unless imageTemplate is empty
+func (s SandboxTemplates) Lookup(name, imageTemplate string) (SandboxTemplate, error) {
+	if t, ok := s[name]; ok {
+		return t, nil
+	}
+
+	if t, ok := s[imageTemplate]; ok && imageTemplate != "" && name != "" {
+		t.Image = name
+		return t, nil
+	}
+
+	return SandboxTemplate{}, fmt.Errorf("sandbox template %v does not exist", name)
+}
+
+func (t SandboxTemplate) config() (*container.Config, *container.HostConfig) {
+	cmd := t.Cmd
+	if len(cmd) == 0 {
+		cmd = []string{"sleep", "infinity"}
+	}
+
+	config := &container.Config{
+		Image:      t.Image,
+		Cmd:        cmd,
+		Env:        t.Env,
+		User:       t.User,
+		WorkingDir: t.WorkingDir,
+		Labels:     map[string]string{SandboxLabel: "true"},
+	}
+
+	hostConfig := &container.HostConfig{
+		NetworkMode:    container.NetworkMode(t.Network),
+		Binds:          t.Mounts,
+		ReadonlyRootfs: t.ReadOnly,
+		Resources: container.Resources{
+			Memory:    t.Memory,
+			NanoCPUs:  int64(t.CPUs * 1e9),
+			PidsLimit: pidsLimit(t.PidsLimit),
+		},
+	}
+
+	return config, hostConfig
+}
+
+func pidsLimit(n int64) *int64 {
+	if n == 0 {
+		return nil
+	}
+
+	return &n
+}
+
+var _ bridge.SessionProvider = (*sandboxconn)(nil)
+
+// sandboxconn execs into a container it created, the container is removed on Close
+type sandboxconn struct {
+	*dockersshdconn
+	sandboxcli sandboxClient
+}
+
+// sandboxClient is the part of docker client used to create and remove sandbox containers
+type sandboxClient interface {
+	ContainerCreate(ctx context.Context, config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, platform *ocispec.Platform, containerName string) (container.CreateResponse, error)
+	ContainerStart(ctx context.Context, containerID string, options container.StartOptions) error
+	ContainerRemove(ctx context.Context, containerID string, options container.RemoveOptions) error
+	ImagePull(ctx context.Context, refStr string, options image.PullOptions) (io.ReadCloser, error)
+}
+
+// NewSandbox creates and starts a container from t, the image is pulled if missing
+// the returned provider removes the container when closed
+func NewSandbox(ctx context.Context, dockercli *client.Client, t SandboxTemplate) (bridge.SessionProvider, error) {
+	id, err := startSandbox(ctx, dockercli, t)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sandboxconn{
+		dockersshdconn: newDockersshdconn(dockercli, id, false),
+		sandboxcli:     dockercli,
+	}, nil
+}
+
+// startSandbox creates and starts a container from t and returns its id, it is removed again if it fails to start
+func startSandbox(ctx context.Context, dockercli sandboxClient, t SandboxTemplate) (string, error) {
+	config, hostConfig := t.config()
+
+	created, err := dockercli.ContainerCreate(ctx, config, hostConfig, nil, nil, "")
+	if cerrdefs.IsNotFound(err) {
+		log.Infof("pulling sandbox image %v", t.Image)
+
+		if err = pullImage(ctx, dockercli, t.Image); err == nil {
+			created, err = dockercli.ContainerCreate(ctx, config, hostConfig, nil, nil, "")
+		}
+	}
+
+	if err != nil {
+		return "", fmt.Errorf("failed to create sandbox from %v: %w", t.Image, err)
+	}
+
+	if err := dockercli.ContainerStart(ctx, created.ID, container.StartOptions{}); err != nil {
+		_ = removeSandbox(dockercli, created.ID)
+		return "", fmt.Errorf("failed to start sandbox from %v: %w", t.Image, err)
+	}
+
+	log.Infof("sandbox container [%v] from %v started", created.ID, t.Image)
+
+	return created.ID, nil
+}
+
+// removeSandbox removes the container with its anonymous volumes, even if the connection's context has ended
+func removeSandbox(dockercli sandboxClient, id string) error {
+	log.Infof("removing sandbox container [%v]", id)
+
+	return dockercli.ContainerRemove(context.Background(), id, container.RemoveOptions{
+		Force:         true,
+		RemoveVolumes: true,
+	})
+}
+
+func (s *sandboxconn) Close() error {
+	_ = s.dockersshdconn.Close()
+
+	return removeSandbox(s.sandboxcli, s.containerName)
+}
+
+func pullImage(ctx context.Context, dockercli sandboxClient, ref string) error {
+	r, err := dockercli.ImagePull(ctx, ref, image.PullOptions{})
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	// the pull is done when the progress stream ends
+	_, err = io.Copy(io.Discard, r)
+	return err
+}
+
+// IsSandbox reports whether user asks for a sandbox and returns the template name
+func IsSandbox(user string) (string, bool) {
+	return strings.CutPrefix(user, SandboxPrefix)
+}
@@ -0,0 +1,211 @@
+package dockersshd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	cerrdefs "github.com/containerd/errdefs"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/network"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// fakeSandboxClient keeps the containers created from images it has pulled
+type fakeSandboxClient struct {
+	images     map[string]bool
+	pulls      []string
+	created    []*container.Config
+	started    []string
+	removed    []string
+	startErr   error
+	containers map[string]bool
+}
+
+func newFakeSandboxClient(images ...string) *fakeSandboxClient {
+	f := &fakeSandboxClient{images: map[string]bool{}, containers: map[string]bool{}}
+	for _, i := range images {
+		f.images[i] = true
+	}
+
+	return f
+}
+
+func (f *fakeSandboxClient) ContainerCreate(ctx context.Context, config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, platform *ocispec.Platform, containerName string) (container.CreateResponse, error) {
+	if !f.images[config.Image] {
+		return container.CreateResponse{}, fmt.Errorf("%w: no such image: %v", cerrdefs.ErrNotFound, config.Image)
+	}
+
+	f.created = append(f.created, config)
+	id := fmt.Sprintf("sandbox%d", len(f.created))
+	f.containers[id] = true
+
+	return container.CreateResponse{ID: id}, nil
+}
+
+func (f *fakeSandboxClient) ContainerStart(ctx context.Context, containerID string, options container.StartOptions) error {
+	if f.startErr != nil {
+		return f.startErr
+	}
+
+	f.started = append(f.started, containerID)
+	return nil
+}
+
+func (f *fakeSandboxClient) ContainerRemove(ctx context.Context, containerID string, options container.RemoveOptions) error {
+	if !options.Force || !options.RemoveVolumes {
+		return fmt.Errorf("expected forced removal with volumes, got %#v", options)
+	}
+
+	f.removed = append(f.removed, containerID)
+	delete(f.containers, containerID)
+	return nil
+}
+
+func (f *fakeSandboxClient) ImagePull(ctx context.Context, refStr string, options image.PullOptions) (io.ReadCloser, error) {
+	f.pulls = append(f.pulls, refStr)
+	if refStr == "missing" {
+		return nil, fmt.Errorf("%w: pull access denied for %v", cerrdefs.ErrNotFound, refStr)
+	}
+
+	f.images[refStr] = true
+	return io.NopCloser(strings.NewReader(`{"status":"Pull complete"}`)), nil
+}
+
+func TestSandboxTemplates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sandbox.json")
+	if err := os.WriteFile(path, []byte(`{
+		"python": {"image": "python:3.12", "memory": 536870912, "cpus": 0.5, "pids_limit": 128, "network": "none"},
+		"restricted": {"image": "busybox", "memory": 268435456, "read_only": true}
+	}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	templates, err := LoadSandboxTemplates(path)
+	if err != nil {
+		t.Fatalf("LoadSandboxTemplates returned error: %v", err)
+	}
+
+	python, err := templates.Lookup("python", "")
+	if err != nil {
+		t.Fatalf("Lookup returned error: %v", err)
+	}
+
+	config, hostConfig := python.config()
+	if config.Image != "python:3.12" || config.Labels[SandboxLabel] != "true" || config.Cmd[0] != "sleep" {
+		t.Fatalf("unexpected container config %#v", config)
+	}
+
+	if hostConfig.NanoCPUs != 5e8 || *hostConfig.PidsLimit != 128 || hostConfig.NetworkMode != "none" {
+		t.Fatalf("unexpected host config %#v", hostConfig)
+	}
+
+	// any image is only allowed with an image template
+	if _, err := templates.Lookup("alpine:3", ""); err == nil {
+		t.Fatal("expected error for unknown template")
+	}
+
+	alpine, err := templates.Lookup("alpine:3", "restricted")
+	if err != nil {
+		t.Fatalf("Lookup returned error: %v", err)
+	}
+
+	if alpine.Image != "alpine:3" || !alpine.ReadOnly || alpine.Memory != 268435456 {
+		t.Fatalf("expected restricted template with image from name, got %#v", alpine)
+	}
+
+	if python, err := templates.Lookup("python", "restricted"); err != nil || python.Image != "python:3.12" {
+		t.Fatalf("expected own template to win, got %#v %v", python, err)
+	}
+
+	if _, err := templates.Lookup("*", ""); err == nil {
+		t.Fatal("expected * to be no template")
+	}
+}
+
+func TestSandboxTemplateRequiresImage(t *testing.T) {
+	for _, templates := range []string{`{"broken": {"memory": 1}}`, `{"*": {"memory": 1}}`} {
+		path := filepath.Join(t.TempDir(), "sandbox.json")
+		if err := os.WriteFile(path, []byte(templates), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := LoadSandboxTemplates(path); err == nil {
+			t.Fatalf("expected error for template without image in %v", templates)
+		}
+	}
+}
+
+func TestStartSandbox(t *testing.T) {
+	dockercli := newFakeSandboxClient("python:3.12")
+
+	id, err := startSandbox(context.Background(), dockercli, SandboxTemplate{Image: "python:3.12"})
+	if err != nil {
+		t.Fatalf("startSandbox returned error: %v", err)
+	}
+
+	if len(dockercli.pulls) != 0 || len(dockercli.created) != 1 || dockercli.created[0].Labels[SandboxLabel] != "true" {
+		t.Fatalf("expected one labeled container without pull, got %#v pulls %v", dockercli.created, dockercli.pulls)
+	}
+
+	if len(dockercli.started) != 1 || dockercli.started[0] != id {
+		t.Fatalf("expected %v to be started, got %v", id, dockercli.started)
+	}
+
+	if err := removeSandbox(dockercli, id); err != nil || len(dockercli.containers) != 0 {
+		t.Fatalf("expected %v to be removed, got %v %v", id, dockercli.containers, err)
+	}
+}
+
+func TestStartSandboxPullsMissingImage(t *testing.T) {
+	dockercli := newFakeSandboxClient()
+
+	if _, err := startSandbox(context.Background(), dockercli, SandboxTemplate{Image: "alpine:3"}); err != nil {
+		t.Fatalf("startSandbox returned error: %v", err)
+	}
+
+	if len(dockercli.pulls) != 1 || dockercli.pulls[0] != "alpine:3" || len(dockercli.started) != 1 {
+		t.Fatalf("expected alpine:3 to be pulled and started, got pulls %v started %v", dockercli.pulls, dockercli.started)
+	}
+
+	if _, err := startSandbox(context.Background(), dockercli, SandboxTemplate{Image: "missing"}); err == nil || len(dockercli.containers) != 1 {
+		t.Fatalf("expected failed pull to create nothing, got %v %v", err, dockercli.containers)
+	}
+}
+
+func TestStartSandboxRemovesContainerFailingToStart(t *testing.T) {
+	dockercli := newFakeSandboxClient("python:3.12")
+	dockercli.startErr = errors.New("port is already allocated")
+
+	if _, err := startSandbox(context.Background(), dockercli, SandboxTemplate{Image: "python:3.12"}); err == nil || !strings.Contains(err.Error(), "port is already allocated") {
+		t.Fatalf("expected start error, got %v", err)
+	}
+
+	if len(dockercli.removed) != 1 || len(dockercli.containers) != 0 {
+		t.Fatalf("expected the created container to be removed, got removed %v left %v", dockercli.removed, dockercli.containers)
+	}
+}
+
+func TestSandboxCloseRemovesContainer(t *testing.T) {
+	dockercli := newFakeSandboxClient("python:3.12")
+
+	id, err := startSandbox(context.Background(), dockercli, SandboxTemplate{Image: "python:3.12"})
+	if err != nil {
+		t.Fatalf("startSandbox returned error: %v", err)
+	}
+
+	s := &sandboxconn{dockersshdconn: newDockersshdconn(nil, id, false), sandboxcli: dockercli}
+	if err := s.Close(); err != nil || len(dockercli.removed) != 1 || dockercli.removed[0] != id {
+		t.Fatalf("expected %v to be removed, got %v %v", id, dockercli.removed, err)
+	}
+
+	if s.closed.Err() == nil {
+		t.Fatal("expected running execs of the sandbox to be stopped")
+	}
+}
@@ -0,0 +1,117 @@
+package dockersshd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	log "github.com/sirupsen/logrus"
+)
+
+// Options changes how sessions reach the container
+type Options struct {
+	// AutoStart starts or unpauses a container which is not running
+	AutoStart bool
+
+	// DetachKeys ends attach sessions without stopping the container, DefaultDetachKeys if empty
+	DetachKeys string
+}
+
+// StartTimeout is how long AutoStart waits for the container to run
+var StartTimeout = 30 * time.Second
+
+// containerStarter is the part of docker client used to bring a container up
+type containerStarter interface {
+	ContainerInspect(ctx context.Context, containerID string) (container.InspectResponse, error)
+	ContainerStart(ctx context.Context, containerID string, options container.StartOptions) error
+	ContainerUnpause(ctx context.Context, containerID string) error
+}
+
+// ensureRunning returns nil when the container is running, starting it first if autoStart
+// otherwise the error describes the state and the last exit code
+func ensureRunning(ctx context.Context, dockercli containerStarter, containerName string, autoStart bool) error {
+	info, err := dockercli.ContainerInspect(ctx, containerName)
+	if err != nil {
+		return err
+	}
+
+	if info.ContainerJSONBase == nil || info.State == nil {
+		return nil
+	}
+
+	state := info.State
+	if isRunning(state) {
+		return nil
+	}
+
+	name := strings.TrimPrefix(info.Name, "/")
+	if name == "" {
+		name = containerName
+	}
+
+	if !autoStart {
+		return describeState(name, state)
+	}
+
+	if state.Paused {
+		log.Infof("unpausing container [%v]", name)
+		err = dockercli.ContainerUnpause(ctx, containerName)
+	} else if !state.Restarting {
+		log.Infof("starting container [%v], it was %v", name, state.Status)
+		err = dockercli.ContainerStart(ctx, containerName, container.StartOptions{})
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to start container %v: %w", name, err)
+	}
+
+	deadline := time.Now().Add(StartTimeout)
+	for {
+		info, err := dockercli.ContainerInspect(ctx, containerName)
+		if err != nil {
+			return err
+		}
+
+		state := info.State
+		if isRunning(state) {
+			return nil
+		}
+
+		if time.Now().After(deadline) || (!state.Running && !state.Restarting && state.Status != container.StateCreated) {
+			return describeState(name, state)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+}
+
+func isRunning(state *container.State) bool {
+	return state.Running && !state.Paused && !state.Restarting
+}
+
+func describeState(name string, state *container.State) error {
+	switch {
+	case state.Paused:
+		return fmt.Errorf("container %v is paused", name)
+	case state.Restarting:
+		return fmt.Errorf("container %v is restarting, last exit code %v", name, state.ExitCode)
+	case state.Status == container.StateExited || state.Status == container.StateDead:
+		msg := fmt.Sprintf("container %v is %v with exit code %v", name, state.Status, state.ExitCode)
+		if state.FinishedAt != "" {
+			msg += " at " + state.FinishedAt
+		}
+		if state.Error != "" {
+			msg += ": " + state.Error
+		}
+		return errors.New(msg)
+	default:
+		return fmt.Errorf("container %v is %v", name, state.Status)
+	}
+}
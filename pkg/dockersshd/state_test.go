@@ -0,0 +1,72 @@
+package dockersshd
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types/container"
+)
+
+type fakeStarter struct {
+	state    container.State
+	started  int
+	unpaused int
+}
+
+func (f *fakeStarter) ContainerInspect(ctx context.Context, containerID string) (container.InspectResponse, error) {
+	state := f.state
+	return container.InspectResponse{
+		ContainerJSONBase: &container.ContainerJSONBase{ID: containerID, Name: "/web", State: &state},
+	}, nil
+}
+
+func (f *fakeStarter) ContainerStart(ctx context.Context, containerID string, options container.StartOptions) error {
+	f.started++
+	f.state = container.State{Status: container.StateRunning, Running: true}
+	return nil
+}
+
+func (f *fakeStarter) ContainerUnpause(ctx context.Context, containerID string) error {
+	f.unpaused++
+	f.state.Paused = false
+	return nil
+}
+
+func TestEnsureRunningReportsState(t *testing.T) {
+	f := &fakeStarter{state: container.State{Status: container.StateExited, ExitCode: 137, FinishedAt: "2024-05-01T10:00:00Z"}}
+
+	err := ensureRunning(context.Background(), f, "abc", false)
+	if err == nil || !strings.Contains(err.Error(), "web is exited with exit code 137 at 2024-05-01T10:00:00Z") {
+		t.Fatalf("expected state in error, got %v", err)
+	}
+
+	if f.started != 0 {
+		t.Fatal("expected container not to be started without auto start")
+	}
+}
+
+func TestEnsureRunningAutoStart(t *testing.T) {
+	stopped := &fakeStarter{state: container.State{Status: container.StateExited}}
+	if err := ensureRunning(context.Background(), stopped, "abc", true); err != nil {
+		t.Fatalf("ensureRunning returned error: %v", err)
+	}
+
+	if stopped.started != 1 {
+		t.Fatalf("expected container to be started once, got %v", stopped.started)
+	}
+
+	paused := &fakeStarter{state: container.State{Status: container.StatePaused, Running: true, Paused: true}}
+	if err := ensureRunning(context.Background(), paused, "abc", true); err != nil {
+		t.Fatalf("ensureRunning returned error: %v", err)
+	}
+
+	if paused.unpaused != 1 || paused.started != 0 {
+		t.Fatalf("expected container to be unpaused, got unpaused %v started %v", paused.unpaused, paused.started)
+	}
+
+	running := &fakeStarter{state: container.State{Status: container.StateRunning, Running: true}}
+	if err := ensureRunning(context.Background(), running, "abc", true); err != nil || running.started != 0 {
+		t.Fatalf("expected running container to be left alone, got %v", err)
+	}
+}
@@ -0,0 +1,34 @@
+package dockersshd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	"github.com/tg123/docker-sshd/pkg/bridge"
+)
+
+// ListTargets lists running containers for the picker
+func ListTargets(ctx context.Context, dockercli *client.Client) ([]bridge.Target, error) {
+	containers, err := dockercli.ContainerList(ctx, container.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	targets := make([]bridge.Target, 0, len(containers))
+	for _, c := range containers {
+		name := c.ID[:12]
+		if len(c.Names) > 0 {
+			name = strings.TrimPrefix(c.Names[0], "/")
+		}
+
+		targets = append(targets, bridge.Target{
+			Name:        name,
+			Description: fmt.Sprintf("%v (%v)", c.Image, c.Status),
+		})
+	}
+
+	return targets, nil
+}
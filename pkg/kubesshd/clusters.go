@@ -0,0 +1,175 @@
+package kubesshd
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"k8s.io/client-go/kubernetes"
+	restclient "k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// Cluster is the api of one kubeconfig context
+type Cluster struct {
+	Context   string
+	Config    *restclient.Config
+	Clientset kubernetes.Interface
+}
+
+// Clusters caches a Cluster per kubeconfig context, the cache is dropped when a kubeconfig file changes
+type Clusters struct {
+	rules *clientcmd.ClientConfigLoadingRules
+
+	// DefaultContext is used for usernames without context, current-context if empty
+	DefaultContext string
+
+	mu       sync.Mutex
+	mtimes   map[string]time.Time
+	contexts []string
+	clusters map[string]*Cluster
+}
+
+// NewClusters loads kubeconfig with rules, e.g. clientcmd.NewDefaultClientConfigLoadingRules()
+func NewClusters(rules *clientcmd.ClientConfigLoadingRules, defaultContext string) *Clusters {
+	return &Clusters{
+		rules:          rules,
+		DefaultContext: defaultContext,
+	}
+}
+
+// Get returns the cluster of context, the default context if empty
+func (c *Clusters) Get(context string) (*Cluster, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.reloadIfChanged(); err != nil {
+		return nil, err
+	}
+
+	if context == "" {
+		context = c.DefaultContext
+	}
+
+	if cluster, ok := c.clusters[context]; ok {
+		return cluster, nil
+	}
+
+	if context != "" && !c.hasContext(context) {
+		return nil, fmt.Errorf("kubeconfig context %v does not exist", context)
+	}
+
+	config, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(c.rules, &clientcmd.ConfigOverrides{
+		CurrentContext: context,
+	}).ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	cluster := &Cluster{
+		Context:   context,
+		Config:    config,
+		Clientset: clientset,
+	}
+
+	c.clusters[context] = cluster
+	return cluster, nil
+}
+
+// Split cuts a leading kubeconfig context from user, e.g. prod/ns/pod/container returns prod and ns/pod/container
+// user is returned as is if its first segment is not a context
+func (c *Clusters) Split(user string) (context, rest string) {
+	first, rest, ok := strings.Cut(user, "/")
+	if !ok {
+		return "", user
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.reloadIfChanged(); err != nil {
+		log.Warnf("failed to load kubeconfig: %v", err)
+		return "", user
+	}
+
+	if !c.hasContext(first) {
+		return "", user
+	}
+
+	return first, rest
+}
+
+// Contexts returns the context names of kubeconfig
+func (c *Clusters) Contexts() ([]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.reloadIfChanged(); err != nil {
+		return nil, err
+	}
+
+	return c.contexts, nil
+}
+
+func (c *Clusters) hasContext(name string) bool {
+	i := sort.SearchStrings(c.contexts, name)
+	return i < len(c.contexts) && c.contexts[i] == name
+}
+
+// reloadIfChanged reads kubeconfig again when the mtime of any file differs, caller holds mu
+func (c *Clusters) reloadIfChanged() error {
+	mtimes := make(map[string]time.Time)
+	for _, f := range c.rules.GetLoadingPrecedence() {
+		if st, err := os.Stat(f); err == nil {
+			mtimes[f] = st.ModTime()
+		}
+	}
+
+	if c.clusters != nil && sameMtimes(c.mtimes, mtimes) {
+		return nil
+	}
+
+	raw, err := c.rules.Load()
+	if err != nil {
+		return err
+	}
+
+	contexts := make([]string, 0, len(raw.Contexts))
+	for name := range raw.Contexts {
+		contexts = append(contexts, name)
+	}
+	sort.Strings(contexts)
+
+	if c.clusters != nil {
+		log.Infof("kubeconfig changed, reloading %v contexts", len(contexts))
+	}
+
+	c.mtimes = mtimes
+	c.contexts = contexts
+	c.clusters = make(map[string]*Cluster)
+
+	return nil
+}
+
+func sameMtimes(a, b map[string]time.Time) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for f, t := range a {
+		if !b[f].Equal(t) {
+			return false
+		}
+	}
+
+	return true
+}
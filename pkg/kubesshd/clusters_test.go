@@ -0,0 +1,106 @@
+package kubesshd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+func writeKubeconfig(t *testing.T, path, stagingServer string, mtime time.Time) {
+	kubeconfig := fmt.Sprintf(`apiVersion: v1
+kind: Config
+current-context: prod
+clusters:
+- name: prod
+  cluster:
+    server: https://prod.example.com
+- name: staging
+  cluster:
+    server: %v
+contexts:
+- name: prod
+  context:
+    cluster: prod
+    user: ops
+- name: staging
+  context:
+    cluster: staging
+    user: ops
+users:
+- name: ops
+  user:
+    token: secret
+`, stagingServer)
+
+	if err := os.WriteFile(path, []byte(kubeconfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClusters(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kubeconfig")
+	now := time.Now()
+	writeKubeconfig(t, path, "https://staging.example.com", now.Add(-time.Minute))
+
+	clusters := NewClusters(&clientcmd.ClientConfigLoadingRules{ExplicitPath: path}, "")
+
+	tests := []struct {
+		user    string
+		context string
+		rest    string
+	}{
+		{"web-1", "", "web-1"},
+		{"prod/web-1", "prod", "web-1"},
+		{"staging/default/web-1/nginx", "staging", "default/web-1/nginx"},
+		{"prod/deploy/web", "prod", "deploy/web"},
+		{"dev/deploy/web", "", "dev/deploy/web"},
+	}
+
+	for _, tt := range tests {
+		context, rest := clusters.Split(tt.user)
+		if context != tt.context || rest != tt.rest {
+			t.Fatalf("Split(%v) = %v, %v, expected %v, %v", tt.user, context, rest, tt.context, tt.rest)
+		}
+	}
+
+	prod, err := clusters.Get("")
+	if err != nil {
+		t.Fatalf("Get returned error: %v", err)
+	}
+
+	if prod.Config.Host != "https://prod.example.com" {
+		t.Fatalf("expected current-context prod, got %v", prod.Config.Host)
+	}
+
+	staging, err := clusters.Get("staging")
+	if err != nil {
+		t.Fatalf("Get returned error: %v", err)
+	}
+
+	if again, _ := clusters.Get("staging"); again != staging {
+		t.Fatal("expected cached cluster")
+	}
+
+	if _, err := clusters.Get("missing"); err == nil {
+		t.Fatal("expected error for unknown context")
+	}
+
+	writeKubeconfig(t, path, "https://staging2.example.com", now)
+
+	reloaded, err := clusters.Get("staging")
+	if err != nil {
+		t.Fatalf("Get returned error: %v", err)
+	}
+
+	if reloaded.Config.Host != "https://staging2.example.com" {
+		t.Fatalf("expected reloaded kubeconfig, got %v", reloaded.Config.Host)
+	}
+}
@@ -0,0 +1,257 @@
+package kubesshd
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tg123/docker-sshd/pkg/bridge"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	restclient "k8s.io/client-go/rest"
+)
+
+// DebugSuffix on the username runs the session in an ephemeral debug container, e.g. web-1+debug
+const DebugSuffix = "+debug"
+
+// DebugStartTimeout is how long to wait for the debug container to run
+var DebugStartTimeout = 2 * time.Minute
+
+var _ bridge.SessionProvider = (*debugconn)(nil)
+var _ bridge.Session = (*debugsession)(nil)
+
+// debugconn runs the command as an ephemeral container and attaches to it, like kubectl debug
+// ephemeral containers cannot be removed from the pod, one is created per connection and shared by its sessions
+type debugconn struct {
+	*kubesshdconn
+
+	clientset kubernetes.Interface
+	image     string
+
+	mu   sync.Mutex
+	name string
+	spec v1.EphemeralContainer
+}
+
+// NewDebug returns a provider which runs commands in a new ephemeral container of image,
+// sharing the process namespace of container
+func NewDebug(config *restclient.Config, namespace, pod, container, image string) (bridge.SessionProvider, error) {
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &debugconn{
+		kubesshdconn: newKubesshdconn(config, namespace, pod, container),
+		clientset:    clientset,
+		image:        image,
+	}, nil
+}
+
+func (d *debugconn) NewSession() bridge.Session {
+	return &debugsession{kubesession: d.newSession(), debug: d}
+}
+
+// debugsession attaches to the debug container of the connection, sessions share its terminal like docker attach
+type debugsession struct {
+	*kubesession
+	debug *debugconn
+}
+
+func (d *debugsession) Exec(ctx context.Context, execconfig bridge.ExecConfig) (<-chan bridge.ExecResult, error) {
+	// every forwarded channel would need a container of its own
+	if execconfig.Forward {
+		return nil, fmt.Errorf("port forwarding is not available in debug containers")
+	}
+
+	name, err := d.debug.debugContainer(ctx, execconfig)
+	if err != nil {
+		return nil, err
+	}
+
+	req := d.debug.clientset.CoreV1().RESTClient().Post().
+		Resource("pods").
+		Name(d.pod).
+		Namespace(d.namespace).
+		SubResource("attach").
+		VersionedParams(
+			&v1.PodAttachOptions{
+				Container: name,
+				Stdin:     true,
+				Stdout:    true,
+				Stderr:    !execconfig.Tty,
+				TTY:       execconfig.Tty,
+			},
+			scheme.ParameterCodec,
+		)
+
+	return d.stream(ctx, req.URL(), execconfig)
+}
+
+// debugContainer returns the running debug container of the connection, the first session creates it with its command
+// later sessions attach to it and must ask for the same command, environment and user
+func (d *debugconn) debugContainer(ctx context.Context, execconfig bridge.ExecConfig) (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	c, err := d.ephemeralContainer(execconfig)
+	if err != nil {
+		return "", err
+	}
+
+	if d.name == "" {
+		name, err := createDebugContainer(ctx, d.clientset, d.namespace, d.pod, c)
+		if err != nil {
+			return "", err
+		}
+
+		log.Infof("created debug container %v in pod %v/%v", name, d.namespace, d.pod)
+
+		// kept even if it fails to start, a retry would add another container
+		d.name = name
+		d.spec = c
+	} else if !sameProcess(d.spec, c) {
+		return "", fmt.Errorf("debug container %v of this connection runs %q, connect again to run %q", d.name, d.spec.Command, c.Command)
+	}
+
+	if err := waitDebugContainer(ctx, d.clientset, d.namespace, d.pod, d.name); err != nil {
+		return "", err
+	}
+
+	return d.name, nil
+}
+
+// ephemeralContainer runs the command of execconfig next to the target container, as the exec user if set
+func (d *debugconn) ephemeralContainer(execconfig bridge.ExecConfig) (v1.EphemeralContainer, error) {
+	securityContext, err := runAs(execconfig.User)
+	if err != nil {
+		return v1.EphemeralContainer{}, err
+	}
+
+	return v1.EphemeralContainer{
+		EphemeralContainerCommon: v1.EphemeralContainerCommon{
+			Image:                    d.image,
+			Command:                  execconfig.Cmd,
+			Env:                      envVars(execconfig.Env),
+			WorkingDir:               execconfig.WorkingDir,
+			Stdin:                    true,
+			TTY:                      execconfig.Tty,
+			TerminationMessagePolicy: v1.TerminationMessageReadFile,
+			SecurityContext:          securityContext,
+		},
+		TargetContainerName: d.container,
+	}, nil
+}
+
+// sameProcess reports whether a and b run the same command with the same environment, user and working directory
+func sameProcess(a, b v1.EphemeralContainer) bool {
+	return equality.Semantic.DeepEqual(a.Command, b.Command) &&
+		equality.Semantic.DeepEqual(a.Env, b.Env) &&
+		equality.Semantic.DeepEqual(a.SecurityContext, b.SecurityContext) &&
+		a.WorkingDir == b.WorkingDir
+}
+
+// runAs is the security context running as user, uid or uid:gid since user names of the debug image are not known
+func runAs(user string) (*v1.SecurityContext, error) {
+	if user == "" {
+		return nil, nil
+	}
+
+	uid, gid, _ := strings.Cut(user, ":")
+	if gid == "" {
+		gid = uid
+	}
+
+	runAsUser, err := strconv.ParseInt(uid, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("debug containers run as uid or uid:gid, got %v", user)
+	}
+
+	runAsGroup, err := strconv.ParseInt(gid, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("debug containers run as uid or uid:gid, got %v", user)
+	}
+
+	return &v1.SecurityContext{
+		RunAsUser:  &runAsUser,
+		RunAsGroup: &runAsGroup,
+	}, nil
+}
+
+// createDebugContainer adds c with a generated name to the ephemeral containers of pod and returns the name
+func createDebugContainer(ctx context.Context, clientset kubernetes.Interface, namespace, pod string, c v1.EphemeralContainer) (string, error) {
+	p, err := clientset.CoreV1().Pods(namespace).Get(ctx, pod, metav1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+
+	c.Name = debugContainerName(p.Spec.EphemeralContainers)
+	p.Spec.EphemeralContainers = append(p.Spec.EphemeralContainers, c)
+
+	if _, err := clientset.CoreV1().Pods(namespace).UpdateEphemeralContainers(ctx, pod, p, metav1.UpdateOptions{}); err != nil {
+		return "", fmt.Errorf("failed to create debug container: %w", err)
+	}
+
+	return c.Name, nil
+}
+
+// debugContainerName returns a debugger-NNNNN name no ephemeral container of the pod has
+func debugContainerName(existing []v1.EphemeralContainer) string {
+	used := make(map[string]bool, len(existing))
+	for _, c := range existing {
+		used[c.Name] = true
+	}
+
+	for {
+		name := fmt.Sprintf("debugger-%05d", rand.IntN(100000))
+		if !used[name] {
+			return name
+		}
+	}
+}
+
+// waitDebugContainer waits until the ephemeral container is running
+func waitDebugContainer(ctx context.Context, clientset kubernetes.Interface, namespace, pod, name string) error {
+	return wait.PollUntilContextTimeout(ctx, 500*time.Millisecond, DebugStartTimeout, true, func(ctx context.Context) (bool, error) {
+		p, err := clientset.CoreV1().Pods(namespace).Get(ctx, pod, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+
+		for _, s := range p.Status.EphemeralContainerStatuses {
+			if s.Name != name {
+				continue
+			}
+
+			switch {
+			case s.State.Running != nil:
+				return true, nil
+			case s.State.Terminated != nil:
+				return false, fmt.Errorf("debug container %v exited: %v %v", name, s.State.Terminated.Reason, s.State.Terminated.Message)
+			case s.State.Waiting != nil && (s.State.Waiting.Reason == "ErrImagePull" || s.State.Waiting.Reason == "ImagePullBackOff"):
+				return false, fmt.Errorf("debug container %v cannot pull image: %v", name, s.State.Waiting.Message)
+			}
+		}
+
+		return false, nil
+	})
+}
+
+func envVars(env []string) []v1.EnvVar {
+	var vars []v1.EnvVar
+	for _, e := range env {
+		k, v, _ := strings.Cut(e, "=")
+		vars = append(vars, v1.EnvVar{Name: k, Value: v})
+	}
+
+	return vars
+}
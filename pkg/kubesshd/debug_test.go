@@ -0,0 +1,160 @@
+package kubesshd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/tg123/docker-sshd/pkg/bridge"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// withEphemeralState reports every ephemeral container of pods in state
+func withEphemeralState(clientset *fake.Clientset, state v1.ContainerState) {
+	clientset.PrependReactor("get", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		get := action.(k8stesting.GetAction)
+
+		obj, err := clientset.Tracker().Get(action.GetResource(), get.GetNamespace(), get.GetName())
+		if err != nil {
+			return true, nil, err
+		}
+
+		pod := obj.(*v1.Pod).DeepCopy()
+		pod.Status.EphemeralContainerStatuses = nil
+		for _, c := range pod.Spec.EphemeralContainers {
+			pod.Status.EphemeralContainerStatuses = append(pod.Status.EphemeralContainerStatuses, v1.ContainerStatus{Name: c.Name, State: state})
+		}
+
+		return true, pod, nil
+	})
+}
+
+func TestCreateDebugContainer(t *testing.T) {
+	clientset := fake.NewClientset(&v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "web-1", Namespace: "default"},
+		Spec:       v1.PodSpec{Containers: []v1.Container{{Name: "app"}}},
+	})
+	withEphemeralState(clientset, v1.ContainerState{Running: &v1.ContainerStateRunning{}})
+
+	name, err := createDebugContainer(context.Background(), clientset, "default", "web-1", v1.EphemeralContainer{
+		EphemeralContainerCommon: v1.EphemeralContainerCommon{Image: "busybox", Command: []string{"/bin/sh"}},
+		TargetContainerName:      "app",
+	})
+	if err != nil {
+		t.Fatalf("createDebugContainer returned error: %v", err)
+	}
+
+	pod, err := clientset.CoreV1().Pods("default").Get(context.Background(), "web-1", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(pod.Spec.EphemeralContainers) != 1 {
+		t.Fatalf("expected one ephemeral container, got %#v", pod.Spec.EphemeralContainers)
+	}
+
+	c := pod.Spec.EphemeralContainers[0]
+	if c.Name != name || c.TargetContainerName != "app" || c.Image != "busybox" {
+		t.Fatalf("unexpected ephemeral container %#v", c)
+	}
+
+	if err := waitDebugContainer(context.Background(), clientset, "default", "web-1", name); err != nil {
+		t.Fatalf("waitDebugContainer returned error: %v", err)
+	}
+}
+
+func TestWaitDebugContainerFails(t *testing.T) {
+	clientset := fake.NewClientset(&v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "web-1", Namespace: "default"},
+		Spec:       v1.PodSpec{EphemeralContainers: []v1.EphemeralContainer{{EphemeralContainerCommon: v1.EphemeralContainerCommon{Name: "debugger-1"}}}},
+	})
+	withEphemeralState(clientset, v1.ContainerState{Waiting: &v1.ContainerStateWaiting{Reason: "ImagePullBackOff", Message: "not found"}})
+
+	err := waitDebugContainer(context.Background(), clientset, "default", "web-1", "debugger-1")
+	if err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Fatalf("expected image pull error, got %v", err)
+	}
+}
+
+func TestDebugContainerRunsAsExecUser(t *testing.T) {
+	d := &debugconn{kubesshdconn: newKubesshdconn(nil, "default", "web-1", "app"), image: "busybox"}
+
+	c, err := d.ephemeralContainer(bridge.ExecConfig{Cmd: []string{"/bin/sh"}, User: "1000:50", WorkingDir: "/srv"})
+	if err != nil {
+		t.Fatalf("ephemeralContainer returned error: %v", err)
+	}
+
+	sc := c.SecurityContext
+	if sc == nil || *sc.RunAsUser != 1000 || *sc.RunAsGroup != 50 || c.WorkingDir != "/srv" || c.TargetContainerName != "app" {
+		t.Fatalf("unexpected ephemeral container %#v", c)
+	}
+
+	if c, err := d.ephemeralContainer(bridge.ExecConfig{Cmd: []string{"/bin/sh"}}); err != nil || c.SecurityContext != nil {
+		t.Fatalf("expected image default user, got %#v %v", c.SecurityContext, err)
+	}
+
+	if _, err := d.NewSession().Exec(context.Background(), bridge.ExecConfig{Cmd: []string{"/bin/sh"}, User: "app"}); err == nil {
+		t.Fatal("expected user name to be rejected before the debug container is created")
+	}
+}
+
+func TestDebugContainerPerConnection(t *testing.T) {
+	clientset := fake.NewClientset(&v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "web-1", Namespace: "default"},
+		Spec:       v1.PodSpec{Containers: []v1.Container{{Name: "app"}}},
+	})
+	withEphemeralState(clientset, v1.ContainerState{Running: &v1.ContainerStateRunning{}})
+
+	d := &debugconn{kubesshdconn: newKubesshdconn(nil, "default", "web-1", "app"), clientset: clientset, image: "busybox"}
+
+	first, err := d.debugContainer(context.Background(), bridge.ExecConfig{Cmd: []string{"/bin/sh"}})
+	if err != nil {
+		t.Fatalf("debugContainer returned error: %v", err)
+	}
+
+	second, err := d.debugContainer(context.Background(), bridge.ExecConfig{Cmd: []string{"/bin/sh"}})
+	if err != nil {
+		t.Fatalf("debugContainer returned error: %v", err)
+	}
+
+	pod, err := clientset.CoreV1().Pods("default").Get(context.Background(), "web-1", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if first != second || len(pod.Spec.EphemeralContainers) != 1 {
+		t.Fatalf("expected one debug container for the connection, got %v %v %#v", first, second, pod.Spec.EphemeralContainers)
+	}
+
+	if _, err := d.NewSession().Exec(context.Background(), bridge.ExecConfig{Cmd: []string{"nc", "localhost", "80"}, Forward: true}); err == nil {
+		t.Fatal("expected forward to be rejected")
+	}
+
+	// attaching would silently run the first command instead
+	for _, execconfig := range []bridge.ExecConfig{
+		{Cmd: []string{"top"}},
+		{Cmd: []string{"/bin/sh"}, Env: []string{"DEBUG=1"}},
+		{Cmd: []string{"/bin/sh"}, User: "1000"},
+	} {
+		if _, err := d.debugContainer(context.Background(), execconfig); err == nil {
+			t.Fatalf("expected %#v to be rejected by the debug container of %v", execconfig, first)
+		}
+	}
+}
+
+func TestDebugContainerNameIsUnique(t *testing.T) {
+	var existing []v1.EphemeralContainer
+	for i := range 100000 - 1 {
+		existing = append(existing, v1.EphemeralContainer{EphemeralContainerCommon: v1.EphemeralContainerCommon{Name: fmt.Sprintf("debugger-%05d", i+1)}})
+	}
+
+	// only debugger-00000 is free
+	if name := debugContainerName(existing); name != "debugger-00000" {
+		t.Fatalf("expected the free name, got %v", name)
+	}
+}
@@ -3,6 +3,8 @@ package kubesshd
 import (
 	"context"
 	"fmt"
+	"net/url"
+	"strings"
 
 	"github.com/tg123/docker-sshd/pkg/bridge"
 	v1 "k8s.io/api/core/v1"
@@ -15,32 +17,90 @@ import (
 
 var _ bridge.SessionProvider = (*kubesshdconn)(nil)
 
+// UserWrapper is prepended to commands run as another user since pods/exec has no user field, {user} is replaced
+var UserWrapper = []string{"setpriv", "--reuid={user}", "--regid={user}", "--init-groups", "--"}
+
+// wrapCommand runs cmd as user in workingDir, using UserWrapper and a shell for cd
+func wrapCommand(cmd []string, user, workingDir string) []string {
+	if workingDir != "" {
+		cmd = append([]string{"/bin/sh", "-c", `cd "$0" && exec "$@"`, workingDir}, cmd...)
+	}
+
+	if user != "" {
+		wrapped := make([]string, 0, len(UserWrapper)+len(cmd))
+		for _, arg := range UserWrapper {
+			wrapped = append(wrapped, strings.ReplaceAll(arg, "{user}", user))
+		}
+		cmd = append(wrapped, cmd...)
+	}
+
+	return cmd
+}
+
 type kubesshdconn struct {
 	config    *restclient.Config
 	namespace string
 	pod       string
 	container string
 
-	cancel      context.CancelFunc
-	resizeQueue chan *remotecommand.TerminalSize
+	// closed is cancelled by Close, it ends running streams
+	closed context.Context
+	cancel context.CancelFunc
 }
 
-func (k *kubesshdconn) Close() error {
-	if k.cancel != nil {
-		k.cancel()
+func newKubesshdconn(config *restclient.Config, namespace, pod, container string) *kubesshdconn {
+	closed, cancel := context.WithCancel(context.Background())
+
+	return &kubesshdconn{
+		config:    config,
+		pod:       pod,
+		namespace: namespace,
+		container: container,
+		closed:    closed,
+		cancel:    cancel,
 	}
+}
+
+func (k *kubesshdconn) Close() error {
+	k.cancel()
 	return nil
 }
 
-func (k *kubesshdconn) Next() *remotecommand.TerminalSize {
-	size, ok := <-k.resizeQueue
-	if !ok {
+// Target is the namespace/pod the provider was created for
+func (k *kubesshdconn) Target() string {
+	return k.namespace + "/" + k.pod
+}
+
+func (k *kubesshdconn) NewSession() bridge.Session {
+	return k.newSession()
+}
+
+func (k *kubesshdconn) newSession() *kubesession {
+	return &kubesession{
+		kubesshdconn: k,
+		resizeQueue:  make(chan *remotecommand.TerminalSize, 1),
+	}
+}
+
+// kubesession is one exec or attach stream, each session channel has its own
+type kubesession struct {
+	*kubesshdconn
+
+	resizeQueue chan *remotecommand.TerminalSize
+	done        <-chan struct{}
+}
+
+// Next is the TerminalSizeQueue of the stream, it ends with the stream
+func (k *kubesession) Next() *remotecommand.TerminalSize {
+	select {
+	case size := <-k.resizeQueue:
+		return size
+	case <-k.done:
 		return nil
 	}
-	return size
 }
 
-func (k *kubesshdconn) Exec(ctx context.Context, execconfig bridge.ExecConfig) (<-chan bridge.ExecResult, error) {
+func (k *kubesession) Exec(ctx context.Context, execconfig bridge.ExecConfig) (<-chan bridge.ExecResult, error) {
 	corev1client, err := corev1.NewForConfig(k.config)
 	if err != nil {
 		return nil, err
@@ -50,30 +110,39 @@ func (k *kubesshdconn) Exec(ctx context.Context, execconfig bridge.ExecConfig) (
 		Resource("pods").
 		Name(k.pod).
 		Namespace(k.namespace).
-		SubResource("exec")
-
-	executor, err := remotecommand.NewSPDYExecutor(k.config, "POST", req.VersionedParams(
-		&v1.PodExecOptions{
-			Container: k.container,
-			Command:   execconfig.Cmd,
-			Stdin:     true,
-			Stdout:    true,
-			Stderr:    true,
-			TTY:       execconfig.Tty,
-		},
-		scheme.ParameterCodec,
-	).URL())
+		SubResource("exec").
+		VersionedParams(
+			&v1.PodExecOptions{
+				Container: k.container,
+				Command:   wrapCommand(execconfig.CmdWithTerminalModes(), execconfig.User, execconfig.WorkingDir),
+				Stdin:     true,
+				Stdout:    true,
+				Stderr:    true,
+				TTY:       execconfig.Tty,
+			},
+			scheme.ParameterCodec,
+		)
+
+	return k.stream(ctx, req.URL(), execconfig)
+}
+
+// stream runs the exec or attach request at url
+func (k *kubesession) stream(ctx context.Context, url *url.URL, execconfig bridge.ExecConfig) (<-chan bridge.ExecResult, error) {
+	executor, err := remotecommand.NewSPDYExecutor(k.config, "POST", url)
 	if err != nil {
 		return nil, err
 	}
 
-	r := make(chan bridge.ExecResult)
+	// the stream ends with the channel or the provider
+	ctx, cancel := context.WithCancel(ctx)
+	stop := context.AfterFunc(k.closed, cancel)
+	k.done = ctx.Done()
 
-	go func() {
-		defer k.Close()
+	r := make(chan bridge.ExecResult, 1)
 
-		ctx, cancel := context.WithCancel(ctx)
-		k.cancel = cancel
+	go func() {
+		defer stop()
+		defer cancel()
 
 		err := executor.StreamWithContext(ctx, remotecommand.StreamOptions{
 			Stdin:             execconfig.Input,
@@ -98,7 +167,7 @@ func (k *kubesshdconn) Exec(ctx context.Context, execconfig bridge.ExecConfig) (
 	return r, nil
 }
 
-func (k *kubesshdconn) Resize(ctx context.Context, size bridge.ResizeOptions) error {
+func (k *kubesession) Resize(ctx context.Context, size bridge.ResizeOptions) error {
 	select {
 	case k.resizeQueue <- &remotecommand.TerminalSize{
 		Height: uint16(size.Height),
@@ -111,14 +180,17 @@ func (k *kubesshdconn) Resize(ctx context.Context, size bridge.ResizeOptions) er
 	return fmt.Errorf("resize failed")
 }
 
-func New(config *restclient.Config, namespace, pod, container string) (bridge.SessionProvider, error) {
+// Impersonate returns a copy of config acting as user and groups, the api server then applies their rbac
+func Impersonate(config *restclient.Config, user string, groups []string) *restclient.Config {
+	c := restclient.CopyConfig(config)
+	c.Impersonate = restclient.ImpersonationConfig{
+		UserName: user,
+		Groups:   groups,
+	}
 
-	return &kubesshdconn{
-		config:      config,
-		resizeQueue: make(chan *remotecommand.TerminalSize, 1),
-		pod:         pod,
-		namespace:   namespace,
-		container:   container,
-	}, nil
+	return c
+}
 
+func New(config *restclient.Config, namespace, pod, container string) (bridge.SessionProvider, error) {
+	return newKubesshdconn(config, namespace, pod, container), nil
 }
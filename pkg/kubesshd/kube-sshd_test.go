@@ -0,0 +1,25 @@
+package kubesshd
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestWrapCommand(t *testing.T) {
+	tests := []struct {
+		user       string
+		workingDir string
+		want       []string
+	}{
+		{"", "", []string{"ls", "-l"}},
+		{"app", "", []string{"setpriv", "--reuid=app", "--regid=app", "--init-groups", "--", "ls", "-l"}},
+		{"", "/srv", []string{"/bin/sh", "-c", `cd "$0" && exec "$@"`, "/srv", "ls", "-l"}},
+		{"app", "/srv", []string{"setpriv", "--reuid=app", "--regid=app", "--init-groups", "--", "/bin/sh", "-c", `cd "$0" && exec "$@"`, "/srv", "ls", "-l"}},
+	}
+
+	for _, tt := range tests {
+		if got := wrapCommand([]string{"ls", "-l"}, tt.user, tt.workingDir); !reflect.DeepEqual(got, tt.want) {
+			t.Fatalf("wrapCommand(%q, %q) = %q, expected %q", tt.user, tt.workingDir, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,350 @@
+package kubesshd
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Target is a parsed ssh username
+type Target struct {
+	Namespace string
+
+	// Kind is the workload kind, empty for a pod name or a label selector
+	Kind string
+	Name string
+
+	// Selector is a label selector such as app=foo
+	Selector string
+
+	Container string
+}
+
+const (
+	KindPod         = "pod"
+	KindDeployment  = "deployment"
+	KindStatefulSet = "statefulset"
+	KindDaemonSet   = "daemonset"
+	KindJob         = "job"
+	KindService     = "service"
+)
+
+var kindAliases = map[string]string{
+	"po":          KindPod,
+	"pod":         KindPod,
+	"pods":        KindPod,
+	"deploy":      KindDeployment,
+	"deployment":  KindDeployment,
+	"deployments": KindDeployment,
+	"sts":         KindStatefulSet,
+	"statefulset": KindStatefulSet,
+	"ds":          KindDaemonSet,
+	"daemonset":   KindDaemonSet,
+	"job":         KindJob,
+	"jobs":        KindJob,
+	"svc":         KindService,
+	"service":     KindService,
+}
+
+// ParseTarget parses the ssh username, supported forms are
+//
+//	pod, pod/container, namespace/pod/container
+//	kind/name[/container], namespace/kind/name[/container], kind is one of deploy, sts, ds, job, svc, pod
+//	app=foo[,tier=web], in place of pod in any form above
+func ParseTarget(user, defaultNamespace string) Target {
+	parts := strings.Split(user, "/")
+	t := Target{Namespace: defaultNamespace}
+
+	kindAt := -1
+	for i := 0; i < len(parts)-1 && i < 2; i++ {
+		if _, ok := kindAliases[parts[i]]; ok {
+			kindAt = i
+			break
+		}
+	}
+
+	switch {
+	case kindAt == 0 && len(parts) <= 3:
+		t.Kind = kindAliases[parts[0]]
+		t.Name = parts[1]
+		if len(parts) == 3 {
+			t.Container = parts[2]
+		}
+	case kindAt == 1 && len(parts) >= 3 && len(parts) <= 4:
+		t.Namespace = parts[0]
+		t.Kind = kindAliases[parts[1]]
+		t.Name = parts[2]
+		if len(parts) == 4 {
+			t.Container = parts[3]
+		}
+	default:
+		switch len(parts) {
+		case 2: // Format: pod/container
+			t.Name = parts[0]
+			t.Container = parts[1]
+		case 3: // Format: namespace/pod/container
+			t.Namespace = parts[0]
+			t.Name = parts[1]
+			t.Container = parts[2]
+		default:
+			t.Name = user
+		}
+	}
+
+	if t.Kind == KindPod {
+		t.Kind = ""
+	}
+
+	if t.Kind == "" && strings.Contains(t.Name, "=") {
+		t.Selector = t.Name
+		t.Name = ""
+	}
+
+	return t
+}
+
+// PickStrategy chooses one pod among the ready pods of a workload
+type PickStrategy string
+
+const (
+	PickFirst  PickStrategy = "first"
+	PickRandom PickStrategy = "random"
+	PickNewest PickStrategy = "newest"
+)
+
+func ParsePickStrategy(s string) (PickStrategy, error) {
+	switch p := PickStrategy(s); p {
+	case PickFirst, PickRandom, PickNewest:
+		return p, nil
+	}
+
+	return "", fmt.Errorf("unknown pick strategy %v, expected first, random or newest", s)
+}
+
+// DefaultContainerAnnotation is honored by kubectl exec when no container is given
+const DefaultContainerAnnotation = "kubectl.kubernetes.io/default-container"
+
+// DefaultSidecars are container names skipped when picking the default container
+var DefaultSidecars = []string{
+	"istio-proxy",
+	"istio-init",
+	"linkerd-proxy",
+	"envoy",
+	"envoy-sidecar",
+	"vault-agent",
+	"cloud-sql-proxy",
+	"cloudsql-proxy",
+	"oauth2-proxy",
+	"fluent-bit",
+	"fluentd",
+	"datadog-agent",
+}
+
+// Resolver finds the pod for a target through the core and apps apis
+type Resolver struct {
+	Clientset kubernetes.Interface
+	Strategy  PickStrategy
+
+	// Sidecars overrides DefaultSidecars
+	Sidecars []string
+}
+
+var statefulSetPod = regexp.MustCompile(`^(.+)-(\d+)$`)
+
+// Resolve returns the pod name of t
+func (r *Resolver) Resolve(ctx context.Context, t Target) (string, error) {
+	if t.Kind == "" && t.Selector == "" {
+		return t.Name, nil
+	}
+
+	selector, err := r.selector(ctx, t)
+	if err != nil {
+		return "", err
+	}
+
+	// sts/name-0 addresses one replica of a statefulset
+	if selector == nil {
+		return t.Name, nil
+	}
+
+	pods, err := r.Clientset.CoreV1().Pods(t.Namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: selector.String(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	ready := make([]v1.Pod, 0, len(pods.Items))
+	for _, pod := range pods.Items {
+		if isPodReady(&pod) {
+			ready = append(ready, pod)
+		}
+	}
+
+	if len(ready) == 0 {
+		return "", fmt.Errorf("no ready pod for %v in namespace %v (%v pods match %v)", t.describe(), t.Namespace, len(pods.Items), selector)
+	}
+
+	return r.pick(ready).Name, nil
+}
+
+// Container returns container if not empty, otherwise the default container of pod
+// it follows the default-container annotation, then the only container which is not a sidecar
+func (r *Resolver) Container(ctx context.Context, namespace, pod, container string) (string, error) {
+	if container != "" {
+		return container, nil
+	}
+
+	p, err := r.Clientset.CoreV1().Pods(namespace).Get(ctx, pod, metav1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+
+	names := make([]string, 0, len(p.Spec.Containers))
+	for _, c := range p.Spec.Containers {
+		names = append(names, c.Name)
+	}
+
+	if name, ok := p.Annotations[DefaultContainerAnnotation]; ok {
+		if slices.Contains(names, name) {
+			return name, nil
+		}
+
+		log.Warnf("pod %v/%v default container %v does not exist", namespace, pod, name)
+	}
+
+	if len(names) == 1 {
+		return names[0], nil
+	}
+
+	sidecars := r.Sidecars
+	if sidecars == nil {
+		sidecars = DefaultSidecars
+	}
+
+	var candidates []string
+	for _, name := range names {
+		if !slices.Contains(sidecars, name) {
+			candidates = append(candidates, name)
+		}
+	}
+
+	if len(candidates) == 1 {
+		return candidates[0], nil
+	}
+
+	return "", fmt.Errorf("pod %v has %v containers, choose one with %v/<container>: %v", pod, len(names), pod, strings.Join(names, ", "))
+}
+
+func (r *Resolver) selector(ctx context.Context, t Target) (labels.Selector, error) {
+	if t.Selector != "" {
+		return labels.Parse(t.Selector)
+	}
+
+	var ls *metav1.LabelSelector
+
+	switch t.Kind {
+	case KindDeployment:
+		d, err := r.Clientset.AppsV1().Deployments(t.Namespace).Get(ctx, t.Name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		ls = d.Spec.Selector
+	case KindStatefulSet:
+		s, err := r.Clientset.AppsV1().StatefulSets(t.Namespace).Get(ctx, t.Name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			if m := statefulSetPod.FindStringSubmatch(t.Name); m != nil {
+				if _, err := r.Clientset.AppsV1().StatefulSets(t.Namespace).Get(ctx, m[1], metav1.GetOptions{}); err == nil {
+					return nil, nil
+				}
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		ls = s.Spec.Selector
+	case KindDaemonSet:
+		d, err := r.Clientset.AppsV1().DaemonSets(t.Namespace).Get(ctx, t.Name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		ls = d.Spec.Selector
+	case KindJob:
+		j, err := r.Clientset.BatchV1().Jobs(t.Namespace).Get(ctx, t.Name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		ls = j.Spec.Selector
+	case KindService:
+		s, err := r.Clientset.CoreV1().Services(t.Namespace).Get(ctx, t.Name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		if len(s.Spec.Selector) == 0 {
+			return nil, fmt.Errorf("service %v has no selector", t.Name)
+		}
+		return labels.SelectorFromSet(s.Spec.Selector), nil
+	default:
+		return nil, fmt.Errorf("unsupported kind %v", t.Kind)
+	}
+
+	if ls == nil {
+		return nil, fmt.Errorf("%v has no selector", t.describe())
+	}
+
+	return metav1.LabelSelectorAsSelector(ls)
+}
+
+func (r *Resolver) pick(pods []v1.Pod) v1.Pod {
+	switch r.Strategy {
+	case PickRandom:
+		return pods[rand.IntN(len(pods))]
+	case PickNewest:
+		sort.Slice(pods, func(i, j int) bool {
+			return pods[j].CreationTimestamp.Before(&pods[i].CreationTimestamp)
+		})
+	default:
+		sort.Slice(pods, func(i, j int) bool {
+			return pods[i].Name < pods[j].Name
+		})
+	}
+
+	return pods[0]
+}
+
+func (t Target) describe() string {
+	if t.Selector != "" {
+		return t.Selector
+	}
+
+	if t.Kind == "" {
+		return t.Name
+	}
+
+	return t.Kind + "/" + t.Name
+}
+
+func isPodReady(pod *v1.Pod) bool {
+	if pod.DeletionTimestamp != nil || pod.Status.Phase != v1.PodRunning {
+		return false
+	}
+
+	for _, c := range pod.Status.Conditions {
+		if c.Type == v1.PodReady {
+			return c.Status == v1.ConditionTrue
+		}
+	}
+
+	return false
+}
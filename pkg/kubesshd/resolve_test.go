@@ -0,0 +1,161 @@
+package kubesshd
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestParseTarget(t *testing.T) {
+	tests := []struct {
+		user string
+		want Target
+	}{
+		{"web-1", Target{Namespace: "default", Name: "web-1"}},
+		{"web-1/nginx", Target{Namespace: "default", Name: "web-1", Container: "nginx"}},
+		{"prod/web-1/nginx", Target{Namespace: "prod", Name: "web-1", Container: "nginx"}},
+		{"deploy/web", Target{Namespace: "default", Kind: KindDeployment, Name: "web"}},
+		{"sts/db-0/postgres", Target{Namespace: "default", Kind: KindStatefulSet, Name: "db-0", Container: "postgres"}},
+		{"prod/svc/web", Target{Namespace: "prod", Kind: KindService, Name: "web"}},
+		{"prod/ds/agent/log", Target{Namespace: "prod", Kind: KindDaemonSet, Name: "agent", Container: "log"}},
+		{"pod/web-1", Target{Namespace: "default", Name: "web-1"}},
+		{"app=web", Target{Namespace: "default", Selector: "app=web"}},
+		{"prod/app=web,tier=fe/nginx", Target{Namespace: "prod", Selector: "app=web,tier=fe", Container: "nginx"}},
+	}
+
+	for _, tt := range tests {
+		if got := ParseTarget(tt.user, "default"); got != tt.want {
+			t.Fatalf("ParseTarget(%v) = %#v, expected %#v", tt.user, got, tt.want)
+		}
+	}
+}
+
+func newPod(name string, labels map[string]string, ready bool, created time.Time) *v1.Pod {
+	status := v1.ConditionFalse
+	if ready {
+		status = v1.ConditionTrue
+	}
+
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              name,
+			Namespace:         "default",
+			Labels:            labels,
+			CreationTimestamp: metav1.NewTime(created),
+		},
+		Status: v1.PodStatus{
+			Phase:      v1.PodRunning,
+			Conditions: []v1.PodCondition{{Type: v1.PodReady, Status: status}},
+		},
+	}
+}
+
+func TestResolverWorkloads(t *testing.T) {
+	now := time.Now()
+	web := map[string]string{"app": "web"}
+
+	clientset := fake.NewClientset(
+		&appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+			Spec:       appsv1.DeploymentSpec{Selector: &metav1.LabelSelector{MatchLabels: web}},
+		},
+		&appsv1.StatefulSet{
+			ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "default"},
+			Spec:       appsv1.StatefulSetSpec{Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "db"}}},
+		},
+		&v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+			Spec:       v1.ServiceSpec{Selector: web},
+		},
+		newPod("web-a", web, true, now.Add(-time.Hour)),
+		newPod("web-b", web, true, now),
+		newPod("web-0", web, false, now.Add(time.Hour)),
+		newPod("db-0", map[string]string{"app": "db"}, true, now),
+	)
+
+	tests := []struct {
+		user     string
+		strategy PickStrategy
+		pod      string
+	}{
+		{"web-x", PickFirst, "web-x"},
+		{"deploy/web", PickFirst, "web-a"},
+		{"deploy/web", PickNewest, "web-b"},
+		{"svc/web", PickFirst, "web-a"},
+		{"app=web", PickNewest, "web-b"},
+		{"sts/db", PickFirst, "db-0"},
+		{"sts/db-0", PickFirst, "db-0"},
+	}
+
+	for _, tt := range tests {
+		r := &Resolver{Clientset: clientset, Strategy: tt.strategy}
+
+		pod, err := r.Resolve(context.Background(), ParseTarget(tt.user, "default"))
+		if err != nil {
+			t.Fatalf("Resolve(%v) returned error: %v", tt.user, err)
+		}
+
+		if pod != tt.pod {
+			t.Fatalf("Resolve(%v) with %v = %v, expected %v", tt.user, tt.strategy, pod, tt.pod)
+		}
+	}
+
+	r := &Resolver{Clientset: clientset, Strategy: PickFirst}
+	if _, err := r.Resolve(context.Background(), ParseTarget("deploy/missing", "default")); err == nil {
+		t.Fatal("expected error for missing deployment")
+	}
+
+	if _, err := r.Resolve(context.Background(), ParseTarget("app=none", "default")); err == nil {
+		t.Fatal("expected error when no pod is ready")
+	}
+}
+
+func TestResolverContainer(t *testing.T) {
+	pod := func(name string, annotations map[string]string, containers ...string) *v1.Pod {
+		p := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Annotations: annotations}}
+		for _, c := range containers {
+			p.Spec.Containers = append(p.Spec.Containers, v1.Container{Name: c})
+		}
+		return p
+	}
+
+	r := &Resolver{Clientset: fake.NewClientset(
+		pod("single", nil, "app"),
+		pod("annotated", map[string]string{DefaultContainerAnnotation: "worker"}, "app", "worker"),
+		pod("meshed", nil, "istio-proxy", "app"),
+		pod("multi", nil, "app", "worker"),
+	)}
+
+	tests := []struct {
+		pod       string
+		container string
+		want      string
+	}{
+		{"multi", "worker", "worker"},
+		{"single", "", "app"},
+		{"annotated", "", "worker"},
+		{"meshed", "", "app"},
+	}
+
+	for _, tt := range tests {
+		got, err := r.Container(context.Background(), "default", tt.pod, tt.container)
+		if err != nil {
+			t.Fatalf("Container(%v) returned error: %v", tt.pod, err)
+		}
+
+		if got != tt.want {
+			t.Fatalf("Container(%v) = %v, expected %v", tt.pod, got, tt.want)
+		}
+	}
+
+	_, err := r.Container(context.Background(), "default", "multi", "")
+	if err == nil || !strings.Contains(err.Error(), "app, worker") {
+		t.Fatalf("expected ambiguous error listing containers, got %v", err)
+	}
+}
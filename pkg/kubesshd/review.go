@@ -0,0 +1,117 @@
+package kubesshd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/tg123/docker-sshd/pkg/bridge"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	SubresourceExec        = "exec"
+	SubresourcePortForward = "portforward"
+	SubresourceAttach      = "attach"
+
+	// SubresourceEphemeralContainers is updated to add debug containers
+	SubresourceEphemeralContainers = "ephemeralcontainers"
+)
+
+// AccessReviewer asks the api server with SubjectAccessReview whether a user may create pods/<subresource>
+type AccessReviewer struct {
+	Clientset kubernetes.Interface
+}
+
+// reviewVerb is the verb of a subresource, ephemeral containers are added by updating the pod
+func reviewVerb(subresource string) string {
+	if subresource == SubresourceEphemeralContainers {
+		return "update"
+	}
+
+	return "create"
+}
+
+// Review returns an error unless user or one of groups may create pods/subresource on namespace/pod,
+// update for pods/ephemeralcontainers
+func (a *AccessReviewer) Review(ctx context.Context, user string, groups []string, namespace, pod, subresource string) error {
+	verb := reviewVerb(subresource)
+
+	review, err := a.Clientset.AuthorizationV1().SubjectAccessReviews().Create(ctx, &authorizationv1.SubjectAccessReview{
+		Spec: authorizationv1.SubjectAccessReviewSpec{
+			User:   user,
+			Groups: groups,
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Namespace:   namespace,
+				Verb:        verb,
+				Resource:    "pods",
+				Subresource: subresource,
+				Name:        pod,
+			},
+		},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return fmt.Errorf("access review failed: %w", err)
+	}
+
+	if !review.Status.Allowed {
+		reason := review.Status.Reason
+		if reason == "" {
+			reason = "denied by rbac"
+		}
+
+		return fmt.Errorf("%v is not allowed to %v pods/%v on %v/%v: %v", user, verb, subresource, namespace, pod, reason)
+	}
+
+	return nil
+}
+
+// WithReview checks pods/portforward with review before an exec or dial which forwards a direct-tcpip channel
+func WithReview(provider bridge.SessionProvider, review func(ctx context.Context, subresource string) error) bridge.SessionProvider {
+	return &reviewedProvider{SessionProvider: provider, review: review}
+}
+
+type reviewedProvider struct {
+	bridge.SessionProvider
+	review func(ctx context.Context, subresource string) error
+}
+
+// Target is the target of the wrapped provider
+func (r *reviewedProvider) Target() string {
+	return bridge.TargetOf(r.SessionProvider)
+}
+
+// Dial uses the Dialer of the wrapped provider once pods/portforward is allowed
+func (r *reviewedProvider) Dial(ctx context.Context, network, address string) (net.Conn, error) {
+	if _, ok := r.SessionProvider.(bridge.Dialer); !ok {
+		return nil, errors.ErrUnsupported
+	}
+
+	if err := r.review(ctx, SubresourcePortForward); err != nil {
+		return nil, err
+	}
+
+	return bridge.DialProvider(ctx, r.SessionProvider, network, address)
+}
+
+func (r *reviewedProvider) NewSession() bridge.Session {
+	return &reviewedSession{Session: r.SessionProvider.NewSession(), review: r.review}
+}
+
+type reviewedSession struct {
+	bridge.Session
+	review func(ctx context.Context, subresource string) error
+}
+
+func (r *reviewedSession) Exec(ctx context.Context, execconfig bridge.ExecConfig) (<-chan bridge.ExecResult, error) {
+	if execconfig.Forward {
+		if err := r.review(ctx, SubresourcePortForward); err != nil {
+			return nil, err
+		}
+	}
+
+	return r.Session.Exec(ctx, execconfig)
+}
@@ -0,0 +1,146 @@
+package kubesshd
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/tg123/docker-sshd/pkg/bridge"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// newReviewClientset allows alice to exec into default/web-1 and bob to also port forward and debug
+func newReviewClientset() *fake.Clientset {
+	clientset := fake.NewClientset()
+	clientset.PrependReactor("create", "subjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SubjectAccessReview)
+		attrs := review.Spec.ResourceAttributes
+
+		verb := "create"
+		if attrs.Subresource == SubresourceEphemeralContainers {
+			verb = "update"
+		}
+
+		allowed := attrs.Namespace == "default" && attrs.Name == "web-1" && attrs.Verb == verb && attrs.Resource == "pods"
+		switch review.Spec.User {
+		case "alice":
+			allowed = allowed && attrs.Subresource == SubresourceExec
+		case "bob":
+		default:
+			allowed = false
+		}
+
+		review.Status.Allowed = allowed
+		return true, review, nil
+	})
+
+	return clientset
+}
+
+func TestAccessReviewer(t *testing.T) {
+	r := &AccessReviewer{Clientset: newReviewClientset()}
+
+	tests := []struct {
+		user        string
+		pod         string
+		subresource string
+		allowed     bool
+	}{
+		{"alice", "web-1", SubresourceExec, true},
+		{"alice", "web-1", SubresourcePortForward, false},
+		{"alice", "db-0", SubresourceExec, false},
+		{"bob", "web-1", SubresourcePortForward, true},
+		{"alice", "web-1", SubresourceEphemeralContainers, false},
+		{"bob", "web-1", SubresourceEphemeralContainers, true},
+		{"eve", "web-1", SubresourceExec, false},
+	}
+
+	for _, tt := range tests {
+		err := r.Review(context.Background(), tt.user, nil, "default", tt.pod, tt.subresource)
+		if (err == nil) != tt.allowed {
+			t.Fatalf("Review(%v, %v, %v) = %v, expected allowed %v", tt.user, tt.pod, tt.subresource, err, tt.allowed)
+		}
+	}
+}
+
+type fakeExecProvider struct {
+	bridge.SessionProvider
+	bridge.Session
+	execs int
+}
+
+func (f *fakeExecProvider) NewSession() bridge.Session {
+	return f
+}
+
+func (f *fakeExecProvider) Exec(ctx context.Context, execconfig bridge.ExecConfig) (<-chan bridge.ExecResult, error) {
+	f.execs++
+	return make(chan bridge.ExecResult), nil
+}
+
+func TestWithReviewChecksForward(t *testing.T) {
+	r := &AccessReviewer{Clientset: newReviewClientset()}
+	inner := &fakeExecProvider{}
+
+	p := WithReview(inner, func(ctx context.Context, subresource string) error {
+		return r.Review(ctx, "alice", nil, "default", "web-1", subresource)
+	})
+
+	if _, err := p.NewSession().Exec(context.Background(), bridge.ExecConfig{Cmd: []string{"/bin/sh"}}); err != nil {
+		t.Fatalf("expected exec to be allowed, got %v", err)
+	}
+
+	if _, err := p.NewSession().Exec(context.Background(), bridge.ExecConfig{Cmd: []string{"nc", "localhost", "80"}, Forward: true}); err == nil {
+		t.Fatal("expected forward to be denied")
+	}
+
+	if inner.execs != 1 {
+		t.Fatalf("expected only the allowed exec to reach the provider, got %v", inner.execs)
+	}
+}
+
+type fakeDialProvider struct {
+	fakeExecProvider
+	dials int
+}
+
+func (f *fakeDialProvider) Dial(ctx context.Context, network, address string) (net.Conn, error) {
+	f.dials++
+	client, server := net.Pipe()
+	_ = server.Close()
+	return client, nil
+}
+
+func TestWithReviewChecksDial(t *testing.T) {
+	r := &AccessReviewer{Clientset: newReviewClientset()}
+
+	for user, allowed := range map[string]bool{"alice": false, "bob": true} {
+		inner := &fakeDialProvider{}
+		p := WithReview(inner, func(ctx context.Context, subresource string) error {
+			return r.Review(ctx, user, nil, "default", "web-1", subresource)
+		})
+
+		conn, err := bridge.DialProvider(context.Background(), p, "tcp", "localhost:80")
+		if (err == nil) != allowed || (inner.dials == 1) != allowed {
+			t.Fatalf("%v: expected dial allowed %v, got %v after %v dials", user, allowed, err, inner.dials)
+		}
+
+		if conn != nil {
+			_ = conn.Close()
+		}
+	}
+
+	// without a Dialer the bridge falls back to an exec, which is reviewed on its own
+	p := WithReview(&fakeExecProvider{}, func(ctx context.Context, subresource string) error {
+		t.Fatalf("unexpected review of %v", subresource)
+		return nil
+	})
+
+	if _, err := bridge.DialProvider(context.Background(), p, "tcp", "localhost:80"); !errors.Is(err, errors.ErrUnsupported) {
+		t.Fatalf("expected ErrUnsupported, got %v", err)
+	}
+}
@@ -0,0 +1,43 @@
+package kubesshd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/tg123/docker-sshd/pkg/bridge"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// ListTargets lists running pods in namespace for the picker
+func ListTargets(ctx context.Context, clientset kubernetes.Interface, namespace string) ([]bridge.Target, error) {
+	pods, err := clientset.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{
+		FieldSelector: "status.phase=" + string(v1.PodRunning),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	targets := make([]bridge.Target, 0, len(pods.Items))
+	for _, pod := range pods.Items {
+		containers := make([]string, 0, len(pod.Spec.Containers))
+		for _, c := range pod.Spec.Containers {
+			containers = append(containers, c.Name)
+		}
+
+		targets = append(targets, bridge.Target{
+			Name:        pod.Name,
+			Description: fmt.Sprintf("[%v] on %v", strings.Join(containers, ","), pod.Spec.NodeName),
+		})
+	}
+
+	return targets, nil
+}
+
+// Exists reports whether pod can be found in namespace
+func Exists(ctx context.Context, clientset kubernetes.Interface, namespace, pod string) bool {
+	_, err := clientset.CoreV1().Pods(namespace).Get(ctx, pod, metav1.GetOptions{})
+	return err == nil
+}
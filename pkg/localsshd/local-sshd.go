@@ -0,0 +1,271 @@
+package localsshd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/creack/pty"
+	log "github.com/sirupsen/logrus"
+	"github.com/tg123/docker-sshd/pkg/bridge"
+)
+
+var _ bridge.SessionProvider = (*localsshdconn)(nil)
+var _ bridge.Session = (*localsession)(nil)
+
+// DrainTimeout bounds reading the remaining pty output after the command exits,
+// background processes may keep the pty open
+var DrainTimeout = time.Second
+
+type localsshdconn struct {
+	// closed is cancelled by Close, running commands are killed
+	closed context.Context
+	cancel context.CancelFunc
+}
+
+func (l *localsshdconn) NewSession() bridge.Session {
+	return &localsession{localsshdconn: l}
+}
+
+// localsession is one command, each session channel has its own pty
+type localsession struct {
+	*localsshdconn
+
+	mu       sync.Mutex
+	pty      *os.File
+	initSize bridge.ResizeOptions
+}
+
+// baseEnv is the environment of commands before the session env, the environment of the bridge is not inherited
+func baseEnv() []string {
+	env := []string{"PATH=" + os.Getenv("PATH")}
+
+	for _, k := range []string{"HOME", "USER", "LOGNAME", "SHELL", "LANG"} {
+		if v, ok := os.LookupEnv(k); ok {
+			env = append(env, k+"="+v)
+		}
+	}
+
+	return env
+}
+
+func (l *localsession) Exec(ctx context.Context, execconfig bridge.ExecConfig) (<-chan bridge.ExecResult, error) {
+	if len(execconfig.Cmd) == 0 {
+		return nil, fmt.Errorf("no command to run")
+	}
+
+	args := execconfig.Cmd
+	if execconfig.Tty {
+		// the host has sh and stty, unlike containers the prelude also applies to exec requests
+		args = bridge.WithTerminalModes(args, execconfig.Modes)
+	}
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Env = baseEnv()
+	cmd.Dir = execconfig.WorkingDir
+
+	if execconfig.User != "" {
+		env, err := runAs(cmd, execconfig.User)
+		if err != nil {
+			return nil, err
+		}
+
+		cmd.Env = append(cmd.Env, env...)
+	}
+
+	// later entries win, the session env overrides the defaults
+	cmd.Env = append(cmd.Env, execconfig.Env...)
+
+	var (
+		output <-chan struct{}
+		err    error
+	)
+
+	if execconfig.Tty {
+		output, err = l.startPty(cmd, execconfig)
+	} else {
+		output, err = l.startPipes(cmd, execconfig)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debugf("local exec [%v] started pid %v", execconfig.Cmd, cmd.Process.Pid)
+
+	r := make(chan bridge.ExecResult, 1)
+
+	go func() {
+		kill := func() { _ = cmd.Process.Kill() }
+
+		stop := context.AfterFunc(ctx, kill)
+		defer stop()
+
+		stopClosed := context.AfterFunc(l.closed, kill)
+		defer stopClosed()
+
+		err := cmd.Wait()
+
+		select {
+		case <-output:
+		case <-time.After(DrainTimeout):
+			log.Warnf("output of local exec [%v] still open after exit", execconfig.Cmd)
+		}
+
+		l.mu.Lock()
+		if l.pty != nil {
+			_ = l.pty.Close()
+		}
+		l.mu.Unlock()
+
+		result := bridge.ExecResult{Error: err}
+
+		var exitErr *exec.ExitError
+		switch {
+		case err == nil:
+		case errors.As(err, &exitErr):
+			result.ExitCode = exitErr.ExitCode()
+
+			if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+				result.Signal = signalName(status.Signal())
+				result.ExitCode = 128 + int(status.Signal())
+			}
+		default:
+			result.ExitCode = -1
+		}
+
+		log.Debugf("local exec [%v] done exit code %v signal [%v]", execconfig.Cmd, result.ExitCode, result.Signal)
+
+		r <- result
+	}()
+
+	return r, nil
+}
+
+// startPty starts cmd as session leader of a new pty, output is closed once the pty has no more output
+func (l *localsession) startPty(cmd *exec.Cmd, execconfig bridge.ExecConfig) (<-chan struct{}, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var size *pty.Winsize
+	if l.initSize.Width > 0 && l.initSize.Height > 0 {
+		size = winsize(l.initSize)
+	}
+
+	ptmx, err := pty.StartWithSize(cmd, size)
+	if err != nil {
+		return nil, err
+	}
+
+	l.pty = ptmx
+
+	go func() {
+		_, _ = io.Copy(ptmx, execconfig.Input)
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// reading fails with EIO once the command and its children close the pty
+		_, _ = io.Copy(execconfig.Output, ptmx)
+	}()
+
+	return done, nil
+}
+
+// startPipes starts cmd with stdin and the combined output over pipes
+func (l *localsession) startPipes(cmd *exec.Cmd, execconfig bridge.ExecConfig) (<-chan struct{}, error) {
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	// not StdoutPipe, Wait closes it before the output is read, same pipe for stderr as the session has a single output
+	stdout, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+
+	cmd.Stdout = w
+	cmd.Stderr = w
+
+	err = cmd.Start()
+	_ = w.Close()
+
+	if err != nil {
+		_ = stdout.Close()
+		return nil, err
+	}
+
+	go func() {
+		_, _ = io.Copy(stdin, execconfig.Input)
+		_ = stdin.Close()
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer stdout.Close()
+		_, _ = io.Copy(execconfig.Output, stdout)
+	}()
+
+	return done, nil
+}
+
+// Resize sets the window size of the pty with TIOCSWINSZ, the command receives SIGWINCH
+func (l *localsession) Resize(ctx context.Context, size bridge.ResizeOptions) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.pty == nil {
+		l.initSize = size
+		return nil
+	}
+
+	return pty.Setsize(l.pty, winsize(size))
+}
+
+func winsize(size bridge.ResizeOptions) *pty.Winsize {
+	return &pty.Winsize{
+		Rows: uint16(size.Height),
+		Cols: uint16(size.Width),
+		X:    uint16(size.WidthPixels),
+		Y:    uint16(size.HeightPixels),
+	}
+}
+
+// Target is the hostname of the bridge host, where commands run
+func (l *localsshdconn) Target() string {
+	hostname, _ := os.Hostname()
+	return hostname
+}
+
+// Dial connects from the bridge host
+func (l *localsshdconn) Dial(ctx context.Context, network, address string) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, network, address)
+}
+
+// Close kills the commands which are still running
+func (l *localsshdconn) Close() error {
+	l.cancel()
+	return nil
+}
+
+// New creates a provider which runs commands on the bridge host as the user of the bridge
+// or as ExecConfig.User, which requires root
+func New() (bridge.SessionProvider, error) {
+	closed, cancel := context.WithCancel(context.Background())
+
+	return &localsshdconn{
+		closed: closed,
+		cancel: cancel,
+	}, nil
+}
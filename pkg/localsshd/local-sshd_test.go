@@ -0,0 +1,305 @@
+package localsshd
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/tg123/docker-sshd/pkg/bridge"
+	"golang.org/x/crypto/ssh"
+)
+
+// dialBridge serves a bridge with a local provider per connection and returns a connected client
+func dialBridge(t *testing.T) *ssh.Client {
+	t.Helper()
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate host key: %v", err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatalf("failed to create signer: %v", err)
+	}
+
+	serverConfig := &ssh.ServerConfig{NoClientAuth: true}
+	serverConfig.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	go func() {
+		c, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		b, err := bridge.New(c, serverConfig, &bridge.BridgeConfig{DefaultCmd: "/bin/sh"}, func(*ssh.ServerConn) (bridge.SessionProvider, error) {
+			return New()
+		})
+		if err != nil {
+			t.Errorf("bridge.New returned error: %v", err)
+			return
+		}
+
+		b.Start()
+	}()
+
+	client, err := ssh.Dial("tcp", listener.Addr().String(), &ssh.ClientConfig{
+		User:            "local",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatalf("client handshake failed: %v", err)
+	}
+	t.Cleanup(func() { _ = client.Close() })
+
+	return client
+}
+
+// script writes an executable shell script, the bridge splits commands at spaces
+func script(t *testing.T, body string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "script.sh")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+body+"\n"), 0o755); err != nil {
+		t.Fatalf("write script failed: %v", err)
+	}
+
+	return path
+}
+
+func TestLocalExecOutput(t *testing.T) {
+	session, err := dialBridge(t).NewSession()
+	if err != nil {
+		t.Fatalf("NewSession returned error: %v", err)
+	}
+	defer session.Close()
+
+	session.Stdin = strings.NewReader("hello\n")
+
+	out, err := session.CombinedOutput(script(t, "read line; echo out $line; echo err >&2"))
+	if err != nil {
+		t.Fatalf("exec returned error: %v", err)
+	}
+
+	if string(out) != "out hello\nerr\n" {
+		t.Fatalf("unexpected output %q", out)
+	}
+}
+
+func TestLocalExecExitCode(t *testing.T) {
+	session, err := dialBridge(t).NewSession()
+	if err != nil {
+		t.Fatalf("NewSession returned error: %v", err)
+	}
+	defer session.Close()
+
+	var exitErr *ssh.ExitError
+	if err := session.Run(script(t, "exit 3")); !errors.As(err, &exitErr) {
+		t.Fatalf("expected exit error, got %v", err)
+	}
+
+	if exitErr.ExitStatus() != 3 || exitErr.Signal() != "" {
+		t.Fatalf("expected exit status 3, got %v", exitErr)
+	}
+}
+
+func TestLocalExecSignal(t *testing.T) {
+	session, err := dialBridge(t).NewSession()
+	if err != nil {
+		t.Fatalf("NewSession returned error: %v", err)
+	}
+	defer session.Close()
+
+	var exitErr *ssh.ExitError
+	if err := session.Run(script(t, "kill -TERM $$")); !errors.As(err, &exitErr) {
+		t.Fatalf("expected exit error, got %v", err)
+	}
+
+	if exitErr.Signal() != "TERM" {
+		t.Fatalf("expected TERM signal, got %v", exitErr)
+	}
+}
+
+func TestLocalPtyResize(t *testing.T) {
+	session, err := dialBridge(t).NewSession()
+	if err != nil {
+		t.Fatalf("NewSession returned error: %v", err)
+	}
+	defer session.Close()
+
+	if err := session.RequestPty("xterm", 24, 80, ssh.TerminalModes{}); err != nil {
+		t.Fatalf("RequestPty returned error: %v", err)
+	}
+
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		t.Fatalf("StdinPipe returned error: %v", err)
+	}
+
+	var out bytes.Buffer
+	session.Stdout = &out
+
+	if err := session.Start(script(t, "stty -echo; tty -s && stty size; read line; stty size")); err != nil {
+		t.Fatalf("Start returned error: %v", err)
+	}
+
+	// the initial size is applied before the command runs, the second size after window-change
+	time.Sleep(200 * time.Millisecond)
+
+	if err := session.WindowChange(40, 120); err != nil {
+		t.Fatalf("WindowChange returned error: %v", err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	_, _ = io.WriteString(stdin, "\n")
+
+	if err := session.Wait(); err != nil {
+		t.Fatalf("Wait returned error: %v", err)
+	}
+
+	if got := strings.ReplaceAll(out.String(), "\r", ""); got != "24 80\n40 120\n" {
+		t.Fatalf("unexpected output %q", got)
+	}
+}
+
+func TestLocalExecKilledOnChannelClose(t *testing.T) {
+	session, err := dialBridge(t).NewSession()
+	if err != nil {
+		t.Fatalf("NewSession returned error: %v", err)
+	}
+
+	pidfile := filepath.Join(t.TempDir(), "pid")
+	if err := session.Start(script(t, "echo $$ > "+pidfile+"; exec sleep 100")); err != nil {
+		t.Fatalf("Start returned error: %v", err)
+	}
+
+	var pid int
+	deadline := time.Now().Add(5 * time.Second)
+	for pid == 0 {
+		if b, err := os.ReadFile(pidfile); err == nil {
+			pid, _ = strconv.Atoi(strings.TrimSpace(string(b)))
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("command did not start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	_ = session.Close()
+
+	// the process is killed and reaped, signal 0 fails once the pid is gone
+	for syscall.Kill(pid, 0) == nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("process %v still running after the channel closed", pid)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestLocalSessionsHaveOwnPty(t *testing.T) {
+	client := dialBridge(t)
+	cmd := script(t, "stty -echo; read line; stty size")
+
+	sizes := [][2]int{{24, 80}, {30, 100}}
+	stdins := make([]io.WriteCloser, len(sizes))
+	outs := make([]bytes.Buffer, len(sizes))
+	sessions := make([]*ssh.Session, len(sizes))
+
+	for i, size := range sizes {
+		session, err := client.NewSession()
+		if err != nil {
+			t.Fatalf("NewSession returned error: %v", err)
+		}
+		defer session.Close()
+
+		if err := session.RequestPty("xterm", size[0], size[1], ssh.TerminalModes{}); err != nil {
+			t.Fatalf("RequestPty returned error: %v", err)
+		}
+
+		if stdins[i], err = session.StdinPipe(); err != nil {
+			t.Fatalf("StdinPipe returned error: %v", err)
+		}
+
+		session.Stdout = &outs[i]
+
+		if err := session.Start(cmd); err != nil {
+			t.Fatalf("Start returned error: %v", err)
+		}
+
+		sessions[i] = session
+	}
+
+	// only the first pty is resized
+	if err := sessions[0].WindowChange(40, 120); err != nil {
+		t.Fatalf("WindowChange returned error: %v", err)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+
+	expected := []string{"40 120\n", "30 100\n"}
+	for i, session := range sessions {
+		_, _ = io.WriteString(stdins[i], "\n")
+
+		if err := session.Wait(); err != nil {
+			t.Fatalf("Wait returned error: %v", err)
+		}
+
+		if got := strings.ReplaceAll(outs[i].String(), "\r", ""); got != expected[i] {
+			t.Fatalf("session %v: unexpected output %q", i, got)
+		}
+	}
+}
+
+func TestLocalPtyTermAndModes(t *testing.T) {
+	session, err := dialBridge(t).NewSession()
+	if err != nil {
+		t.Fatalf("NewSession returned error: %v", err)
+	}
+	defer session.Close()
+
+	if err := session.RequestPty("vt100", 24, 80, ssh.TerminalModes{ssh.VERASE: 8, ssh.ECHO: 0}); err != nil {
+		t.Fatalf("RequestPty returned error: %v", err)
+	}
+
+	out, err := session.Output(script(t, "echo $TERM; stty -a"))
+	if err != nil {
+		t.Fatalf("exec returned error: %v", err)
+	}
+
+	got := strings.ReplaceAll(string(out), "\r", "")
+	for _, want := range []string{"vt100\n", "erase = ^H;", " -echo "} {
+		if !strings.Contains(got, want) {
+			t.Fatalf("expected %q in output %q", want, got)
+		}
+	}
+}
+
+func TestLocalTargetIsHostname(t *testing.T) {
+	provider, err := New()
+	if err != nil {
+		t.Fatalf("New returned error: %v", err)
+	}
+	defer provider.Close()
+
+	hostname, _ := os.Hostname()
+	if target, ok := provider.(bridge.Targeter); !ok || target.Target() != hostname {
+		t.Fatalf("expected target %v, got %#v", hostname, provider)
+	}
+}
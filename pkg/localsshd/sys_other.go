@@ -0,0 +1,17 @@
+//go:build !unix
+
+package localsshd
+
+import (
+	"fmt"
+	"os/exec"
+	"syscall"
+)
+
+func runAs(cmd *exec.Cmd, name string) ([]string, error) {
+	return nil, fmt.Errorf("running local commands as %v is not supported on this platform", name)
+}
+
+func signalName(sig syscall.Signal) string {
+	return sig.String()
+}
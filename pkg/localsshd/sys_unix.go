@@ -0,0 +1,72 @@
+//go:build unix
+
+package localsshd
+
+import (
+	"fmt"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// runAs sets the credentials of cmd to name and returns its HOME, USER and LOGNAME
+func runAs(cmd *exec.Cmd, name string) ([]string, error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("uid of %v: %w", name, err)
+	}
+
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("gid of %v: %w", name, err)
+	}
+
+	groupIDs, err := u.GroupIds()
+	if err != nil {
+		return nil, fmt.Errorf("groups of %v: %w", name, err)
+	}
+
+	groups := make([]uint32, 0, len(groupIDs))
+	for _, g := range groupIDs {
+		id, err := strconv.ParseUint(g, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("groups of %v: %w", name, err)
+		}
+
+		groups = append(groups, uint32(id))
+	}
+
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+
+	cmd.SysProcAttr.Credential = &syscall.Credential{
+		Uid:    uint32(uid),
+		Gid:    uint32(gid),
+		Groups: groups,
+	}
+
+	if cmd.Dir == "" {
+		cmd.Dir = u.HomeDir
+	}
+
+	return []string{"HOME=" + u.HomeDir, "USER=" + u.Username, "LOGNAME=" + u.Username}, nil
+}
+
+// signalName returns the name of sig without the SIG prefix as in ssh exit-signal
+func signalName(sig syscall.Signal) string {
+	if name := unix.SignalName(sig); name != "" {
+		return strings.TrimPrefix(name, "SIG")
+	}
+
+	return strconv.Itoa(int(sig))
+}
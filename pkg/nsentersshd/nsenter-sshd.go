@@ -0,0 +1,158 @@
+package nsentersshd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/tg123/docker-sshd/pkg/bridge"
+	"github.com/tg123/docker-sshd/pkg/localsshd"
+)
+
+var _ bridge.SessionProvider = (*nsenterconn)(nil)
+var _ bridge.Session = (*nsentersession)(nil)
+
+// NsenterPath is the nsenter binary from util-linux, 2.37 or later for --wdns
+var NsenterPath = "nsenter"
+
+// DefaultNamespaces are entered unless Options.Namespaces is set, names are the nsenter long options
+var DefaultNamespaces = []string{"mount", "pid", "net", "uts", "ipc"}
+
+// hostNamespaces are compared with pid 1, a process sharing one of them is on the host rather than in a workload
+var hostNamespaces = []string{"mnt", "pid"}
+
+// Options of the nsenter provider
+type Options struct {
+	Namespaces []string
+
+	// AllowHost allows targets sharing the mount or pid namespace of pid 1, i.e. a root shell on the host
+	AllowHost bool
+}
+
+// HostNamespaces returns the namespaces of pid which are the ones of pid 1
+func HostNamespaces(pid int) ([]string, error) {
+	var shared []string
+
+	for _, ns := range hostNamespaces {
+		host, err := os.Readlink(filepath.Join(ProcRoot, "1", "ns", ns))
+		if err != nil {
+			return nil, err
+		}
+
+		target, err := os.Readlink(filepath.Join(ProcRoot, strconv.Itoa(pid), "ns", ns))
+		if err != nil {
+			return nil, err
+		}
+
+		if host == target {
+			shared = append(shared, ns)
+		}
+	}
+
+	return shared, nil
+}
+
+// nsenterconn runs commands through nsenter on a local pty, pty, resize and exit signals come from localsshd
+type nsenterconn struct {
+	bridge.SessionProvider
+	pid  int
+	opts Options
+}
+
+// command wraps cmd with nsenter, user is uid or uid:gid inside the namespaces since the passwd of the target is not readable here
+func (n *nsenterconn) command(cmd []string, user, workingDir string) ([]string, error) {
+	namespaces := n.opts.Namespaces
+	if len(namespaces) == 0 {
+		namespaces = DefaultNamespaces
+	}
+
+	wrapped := []string{NsenterPath, "--target", strconv.Itoa(n.pid)}
+	for _, ns := range namespaces {
+		wrapped = append(wrapped, "--"+ns)
+	}
+
+	if user != "" {
+		uid, gid, _ := strings.Cut(user, ":")
+		if gid == "" {
+			gid = uid
+		}
+
+		if _, err := strconv.ParseUint(uid, 10, 32); err != nil {
+			return nil, fmt.Errorf("nsenter user must be uid or uid:gid, got %v", user)
+		}
+
+		if _, err := strconv.ParseUint(gid, 10, 32); err != nil {
+			return nil, fmt.Errorf("nsenter user must be uid or uid:gid, got %v", user)
+		}
+
+		wrapped = append(wrapped, "--setuid", uid, "--setgid", gid)
+	}
+
+	if workingDir != "" {
+		// util-linux 2.38 takes the directory only in the --wdns=dir form
+		wrapped = append(wrapped, "--wdns="+workingDir)
+	} else {
+		// the working directory of the target, otherwise the one of the bridge is kept
+		wrapped = append(wrapped, "--wd")
+	}
+
+	return append(append(wrapped, "--"), cmd...), nil
+}
+
+// Target is the pid whose namespaces are entered, e.g. what a machine: or cgroup: target resolved to
+func (n *nsenterconn) Target() string {
+	return "pid:" + strconv.Itoa(n.pid)
+}
+
+func (n *nsenterconn) NewSession() bridge.Session {
+	return &nsentersession{Session: n.SessionProvider.NewSession(), nsenter: n}
+}
+
+// nsentersession wraps the command of a local session with nsenter
+type nsentersession struct {
+	bridge.Session
+	nsenter *nsenterconn
+}
+
+func (n *nsentersession) Exec(ctx context.Context, execconfig bridge.ExecConfig) (<-chan bridge.ExecResult, error) {
+	cmd, err := n.nsenter.command(execconfig.Cmd, execconfig.User, execconfig.WorkingDir)
+	if err != nil {
+		return nil, err
+	}
+
+	// user and working directory apply inside the namespaces, not to nsenter on the host
+	execconfig.Cmd = cmd
+	execconfig.User = ""
+	execconfig.WorkingDir = ""
+
+	return n.Session.Exec(ctx, execconfig)
+}
+
+// New creates a provider which runs commands in the namespaces of pid, see Resolve
+// processes of the host are refused unless Options.AllowHost is set
+func New(pid int, opts Options) (bridge.SessionProvider, error) {
+	if !opts.AllowHost {
+		shared, err := HostNamespaces(pid)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(shared) > 0 {
+			return nil, fmt.Errorf("pid %v is in the %v namespace of the host", pid, strings.Join(shared, ", "))
+		}
+	}
+
+	local, err := localsshd.New()
+	if err != nil {
+		return nil, err
+	}
+
+	return &nsenterconn{
+		SessionProvider: local,
+		pid:             pid,
+		opts:            opts,
+	}, nil
+}
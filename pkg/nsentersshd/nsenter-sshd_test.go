@@ -0,0 +1,162 @@
+package nsentersshd
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tg123/docker-sshd/pkg/bridge"
+)
+
+func TestCommand(t *testing.T) {
+	n := &nsenterconn{pid: 42, opts: Options{Namespaces: []string{"mount", "uts"}}}
+
+	tests := []struct {
+		user       string
+		workingDir string
+		expected   []string
+	}{
+		{"", "", []string{"nsenter", "--target", "42", "--mount", "--uts", "--wd", "--", "id"}},
+		{"1000", "/srv", []string{"nsenter", "--target", "42", "--mount", "--uts", "--setuid", "1000", "--setgid", "1000", "--wdns=/srv", "--", "id"}},
+		{"1000:50", "", []string{"nsenter", "--target", "42", "--mount", "--uts", "--setuid", "1000", "--setgid", "50", "--wd", "--", "id"}},
+	}
+
+	for _, tt := range tests {
+		cmd, err := n.command([]string{"id"}, tt.user, tt.workingDir)
+		if err != nil {
+			t.Fatalf("command(%q) returned error: %v", tt.user, err)
+		}
+
+		if !reflect.DeepEqual(cmd, tt.expected) {
+			t.Fatalf("command(%q) = %v, want %v", tt.user, cmd, tt.expected)
+		}
+	}
+
+	if _, err := n.command([]string{"id"}, "app", ""); err == nil {
+		t.Fatal("expected error for user name")
+	}
+}
+
+func TestTarget(t *testing.T) {
+	var provider bridge.SessionProvider = &nsenterconn{pid: 42}
+
+	// admin kill and broadcast match machine: and cgroup: connections by the pid they resolved to
+	if target, ok := provider.(bridge.Targeter); !ok || target.Target() != "pid:42" {
+		t.Fatalf("expected target pid:42, got %#v", provider)
+	}
+}
+
+// unshareTarget runs a process in new uts, mount and pid namespaces with hostname nstest and returns its pid
+func unshareTarget(t *testing.T) int {
+	t.Helper()
+
+	if os.Geteuid() != 0 {
+		t.Skip("entering namespaces requires root")
+	}
+
+	if _, err := exec.LookPath("unshare"); err != nil {
+		t.Skip("unshare not found")
+	}
+
+	cmd := exec.Command("unshare", "--uts", "--mount", "--pid", "--fork", "--mount-proc", "sh", "-c", "hostname nstest && exec sleep 60")
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("unshare failed: %v", err)
+	}
+
+	t.Cleanup(func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	})
+
+	// the target is the forked child of unshare, wait until it has set the hostname and exec'd sleep
+	children := filepath.Join("/proc", strconv.Itoa(cmd.Process.Pid), "task", strconv.Itoa(cmd.Process.Pid), "children")
+	deadline := time.Now().Add(5 * time.Second)
+
+	for time.Now().Before(deadline) {
+		data, _ := os.ReadFile(children)
+		if fields := strings.Fields(string(data)); len(fields) > 0 {
+			comm, _ := os.ReadFile(filepath.Join("/proc", fields[0], "comm"))
+			if strings.TrimSpace(string(comm)) == "sleep" {
+				pid, _ := strconv.Atoi(fields[0])
+				return pid
+			}
+		}
+
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	t.Fatal("unshare child did not start")
+	return 0
+}
+
+func run(t *testing.T, p bridge.SessionProvider, execconfig bridge.ExecConfig) (string, bridge.ExecResult) {
+	t.Helper()
+
+	var out bytes.Buffer
+	execconfig.Input = strings.NewReader("")
+	execconfig.Output = &out
+
+	r, err := p.NewSession().Exec(context.Background(), execconfig)
+	if err != nil {
+		t.Fatalf("Exec returned error: %v", err)
+	}
+
+	select {
+	case result := <-r:
+		return out.String(), result
+	case <-time.After(10 * time.Second):
+		t.Fatal("expected exec result")
+	}
+
+	return "", bridge.ExecResult{}
+}
+
+func TestNsenterUnshare(t *testing.T) {
+	pid := unshareTarget(t)
+
+	// namespaces of pid 1 are not readable without CAP_SYS_PTRACE, e.g. in containers, TestHostNamespaces covers the check
+	_, err := os.Readlink("/proc/1/ns/mnt")
+	allowHost := err != nil
+
+	p, err := New(pid, Options{Namespaces: []string{"mount", "pid", "uts"}, AllowHost: allowHost})
+	if err != nil {
+		t.Fatalf("New returned error: %v", err)
+	}
+
+	out, result := run(t, p, bridge.ExecConfig{Cmd: []string{"sh", "-c", "hostname; echo $$"}})
+	if result.ExitCode != 0 {
+		t.Fatalf("expected exit code 0, got %v (%v)", result.ExitCode, result.Error)
+	}
+
+	lines := strings.Fields(out)
+	if len(lines) != 2 || lines[0] != "nstest" {
+		t.Fatalf("expected hostname of the namespace, got %q", out)
+	}
+
+	// the target is pid 1 of its namespace, the command is one of the next few pids
+	if inner, _ := strconv.Atoi(lines[1]); inner <= 1 || inner > 100 {
+		t.Fatalf("expected a pid inside the namespace, got %q", lines[1])
+	}
+
+	// exec is called once per provider
+	p, err = New(pid, Options{AllowHost: allowHost})
+	if err != nil {
+		t.Fatalf("New returned error: %v", err)
+	}
+
+	out, result = run(t, p, bridge.ExecConfig{Cmd: []string{"sh", "-c", "pwd; exit 3"}, WorkingDir: "/tmp"})
+	if result.ExitCode != 3 {
+		t.Fatalf("expected exit code 3, got %v (%v)", result.ExitCode, result.Error)
+	}
+
+	if out != "/tmp\n" {
+		t.Fatalf("expected working directory inside the namespace, got %q", out)
+	}
+}
@@ -0,0 +1,143 @@
+package nsentersshd
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ErrNotFound is returned by Resolve when the target has no process
+var ErrNotFound = errors.New("no process matches")
+
+// Resolver returns the pid whose namespaces are entered for a target
+type Resolver func(ctx context.Context, target string) (int, error)
+
+var (
+	// ProcRoot is where processes are looked up
+	ProcRoot = "/proc"
+
+	// CgroupRoot is the cgroup v2 mount, cgroup: targets are relative to it
+	CgroupRoot = "/sys/fs/cgroup"
+
+	// MachinectlPath is the machinectl binary of systemd-nspawn
+	MachinectlPath = "machinectl"
+)
+
+// Resolvers map target prefixes to resolvers, register more to support other runtimes
+//
+//	pid:1234 or 1234
+//	cgroup:system.slice/app.service, the first process of the cgroup
+//	machine:web, the leader of a systemd-nspawn machine
+var Resolvers = map[string]Resolver{
+	"pid":     ResolvePid,
+	"cgroup":  ResolveCgroup,
+	"machine": ResolveMachine,
+}
+
+// Resolve finds the pid of target using the resolver of its prefix, a target without prefix is a pid
+func Resolve(ctx context.Context, target string) (int, error) {
+	kind, name, ok := strings.Cut(target, ":")
+	if !ok {
+		return ResolvePid(ctx, target)
+	}
+
+	resolver, ok := Resolvers[kind]
+	if !ok {
+		return 0, fmt.Errorf("unknown target type [%v] in [%v]", kind, target)
+	}
+
+	return resolver(ctx, name)
+}
+
+// Normalize returns the canonical form of target which allow-target patterns match,
+// pid:<pid> for pids with or without prefix, cgroup:<path> with the path cleaned and relative to CgroupRoot
+func Normalize(target string) (string, error) {
+	kind, name, ok := strings.Cut(target, ":")
+	if !ok {
+		kind, name = "pid", target
+	}
+
+	if _, ok := Resolvers[kind]; !ok {
+		return "", fmt.Errorf("unknown target type [%v] in [%v]", kind, target)
+	}
+
+	switch kind {
+	case "pid":
+		pid, err := strconv.Atoi(name)
+		if err != nil || pid <= 0 {
+			return "", fmt.Errorf("invalid pid [%v]", name)
+		}
+
+		name = strconv.Itoa(pid)
+	case "cgroup":
+		name = strings.TrimPrefix(filepath.Clean("/"+name), "/")
+	}
+
+	return kind + ":" + name, nil
+}
+
+// ResolvePid checks that the process exists
+func ResolvePid(ctx context.Context, target string) (int, error) {
+	pid, err := strconv.Atoi(target)
+	if err != nil || pid <= 0 {
+		return 0, fmt.Errorf("invalid pid [%v]", target)
+	}
+
+	if _, err := os.Stat(filepath.Join(ProcRoot, strconv.Itoa(pid))); err != nil {
+		return 0, fmt.Errorf("%w [%v]", ErrNotFound, target)
+	}
+
+	return pid, nil
+}
+
+// ResolveCgroup returns the first process in cgroup.procs of the cgroup
+func ResolveCgroup(ctx context.Context, target string) (int, error) {
+	path := filepath.Join(CgroupRoot, filepath.Clean("/"+target), "cgroup.procs")
+
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return 0, fmt.Errorf("%w [cgroup:%v]", ErrNotFound, target)
+		}
+		return 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if pid, err := strconv.Atoi(strings.TrimSpace(scanner.Text())); err == nil && pid > 0 {
+			return pid, nil
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+
+	return 0, fmt.Errorf("%w [cgroup:%v], the cgroup is empty", ErrNotFound, target)
+}
+
+// ResolveMachine returns the leader pid of a machine registered with systemd-machined
+func ResolveMachine(ctx context.Context, target string) (int, error) {
+	out, err := exec.CommandContext(ctx, MachinectlPath, "show", "--property=Leader", "--value", target).Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return 0, fmt.Errorf("%w [machine:%v]: %v", ErrNotFound, target, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return 0, err
+	}
+
+	pid, err := strconv.Atoi(strings.TrimSpace(string(out)))
+	if err != nil || pid <= 0 {
+		return 0, fmt.Errorf("%w [machine:%v], no leader", ErrNotFound, target)
+	}
+
+	return pid, nil
+}
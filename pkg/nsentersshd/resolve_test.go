@@ -0,0 +1,182 @@
+package nsentersshd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestResolve(t *testing.T) {
+	self := strconv.Itoa(os.Getpid())
+
+	CgroupRoot = t.TempDir()
+	defer func() { CgroupRoot = "/sys/fs/cgroup" }()
+
+	if err := os.MkdirAll(filepath.Join(CgroupRoot, "system.slice", "app.service"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(CgroupRoot, "system.slice", "app.service", "cgroup.procs"), []byte("4242\n4343\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.MkdirAll(filepath.Join(CgroupRoot, "empty.slice"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(CgroupRoot, "empty.slice", "cgroup.procs"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	machinectl := filepath.Join(t.TempDir(), "machinectl")
+	if err := os.WriteFile(machinectl, []byte("#!/bin/sh\n[ \"$4\" = web ] && echo 777 && exit 0\necho \"No machine '$4' known\" >&2\nexit 1\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	MachinectlPath = machinectl
+	defer func() { MachinectlPath = "machinectl" }()
+
+	tests := []struct {
+		target   string
+		pid      int
+		notFound bool
+		err      bool
+	}{
+		{self, os.Getpid(), false, false},
+		{"pid:" + self, os.Getpid(), false, false},
+		{"pid:0", 0, false, true},
+		{"abc", 0, false, true},
+		{"999999999", 0, true, true},
+		{"cgroup:system.slice/app.service", 4242, false, false},
+		{"cgroup:/system.slice/app.service", 4242, false, false},
+		{"cgroup:../../etc", 0, true, true},
+		{"cgroup:empty.slice", 0, true, true},
+		{"machine:web", 777, false, false},
+		{"machine:db", 0, true, true},
+		{"vm:web", 0, false, true},
+	}
+
+	for _, tt := range tests {
+		pid, err := Resolve(context.Background(), tt.target)
+
+		if tt.err {
+			if err == nil {
+				t.Errorf("Resolve(%q) expected error, got %v", tt.target, pid)
+			} else if tt.notFound && !errors.Is(err, ErrNotFound) {
+				t.Errorf("Resolve(%q) expected ErrNotFound, got %v", tt.target, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("Resolve(%q) returned error: %v", tt.target, err)
+			continue
+		}
+
+		if pid != tt.pid {
+			t.Errorf("Resolve(%q) = %v, want %v", tt.target, pid, tt.pid)
+		}
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		target     string
+		normalized string
+	}{
+		{"1234", "pid:1234"},
+		{"001234", "pid:1234"},
+		{"pid:+1234", "pid:1234"},
+		{"cgroup:system.slice/app.service", "cgroup:system.slice/app.service"},
+		{"cgroup:/system.slice//app.service/", "cgroup:system.slice/app.service"},
+		{"cgroup:system.slice/../user.slice/x", "cgroup:user.slice/x"},
+		{"cgroup:../../etc", "cgroup:etc"},
+		{"machine:web", "machine:web"},
+		{"abc", ""},
+		{"pid:-1", ""},
+		{"vm:web", ""},
+	}
+
+	for _, tt := range tests {
+		normalized, err := Normalize(tt.target)
+		if tt.normalized == "" {
+			if err == nil {
+				t.Errorf("Normalize(%q) expected error, got %v", tt.target, normalized)
+			}
+			continue
+		}
+
+		if err != nil || normalized != tt.normalized {
+			t.Errorf("Normalize(%q) = %v %v, want %v", tt.target, normalized, err, tt.normalized)
+		}
+	}
+}
+
+func TestHostNamespaces(t *testing.T) {
+	ProcRoot = t.TempDir()
+	defer func() { ProcRoot = "/proc" }()
+
+	links := map[string]string{
+		"1/ns/mnt":  "mnt:[1]",
+		"1/ns/pid":  "pid:[1]",
+		"42/ns/mnt": "mnt:[2]",
+		"42/ns/pid": "pid:[2]",
+		"43/ns/mnt": "mnt:[3]",
+		"43/ns/pid": "pid:[1]",
+	}
+
+	for name, target := range links {
+		if err := os.MkdirAll(filepath.Join(ProcRoot, filepath.Dir(name)), 0o755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.Symlink(target, filepath.Join(ProcRoot, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		pid    int
+		shared string
+	}{
+		{1, "[mnt pid]"},
+		{42, "[]"},
+		{43, "[pid]"},
+	}
+
+	for _, tt := range tests {
+		shared, err := HostNamespaces(tt.pid)
+		if err != nil {
+			t.Fatalf("HostNamespaces(%v) returned error: %v", tt.pid, err)
+		}
+
+		if got := fmt.Sprint(shared); got != tt.shared {
+			t.Fatalf("HostNamespaces(%v) = %v, want %v", tt.pid, got, tt.shared)
+		}
+	}
+
+	if _, err := New(1, Options{}); err == nil || !strings.Contains(err.Error(), "namespace of the host") {
+		t.Fatalf("expected pid 1 to be refused, got %v", err)
+	}
+
+	if _, err := New(43, Options{}); err == nil {
+		t.Fatal("expected pid in the host pid namespace to be refused")
+	}
+
+	if _, err := New(42, Options{}); err != nil {
+		t.Fatalf("New returned error: %v", err)
+	}
+
+	if _, err := New(1, Options{AllowHost: true}); err != nil {
+		t.Fatalf("expected AllowHost to allow pid 1, got %v", err)
+	}
+
+	if _, err := New(7, Options{}); err == nil {
+		t.Fatal("expected error for unreadable namespaces")
+	}
+}
@@ -0,0 +1,298 @@
+package podmansshd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// apiPrefix is the libpod api version used, supported by podman 4 and later
+const apiPrefix = "/v4.0.0/libpod"
+
+// DefaultSocket returns the podman socket from CONTAINER_HOST, the rootless socket or the system socket
+func DefaultSocket() string {
+	if host := os.Getenv("CONTAINER_HOST"); strings.HasPrefix(host, "unix://") {
+		return strings.TrimPrefix(host, "unix://")
+	}
+
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" && os.Geteuid() != 0 {
+		socket := filepath.Join(dir, "podman", "podman.sock")
+		if _, err := os.Stat(socket); err == nil {
+			return socket
+		}
+	}
+
+	return "/run/podman/podman.sock"
+}
+
+// Client talks to the libpod rest api over the podman unix socket
+type Client struct {
+	dial func(ctx context.Context) (net.Conn, error)
+	http *http.Client
+}
+
+// NewClient creates a client of the podman socket at path
+func NewClient(socket string) *Client {
+	dial := func(ctx context.Context) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "unix", socket)
+	}
+
+	return &Client{
+		dial: dial,
+		http: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return dial(ctx)
+				},
+			},
+		},
+	}
+}
+
+// APIError is returned for non 2xx responses
+type APIError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("podman api error %v: %v", e.StatusCode, e.Message)
+}
+
+// IsNotFound reports whether err is a 404 from the api
+func IsNotFound(err error) bool {
+	apiErr, ok := err.(*APIError)
+	return ok && apiErr.StatusCode == http.StatusNotFound
+}
+
+func (c *Client) newRequest(ctx context.Context, method, path string, query url.Values, body any) (*http.Request, error) {
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(data)
+	}
+
+	u := "http://d" + apiPrefix + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u, r)
+	if err != nil {
+		return nil, err
+	}
+
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	return req, nil
+}
+
+func checkResponse(resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 || resp.StatusCode == http.StatusSwitchingProtocols {
+		return nil
+	}
+
+	msg := struct {
+		Message string `json:"message"`
+	}{}
+
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err := json.Unmarshal(data, &msg); err != nil || msg.Message == "" {
+		msg.Message = strings.TrimSpace(string(data))
+	}
+
+	return &APIError{StatusCode: resp.StatusCode, Message: msg.Message}
+}
+
+// do sends a request and decodes the json response into out if not nil
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, body, out any) error {
+	req, err := c.newRequest(ctx, method, path, query, body)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := checkResponse(resp); err != nil {
+		return err
+	}
+
+	if out == nil {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// hijack sends a request which upgrades the connection to a raw stream
+func (c *Client) hijack(ctx context.Context, path string, body any) (net.Conn, *bufio.Reader, error) {
+	req, err := c.newRequest(ctx, http.MethodPost, path, nil, body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "tcp")
+
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	if err := checkResponse(resp); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	return conn, br, nil
+}
+
+// ExecConfig is the body of exec create
+type ExecConfig struct {
+	AttachStdin  bool     `json:"AttachStdin"`
+	AttachStdout bool     `json:"AttachStdout"`
+	AttachStderr bool     `json:"AttachStderr"`
+	Tty          bool     `json:"Tty"`
+	Env          []string `json:"Env,omitempty"`
+	Cmd          []string `json:"Cmd"`
+	User         string   `json:"User,omitempty"`
+	WorkingDir   string   `json:"WorkingDir,omitempty"`
+}
+
+// ExecInspect is the part of exec inspect used
+type ExecInspect struct {
+	ID          string `json:"ID"`
+	Running     bool   `json:"Running"`
+	ExitCode    int    `json:"ExitCode"`
+	ContainerID string `json:"ContainerID"`
+}
+
+// Container is the part of container inspect and list used
+type Container struct {
+	ID    string
+	Name  string
+	Image string
+	State string
+}
+
+// ExecCreate creates an exec in container and returns its id
+func (c *Client) ExecCreate(ctx context.Context, container string, config ExecConfig) (string, error) {
+	out := struct {
+		ID string `json:"Id"`
+	}{}
+
+	if err := c.do(ctx, http.MethodPost, "/containers/"+url.PathEscape(container)+"/exec", nil, config, &out); err != nil {
+		return "", err
+	}
+
+	return out.ID, nil
+}
+
+// ExecStart starts the exec and returns its attached stream
+// without tty the output is multiplexed like docker, see github.com/docker/docker/pkg/stdcopy
+func (c *Client) ExecStart(ctx context.Context, execID string, tty bool, height, width uint) (net.Conn, *bufio.Reader, error) {
+	body := map[string]any{
+		"Detach": false,
+		"Tty":    tty,
+	}
+
+	if height > 0 && width > 0 {
+		body["h"] = height
+		body["w"] = width
+	}
+
+	return c.hijack(ctx, "/exec/"+url.PathEscape(execID)+"/start", body)
+}
+
+// ExecResize resizes the tty of the exec
+func (c *Client) ExecResize(ctx context.Context, execID string, height, width uint) error {
+	query := url.Values{
+		"h": {fmt.Sprint(height)},
+		"w": {fmt.Sprint(width)},
+	}
+
+	return c.do(ctx, http.MethodPost, "/exec/"+url.PathEscape(execID)+"/resize", query, nil, nil)
+}
+
+// ExecInspect returns the state of the exec
+func (c *Client) ExecInspect(ctx context.Context, execID string) (ExecInspect, error) {
+	var out ExecInspect
+	err := c.do(ctx, http.MethodGet, "/exec/"+url.PathEscape(execID)+"/json", nil, nil, &out)
+	return out, err
+}
+
+// ContainerInspect returns the container of a name or id
+func (c *Client) ContainerInspect(ctx context.Context, container string) (Container, error) {
+	out := struct {
+		ID        string `json:"Id"`
+		Name      string `json:"Name"`
+		ImageName string `json:"ImageName"`
+		State     struct {
+			Status string `json:"Status"`
+		} `json:"State"`
+	}{}
+
+	if err := c.do(ctx, http.MethodGet, "/containers/"+url.PathEscape(container)+"/json", nil, nil, &out); err != nil {
+		return Container{}, err
+	}
+
+	return Container{ID: out.ID, Name: out.Name, Image: out.ImageName, State: out.State.Status}, nil
+}
+
+// ContainerList returns running containers
+func (c *Client) ContainerList(ctx context.Context) ([]Container, error) {
+	var out []struct {
+		ID    string   `json:"Id"`
+		Names []string `json:"Names"`
+		Image string   `json:"Image"`
+		State string   `json:"State"`
+	}
+
+	if err := c.do(ctx, http.MethodGet, "/containers/json", nil, nil, &out); err != nil {
+		return nil, err
+	}
+
+	list := make([]Container, 0, len(out))
+	for _, c := range out {
+		name := c.ID
+		if len(c.Names) > 0 {
+			name = c.Names[0]
+		}
+
+		list = append(list, Container{ID: c.ID, Name: name, Image: c.Image, State: c.State})
+	}
+
+	return list, nil
+}
@@ -0,0 +1,181 @@
+package podmansshd
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/pkg/stdcopy"
+	log "github.com/sirupsen/logrus"
+	"github.com/tg123/docker-sshd/pkg/bridge"
+)
+
+var _ bridge.SessionProvider = (*podmansshdconn)(nil)
+var _ bridge.Session = (*podmansession)(nil)
+
+// DefaultExecTimeout is how long to wait for the exit code after the output of an exec ends
+const DefaultExecTimeout = 10 * time.Second
+
+type podmansshdconn struct {
+	containerName string
+	client        *Client
+
+	// closed is cancelled by Close, running execs stop and their hijacked connections are closed
+	closed context.Context
+	cancel context.CancelFunc
+}
+
+func (p *podmansshdconn) Close() error {
+	p.cancel()
+	return nil
+}
+
+// Target is the container id or name the provider was created for
+func (p *podmansshdconn) Target() string {
+	return p.containerName
+}
+
+func (p *podmansshdconn) NewSession() bridge.Session {
+	return &podmansession{podmansshdconn: p}
+}
+
+// podmansession is one exec in the container, each session channel has its own
+type podmansession struct {
+	*podmansshdconn
+
+	mu       sync.Mutex
+	execID   string
+	initSize bridge.ResizeOptions
+}
+
+func (p *podmansession) Exec(ctx context.Context, execconfig bridge.ExecConfig) (<-chan bridge.ExecResult, error) {
+	execID, err := p.client.ExecCreate(ctx, p.containerName, ExecConfig{
+		AttachStdin:  true,
+		AttachStdout: true,
+		AttachStderr: true,
+		Tty:          execconfig.Tty,
+		Env:          execconfig.Env,
+		Cmd:          execconfig.CmdWithTerminalModes(),
+		User:         execconfig.User,
+		WorkingDir:   execconfig.WorkingDir,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	p.execID = execID
+	size := p.initSize
+	p.mu.Unlock()
+
+	conn, reader, err := p.client.ExecStart(ctx, execID, execconfig.Tty, size.Height, size.Width)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debugf("podman exec [%v] in container [%v] started", execconfig.Cmd, p.containerName)
+
+	timeout := execconfig.ExitTimeout
+	if timeout <= 0 {
+		timeout = DefaultExecTimeout
+	}
+
+	r := make(chan bridge.ExecResult, 1)
+
+	go func() {
+		defer conn.Close()
+
+		done := make(chan error, 1)
+
+		go func() {
+			_, _ = io.Copy(conn, execconfig.Input)
+			// stdin is closed by client but it still need to wait for stdout close
+		}()
+
+		go func() {
+			var err error
+			if execconfig.Tty {
+				_, err = io.Copy(execconfig.Output, reader)
+			} else {
+				_, err = stdcopy.StdCopy(execconfig.Output, execconfig.Output, reader)
+			}
+			done <- err
+		}()
+
+		var err error
+		select {
+		case err = <-done:
+		case <-ctx.Done():
+			log.Warningf("exec [%v] in container [%v] context cancelled", execconfig.Cmd, p.containerName)
+			r <- bridge.ExecResult{ExitCode: -1, Error: ctx.Err()}
+			return
+		case <-p.closed.Done():
+			log.Warningf("exec [%v] in container [%v] closed", execconfig.Cmd, p.containerName)
+			r <- bridge.ExecResult{ExitCode: -1, Error: p.closed.Err()}
+			return
+		}
+
+		log.Debugf("podman exec [%v] in container [%v] done error [%v]", execconfig.Cmd, p.containerName, err)
+
+		exitCode := p.inspectExitCode(execID, time.Now().Add(timeout))
+		if exitCode == 0 {
+			err = nil
+		}
+
+		r <- bridge.ExecResult{
+			ExitCode: exitCode,
+			Error:    err,
+		}
+	}()
+
+	return r, nil
+}
+
+// inspectExitCode polls exec inspect until the exec stops, -1 if it is still running at deadline
+func (p *podmansshdconn) inspectExitCode(execID string, deadline time.Time) int {
+	for {
+		exec, err := p.client.ExecInspect(context.Background(), execID)
+		switch {
+		case err != nil:
+			log.Warningf("inspect exec %v failed %v", execID, err)
+		case exec.Running:
+			log.Warnf("exec %v is still running in container %v", execID, exec.ContainerID)
+		default:
+			return exec.ExitCode
+		}
+
+		if time.Now().After(deadline) {
+			log.Warningf("exec [%v] is still running or inspect error after timeout", execID)
+			return -1
+		}
+
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+func (p *podmansession) Resize(ctx context.Context, size bridge.ResizeOptions) error {
+	p.mu.Lock()
+	execID := p.execID
+	if execID == "" {
+		p.initSize = size
+	}
+	p.mu.Unlock()
+
+	if execID == "" {
+		return nil
+	}
+
+	return p.client.ExecResize(ctx, execID, size.Height, size.Width)
+}
+
+func New(client *Client, containerName string) (bridge.SessionProvider, error) {
+	closed, cancel := context.WithCancel(context.Background())
+
+	return &podmansshdconn{
+		containerName: containerName,
+		client:        client,
+		closed:        closed,
+		cancel:        cancel,
+	}, nil
+}
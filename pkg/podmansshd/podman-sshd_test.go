@@ -0,0 +1,257 @@
+package podmansshd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tg123/docker-sshd/pkg/bridge"
+	"golang.org/x/crypto/ssh"
+)
+
+// fakeLibpod implements the libpod endpoints used by the provider, the exec echoes one line and exits with 3
+// an exec reading hang keeps running until the client closes the stream
+type fakeLibpod struct {
+	mu      sync.Mutex
+	created ExecConfig
+	started map[string]any
+	resizes []string
+
+	hungup chan struct{}
+}
+
+func (f *fakeLibpod) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, apiPrefix)
+
+	switch {
+	case r.Method == http.MethodGet && path == "/containers/web/json":
+		_ = json.NewEncoder(w).Encode(map[string]any{"Id": "c1", "Name": "web", "ImageName": "alpine", "State": map[string]any{"Status": "running"}})
+	case r.Method == http.MethodGet && strings.HasPrefix(path, "/containers/"):
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(map[string]any{"message": "no such container"})
+	case r.Method == http.MethodPost && path == "/containers/c1/exec":
+		f.mu.Lock()
+		_ = json.NewDecoder(r.Body).Decode(&f.created)
+		f.mu.Unlock()
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(map[string]any{"Id": "e1"})
+	case r.Method == http.MethodPost && path == "/exec/e1/start":
+		f.mu.Lock()
+		_ = json.NewDecoder(r.Body).Decode(&f.started)
+		f.mu.Unlock()
+
+		if r.Header.Get("Upgrade") != "tcp" {
+			http.Error(w, "upgrade required", http.StatusBadRequest)
+			return
+		}
+
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		_, _ = rw.WriteString("HTTP/1.1 101 UPGRADED\r\nContent-Type: application/vnd.docker.raw-stream\r\nConnection: Upgrade\r\nUpgrade: tcp\r\n\r\n")
+		_ = rw.Flush()
+
+		line, _ := rw.ReadString('\n')
+		_, _ = rw.WriteString("echo:" + line)
+		_ = rw.Flush()
+
+		if line == "hang\n" {
+			_, _ = io.Copy(io.Discard, rw)
+			f.hungup <- struct{}{}
+		}
+	case r.Method == http.MethodPost && path == "/exec/e1/resize":
+		f.mu.Lock()
+		f.resizes = append(f.resizes, r.URL.Query().Get("w")+"x"+r.URL.Query().Get("h"))
+		f.mu.Unlock()
+	case r.Method == http.MethodGet && path == "/exec/e1/json":
+		_ = json.NewEncoder(w).Encode(map[string]any{"ID": "e1", "Running": false, "ExitCode": 3})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func newFakeLibpod(t *testing.T) (*fakeLibpod, *Client) {
+	t.Helper()
+
+	socket := filepath.Join(t.TempDir(), "podman.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+
+	f := &fakeLibpod{hungup: make(chan struct{}, 1)}
+	srv := &http.Server{Handler: f}
+	go func() { _ = srv.Serve(l) }()
+	t.Cleanup(func() { _ = srv.Close() })
+
+	return f, NewClient(socket)
+}
+
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestPodmanExec(t *testing.T) {
+	f, client := newFakeLibpod(t)
+
+	c, err := Resolve(context.Background(), client, "web")
+	if err != nil {
+		t.Fatalf("Resolve returned error: %v", err)
+	}
+
+	p, err := New(client, c.ID)
+	if err != nil {
+		t.Fatalf("New returned error: %v", err)
+	}
+	session := p.NewSession()
+
+	if err := session.Resize(context.Background(), bridge.ResizeOptions{Width: 80, Height: 24}); err != nil {
+		t.Fatalf("Resize returned error: %v", err)
+	}
+
+	var out lockedBuffer
+	r, err := session.Exec(context.Background(), bridge.ExecConfig{
+		Input:  bufio.NewReader(strings.NewReader("hello\n")),
+		Output: &out,
+		Cmd:    []string{"/bin/sh"},
+		Tty:    true,
+		User:   "app",
+		Shell:  true,
+		Modes:  ssh.TerminalModes{ssh.ECHO: 0},
+	})
+	if err != nil {
+		t.Fatalf("Exec returned error: %v", err)
+	}
+
+	if err := session.Resize(context.Background(), bridge.ResizeOptions{Width: 120, Height: 40}); err != nil {
+		t.Fatalf("Resize returned error: %v", err)
+	}
+
+	select {
+	case result := <-r:
+		if result.ExitCode != 3 {
+			t.Fatalf("expected exit code 3, got %v", result.ExitCode)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected exec result")
+	}
+
+	if out.String() != "echo:hello\n" {
+		t.Fatalf("unexpected output %q", out.String())
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.created.Tty || f.created.User != "app" {
+		t.Fatalf("unexpected exec config %#v", f.created)
+	}
+
+	if cmd := strings.Join(f.created.Cmd, " "); cmd != `/bin/sh -c stty '-echo' 2>/dev/null; exec "$@" sh /bin/sh` {
+		t.Fatalf("expected stty prelude for the shell, got %v", cmd)
+	}
+
+	if f.started["w"] != float64(80) || f.started["h"] != float64(24) {
+		t.Fatalf("expected initial size in exec start, got %#v", f.started)
+	}
+
+	if len(f.resizes) != 1 || f.resizes[0] != "120x40" {
+		t.Fatalf("expected resize after start, got %#v", f.resizes)
+	}
+}
+
+func TestPodmanResolveNotFound(t *testing.T) {
+	_, client := newFakeLibpod(t)
+
+	if _, err := Resolve(context.Background(), client, "missing"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestPodmanExecStopsWithContextAndClose(t *testing.T) {
+	for _, stop := range []string{"cancel", "close"} {
+		t.Run(stop, func(t *testing.T) {
+			f, client := newFakeLibpod(t)
+
+			p, err := New(client, "c1")
+			if err != nil {
+				t.Fatalf("New returned error: %v", err)
+			}
+			session := p.NewSession()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			inr, inw := io.Pipe()
+			defer inw.Close()
+
+			var out lockedBuffer
+			r, err := session.Exec(ctx, bridge.ExecConfig{
+				Input:  inr,
+				Output: &out,
+				Cmd:    []string{"/bin/sh"},
+				Tty:    true,
+			})
+			if err != nil {
+				t.Fatalf("Exec returned error: %v", err)
+			}
+
+			_, _ = io.WriteString(inw, "hang\n")
+
+			deadline := time.Now().Add(5 * time.Second)
+			for out.String() != "echo:hang\n" {
+				if time.Now().After(deadline) {
+					t.Fatalf("unexpected output %q", out.String())
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			if stop == "cancel" {
+				cancel()
+			} else {
+				_ = p.Close()
+			}
+
+			select {
+			case result := <-r:
+				if !errors.Is(result.Error, context.Canceled) {
+					t.Fatalf("expected cancelled exec, got %v", result.Error)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("expected exec result")
+			}
+
+			select {
+			case <-f.hungup:
+			case <-time.After(5 * time.Second):
+				t.Fatal("expected the exec stream to be closed")
+			}
+		})
+	}
+}
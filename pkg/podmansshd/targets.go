@@ -0,0 +1,40 @@
+package podmansshd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/tg123/docker-sshd/pkg/bridge"
+)
+
+// ErrNotFound is returned by Resolve when no container has the name or id
+var ErrNotFound = errors.New("no container matches")
+
+// Resolve returns the container of a name or id
+func Resolve(ctx context.Context, client *Client, target string) (Container, error) {
+	c, err := client.ContainerInspect(ctx, target)
+	if IsNotFound(err) {
+		return Container{}, fmt.Errorf("%w [%v]", ErrNotFound, target)
+	}
+
+	return c, err
+}
+
+// ListTargets lists running containers for the picker
+func ListTargets(ctx context.Context, client *Client) ([]bridge.Target, error) {
+	list, err := client.ContainerList(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	targets := make([]bridge.Target, 0, len(list))
+	for _, c := range list {
+		targets = append(targets, bridge.Target{
+			Name:        c.Name,
+			Description: fmt.Sprintf("%v (%v)", c.Image, c.State),
+		})
+	}
+
+	return targets, nil
+}
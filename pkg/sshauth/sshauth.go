@@ -0,0 +1,197 @@
+package sshauth
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	extIdentity  = "sshauth-identity"
+	extGroups    = "sshauth-groups"
+	extExecUsers = "sshauth-exec-users"
+	extTargets   = "sshauth-targets"
+)
+
+// Identity is the authenticated user behind an ssh connection
+type Identity struct {
+	Name   string
+	Groups []string
+
+	// ExecUsers are the users the identity may run as inside containers, the first is the default
+	ExecUsers []string
+
+	// Targets are glob patterns of the targets the identity may connect to, on top of --allow-target, any if empty
+	Targets []string
+}
+
+// Permissions carries the identity into ssh.ServerConn.Permissions
+func (id Identity) Permissions() *ssh.Permissions {
+	return &ssh.Permissions{
+		Extensions: map[string]string{
+			extIdentity:  id.Name,
+			extGroups:    strings.Join(id.Groups, ","),
+			extExecUsers: strings.Join(id.ExecUsers, ","),
+			extTargets:   strings.Join(id.Targets, ","),
+		},
+	}
+}
+
+// FromPermissions returns the identity set by Permissions, false if the connection was not authenticated by key
+func FromPermissions(p *ssh.Permissions) (Identity, bool) {
+	if p == nil {
+		return Identity{}, false
+	}
+
+	name, ok := p.Extensions[extIdentity]
+	if !ok || name == "" {
+		return Identity{}, false
+	}
+
+	id := Identity{Name: name}
+	if groups := p.Extensions[extGroups]; groups != "" {
+		id.Groups = strings.Split(groups, ",")
+	}
+
+	if users := p.Extensions[extExecUsers]; users != "" {
+		id.ExecUsers = strings.Split(users, ",")
+	}
+
+	if targets := p.Extensions[extTargets]; targets != "" {
+		id.Targets = strings.Split(targets, ",")
+	}
+
+	return id, true
+}
+
+// AuthorizedKeys maps public keys to identities
+type AuthorizedKeys struct {
+	keys map[string]Identity
+}
+
+// LoadAuthorizedKeys reads an authorized_keys file
+//
+// the comment of each key is the identity, options identity="name" and groups="a,b" override or add to it,
+// exec-user="app,www" limits the users inside containers and allow-target="web-*,db-1" the targets
+//
+//	groups="dev,ops",exec-user="app",allow-target="web-*" ssh-ed25519 AAAA... alice
+func LoadAuthorizedKeys(path string) (*AuthorizedKeys, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	a, err := ParseAuthorizedKeys(data)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", path, err)
+	}
+
+	return a, nil
+}
+
+// ParseAuthorizedKeys parses authorized_keys content, see LoadAuthorizedKeys
+func ParseAuthorizedKeys(data []byte) (*AuthorizedKeys, error) {
+	a := &AuthorizedKeys{keys: make(map[string]Identity)}
+
+	for lineno := 1; len(bytes.TrimSpace(data)) > 0; lineno++ {
+		line, rest, _ := bytes.Cut(data, []byte("\n"))
+		data = rest
+
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		key, comment, options, _, err := ssh.ParseAuthorizedKey(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %v: %w", lineno, err)
+		}
+
+		id := Identity{Name: comment}
+
+		for _, o := range options {
+			k, v, _ := strings.Cut(o, "=")
+			v = strings.Trim(v, `"`)
+
+			switch k {
+			case "identity":
+				id.Name = v
+			case "groups":
+				id.Groups = append(id.Groups, splitList(v)...)
+			case "exec-user":
+				id.ExecUsers = append(id.ExecUsers, splitList(v)...)
+			case "allow-target":
+				id.Targets = append(id.Targets, splitList(v)...)
+			}
+		}
+
+		if id.Name == "" {
+			return nil, fmt.Errorf("line %v: key has no identity, set a comment or identity=\"name\"", lineno)
+		}
+
+		a.keys[string(key.Marshal())] = id
+	}
+
+	return a, nil
+}
+
+func splitList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+
+	return list
+}
+
+// ExecUser returns the container user for a session, requested is the user of user+target username, may be empty
+// defaultUser applies to identities without exec-user, requested must then be empty or equal to it
+// without any policy, requested is returned as is and empty means the image default
+func (id Identity) ExecUser(requested, defaultUser string) (string, error) {
+	allowed := id.ExecUsers
+	if len(allowed) == 0 && defaultUser != "" {
+		allowed = []string{defaultUser}
+	}
+
+	if len(allowed) == 0 {
+		return requested, nil
+	}
+
+	if requested == "" {
+		return allowed[0], nil
+	}
+
+	for _, u := range allowed {
+		if u == requested {
+			return requested, nil
+		}
+	}
+
+	return "", fmt.Errorf("%v may not run as %v inside the container", id.Name, requested)
+}
+
+// InGroup reports whether the identity is a member of group, set by the groups option of its key
+func (id Identity) InGroup(group string) bool {
+	for _, g := range id.Groups {
+		if g == group {
+			return true
+		}
+	}
+
+	return false
+}
+
+// PublicKeyCallback is an ssh.ServerConfig.PublicKeyCallback accepting only the authorized keys
+func (a *AuthorizedKeys) PublicKeyCallback(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	id, ok := a.keys[string(key.Marshal())]
+	if !ok {
+		return nil, fmt.Errorf("unknown public key for %v", conn.User())
+	}
+
+	return id.Permissions(), nil
+}
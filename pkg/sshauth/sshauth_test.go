@@ -0,0 +1,139 @@
+package sshauth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func newPublicKey(t *testing.T) ssh.PublicKey {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+func authorizedLine(options string, key ssh.PublicKey, comment string) string {
+	line := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))) + " " + comment
+	if options != "" {
+		line = options + " " + line
+	}
+
+	return line
+}
+
+func TestAuthorizedKeys(t *testing.T) {
+	alice := newPublicKey(t)
+	bob := newPublicKey(t)
+	stranger := newPublicKey(t)
+
+	data := "# team keys\n\n" +
+		authorizedLine(`groups="dev, ops"`, alice, "alice@laptop") + "\n" +
+		authorizedLine(`identity="bob",exec-user="app,www",allow-target="web-*,db-1",no-pty`, bob, "ci") + "\n"
+
+	keys, err := ParseAuthorizedKeys([]byte(data))
+	if err != nil {
+		t.Fatalf("ParseAuthorizedKeys returned error: %v", err)
+	}
+
+	tests := []struct {
+		key  ssh.PublicKey
+		want Identity
+	}{
+		{alice, Identity{Name: "alice@laptop", Groups: []string{"dev", "ops"}}},
+		{bob, Identity{Name: "bob", ExecUsers: []string{"app", "www"}, Targets: []string{"web-*", "db-1"}}},
+	}
+
+	for _, tt := range tests {
+		perms, err := keys.PublicKeyCallback(nil, tt.key)
+		if err != nil {
+			t.Fatalf("PublicKeyCallback returned error: %v", err)
+		}
+
+		id, ok := FromPermissions(perms)
+		if !ok || !reflect.DeepEqual(id, tt.want) {
+			t.Fatalf("expected identity %#v, got %#v", tt.want, id)
+		}
+	}
+
+	if _, err := keys.PublicKeyCallback(fakeConnMetadata{}, stranger); err == nil {
+		t.Fatal("expected unknown key to be rejected")
+	}
+}
+
+func TestAuthorizedKeysRequiresIdentity(t *testing.T) {
+	key := newPublicKey(t)
+
+	if _, err := ParseAuthorizedKeys(ssh.MarshalAuthorizedKey(key)); err == nil {
+		t.Fatal("expected error for key without identity")
+	}
+}
+
+func TestFromPermissionsWithoutIdentity(t *testing.T) {
+	if _, ok := FromPermissions(nil); ok {
+		t.Fatal("expected no identity for nil permissions")
+	}
+
+	if _, ok := FromPermissions(&ssh.Permissions{}); ok {
+		t.Fatal("expected no identity for empty permissions")
+	}
+}
+
+type fakeConnMetadata struct {
+	ssh.ConnMetadata
+}
+
+func (fakeConnMetadata) User() string {
+	return "someone"
+}
+
+func TestIdentityExecUser(t *testing.T) {
+	restricted := Identity{Name: "bob", ExecUsers: []string{"app", "www"}}
+	anyone := Identity{Name: "alice"}
+
+	tests := []struct {
+		id          Identity
+		requested   string
+		defaultUser string
+		want        string
+		allowed     bool
+	}{
+		{restricted, "", "", "app", true},
+		{restricted, "www", "nobody", "www", true},
+		{restricted, "root", "", "", false},
+		{anyone, "", "", "", true},
+		{anyone, "root", "", "root", true},
+		{anyone, "", "nobody", "nobody", true},
+		{anyone, "root", "nobody", "", false},
+	}
+
+	for _, tt := range tests {
+		got, err := tt.id.ExecUser(tt.requested, tt.defaultUser)
+		if (err == nil) != tt.allowed || got != tt.want {
+			t.Fatalf("%v ExecUser(%q, %q) = %q, %v, expected %q allowed %v", tt.id.Name, tt.requested, tt.defaultUser, got, err, tt.want, tt.allowed)
+		}
+	}
+}
+
+func TestIdentityInGroup(t *testing.T) {
+	id := Identity{Name: "alice", Groups: []string{"dev", "ops"}}
+
+	if !id.InGroup("ops") {
+		t.Fatal("expected alice to be in ops")
+	}
+
+	if id.InGroup("host") || (Identity{Name: "bob"}).InGroup("host") {
+		t.Fatal("expected no membership of host")
+	}
+}
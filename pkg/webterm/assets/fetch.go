@@ -0,0 +1,141 @@
+//go:build ignore
+
+// fetch vendors the pinned xterm.js release into this directory, run by go generate ./pkg/webterm
+// tarballs are verified against the integrity of the npm registry before anything is written
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var packages = []struct {
+	name    string
+	version string
+
+	// files maps paths in the tarball to names in this directory
+	files map[string]string
+}{
+	{
+		name:    "@xterm/xterm",
+		version: "5.5.0",
+		files: map[string]string{
+			"package/lib/xterm.js":  "xterm.js",
+			"package/css/xterm.css": "xterm.css",
+			"package/LICENSE":       "xterm.LICENSE",
+		},
+	},
+	{
+		name:    "@xterm/addon-fit",
+		version: "0.10.0",
+		files: map[string]string{
+			"package/lib/addon-fit.js": "addon-fit.js",
+			"package/LICENSE":          "addon-fit.LICENSE",
+		},
+	},
+}
+
+func main() {
+	dir := "assets"
+	if len(os.Args) > 1 {
+		dir = os.Args[1]
+	}
+
+	for _, p := range packages {
+		if err := fetch(dir, p.name, p.version, p.files); err != nil {
+			log.Fatalf("%v@%v: %v", p.name, p.version, err)
+		}
+	}
+}
+
+func get(url string) ([]byte, error) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("get %v: %v", url, resp.Status)
+	}
+
+	return io.ReadAll(resp.Body)
+}
+
+func fetch(dir, name, version string, files map[string]string) error {
+	meta, err := get(fmt.Sprintf("https://registry.npmjs.org/%v/%v", name, version))
+	if err != nil {
+		return err
+	}
+
+	var pkg struct {
+		Dist struct {
+			Tarball   string `json:"tarball"`
+			Integrity string `json:"integrity"`
+		} `json:"dist"`
+	}
+
+	if err := json.Unmarshal(meta, &pkg); err != nil {
+		return err
+	}
+
+	tarball, err := get(pkg.Dist.Tarball)
+	if err != nil {
+		return err
+	}
+
+	sum := sha512.Sum512(tarball)
+	if integrity := "sha512-" + base64.StdEncoding.EncodeToString(sum[:]); integrity != pkg.Dist.Integrity {
+		return fmt.Errorf("tarball integrity %v does not match the registry %v", integrity, pkg.Dist.Integrity)
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(tarball))
+	if err != nil {
+		return err
+	}
+
+	tr := tar.NewReader(gz)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		out, ok := files[h.Name]
+		if !ok {
+			continue
+		}
+
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return err
+		}
+
+		if err := os.WriteFile(filepath.Join(dir, out), data, 0o644); err != nil {
+			return err
+		}
+
+		log.Printf("%v@%v %v -> %v", name, version, strings.TrimPrefix(h.Name, "package/"), out)
+		delete(files, h.Name)
+	}
+
+	for f := range files {
+		return fmt.Errorf("%v is not in the tarball", f)
+	}
+
+	return nil
+}
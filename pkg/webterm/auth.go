@@ -0,0 +1,196 @@
+package webterm
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const bearerProtocolPrefix = "bearer."
+
+// Authenticator validates the bearer token of a request and returns the user name
+type Authenticator interface {
+	Authenticate(ctx context.Context, token string) (string, error)
+}
+
+// bearerToken extracts token from Authorization header or from websocket subprotocol "bearer.<token>"
+func bearerToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+
+	for _, p := range strings.Split(r.Header.Get("Sec-WebSocket-Protocol"), ",") {
+		p = strings.TrimSpace(p)
+		if strings.HasPrefix(p, bearerProtocolPrefix) {
+			return strings.TrimPrefix(p, bearerProtocolPrefix)
+		}
+	}
+
+	return ""
+}
+
+type staticTokens map[string]string
+
+// StaticTokens authenticates against a fixed token to user map
+func StaticTokens(tokens map[string]string) Authenticator {
+	return staticTokens(tokens)
+}
+
+func (s staticTokens) Authenticate(_ context.Context, token string) (string, error) {
+	for t, user := range s {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			return user, nil
+		}
+	}
+
+	return "", fmt.Errorf("invalid token")
+}
+
+// LoadTokenFile reads a token file, one "token user" pair per line, # starts a comment
+func LoadTokenFile(path string) (Authenticator, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tokens := make(map[string]string)
+
+	scanner := bufio.NewScanner(f)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%v:%v: expected \"token user\"", path, lineno)
+		}
+
+		tokens[fields[0]] = fields[1]
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return StaticTokens(tokens), nil
+}
+
+type oidc struct {
+	userinfo  string
+	claim     string
+	client    *http.Client
+	cache     map[string]oidcCacheEntry
+	cacheLock sync.Mutex
+}
+
+type oidcCacheEntry struct {
+	user    string
+	expires time.Time
+}
+
+const oidcCacheTTL = time.Minute
+
+// OIDC validates access tokens by calling the userinfo endpoint of issuer
+// the user name is taken from claim, e.g. preferred_username, email or sub
+func OIDC(ctx context.Context, issuer, claim string) (Authenticator, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(issuer, "/")+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("oidc discovery for %v failed: %v", issuer, resp.Status)
+	}
+
+	discovery := struct {
+		UserinfoEndpoint string `json:"userinfo_endpoint"`
+	}{}
+
+	if err := json.NewDecoder(resp.Body).Decode(&discovery); err != nil {
+		return nil, err
+	}
+
+	if discovery.UserinfoEndpoint == "" {
+		return nil, fmt.Errorf("oidc issuer %v has no userinfo endpoint", issuer)
+	}
+
+	if claim == "" {
+		claim = "sub"
+	}
+
+	return &oidc{
+		userinfo: discovery.UserinfoEndpoint,
+		claim:    claim,
+		client:   client,
+		cache:    make(map[string]oidcCacheEntry),
+	}, nil
+}
+
+func (o *oidc) Authenticate(ctx context.Context, token string) (string, error) {
+	if token == "" {
+		return "", fmt.Errorf("missing token")
+	}
+
+	o.cacheLock.Lock()
+	e, ok := o.cache[token]
+	o.cacheLock.Unlock()
+
+	if ok && time.Now().Before(e.expires) {
+		return e.user, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, o.userinfo, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("userinfo rejected token: %v", resp.Status)
+	}
+
+	claims := make(map[string]any)
+	if err := json.NewDecoder(resp.Body).Decode(&claims); err != nil {
+		return "", err
+	}
+
+	user, _ := claims[o.claim].(string)
+	if user == "" {
+		return "", fmt.Errorf("userinfo has no claim %v", o.claim)
+	}
+
+	o.cacheLock.Lock()
+	for t, e := range o.cache {
+		if time.Now().After(e.expires) {
+			delete(o.cache, t)
+		}
+	}
+	o.cache[token] = oidcCacheEntry{user: user, expires: time.Now().Add(oidcCacheTTL)}
+	o.cacheLock.Unlock()
+
+	return user, nil
+}
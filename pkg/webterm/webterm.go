@@ -0,0 +1,337 @@
+package webterm
+
+import (
+	"context"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+	"github.com/tg123/docker-sshd/pkg/bridge"
+)
+
+//go:generate go run ./assets/fetch.go
+
+//go:embed index.html
+var indexHtml []byte
+
+// vendored is the xterm.js release written by go generate, the page loads nothing from other origins
+//
+//go:embed assets
+var vendored embed.FS
+
+// assetFiles are served under /assets/ for the page
+var assetFiles = map[string]string{
+	"xterm.js":     "text/javascript; charset=utf-8",
+	"xterm.css":    "text/css; charset=utf-8",
+	"addon-fit.js": "text/javascript; charset=utf-8",
+}
+
+type Config struct {
+	DefaultCmd    string
+	Authenticator Authenticator
+
+	// ReadOnly drops all input from browsers, otherwise only sessions opened with readonly=1 are read-only
+	ReadOnly bool
+
+	// NewProvider creates the provider for user connecting to target, same as the ssh username
+	// ctx is the context of the request, cancelled when the browser goes away
+	NewProvider func(ctx context.Context, user, target string) (bridge.SessionProvider, error)
+
+	// Assets holds the files of assetFiles, the vendored copy if nil
+	Assets fs.FS
+
+	// Registry lists web sessions for the admin api next to ssh connections, optional
+	Registry *bridge.Registry
+}
+
+type Server struct {
+	config   Config
+	assets   fs.FS
+	upgrader websocket.Upgrader
+	mux      *http.ServeMux
+}
+
+// message is sent by the browser as websocket text frame
+type message struct {
+	Type string `json:"type"`
+	Data string `json:"data,omitempty"`
+	Cols uint   `json:"cols,omitempty"`
+	Rows uint   `json:"rows,omitempty"`
+}
+
+func New(config Config) (*Server, error) {
+	if config.Authenticator == nil {
+		return nil, fmt.Errorf("web terminal requires an authenticator")
+	}
+
+	if config.NewProvider == nil {
+		return nil, fmt.Errorf("web terminal requires a provider")
+	}
+
+	assets := config.Assets
+	if assets == nil {
+		assets, _ = fs.Sub(vendored, "assets")
+	}
+
+	for name := range assetFiles {
+		if _, err := fs.Stat(assets, name); err != nil {
+			return nil, fmt.Errorf("web terminal asset %v is missing, run go generate ./pkg/webterm: %w", name, err)
+		}
+	}
+
+	s := &Server{
+		config: config,
+		assets: assets,
+		upgrader: websocket.Upgrader{
+			Subprotocols: []string{"webterm"},
+		},
+		mux: http.NewServeMux(),
+	}
+
+	s.mux.HandleFunc("/", s.handleIndex)
+	s.mux.HandleFunc("/ws", s.handleWebsocket)
+	s.mux.HandleFunc("/assets/", s.handleAsset)
+
+	return s, nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+func (s *Server) handleIndex(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, _ = w.Write(indexHtml)
+}
+
+func (s *Server) handleAsset(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/assets/")
+
+	contentType, ok := assetFiles[name]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	data, err := fs.ReadFile(s.assets, name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	_, _ = w.Write(data)
+}
+
+func (s *Server) handleWebsocket(w http.ResponseWriter, r *http.Request) {
+	user, err := s.config.Authenticator.Authenticate(r.Context(), bearerToken(r))
+	if err != nil {
+		log.Warnf("web terminal authentication from %v failed: %v", r.RemoteAddr, err)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	q := r.URL.Query()
+	target := q.Get("target")
+	if target == "" {
+		http.Error(w, "target is required", http.StatusBadRequest)
+		return
+	}
+
+	// an abandoned page load stops creating the provider, e.g. pulling a sandbox image
+	provider, err := s.config.NewProvider(r.Context(), user, target)
+	if err != nil {
+		log.Warnf("web terminal user [%v] failed to create provider for [%v]: %v", user, target, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	defer provider.Close()
+
+	ws, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Warnf("websocket upgrade from %v failed: %v", r.RemoteAddr, err)
+		return
+	}
+	defer ws.Close()
+
+	cols, _ := strconv.ParseUint(q.Get("cols"), 10, 32)
+	rows, _ := strconv.ParseUint(q.Get("rows"), 10, 32)
+
+	t := &terminal{
+		ws:       ws,
+		session:  provider.NewSession(),
+		readOnly: s.config.ReadOnly || q.Get("readonly") == "1",
+	}
+
+	if s.config.Registry != nil {
+		t.conn = &bridge.Conn{
+			User:       user,
+			RemoteAddr: r.RemoteAddr,
+			Target:     target,
+			Provider:   provider,
+			Close:      ws.Close,
+			Terminal:   t,
+		}
+
+		s.config.Registry.Register(t.conn)
+		defer s.config.Registry.Unregister(t.conn)
+
+		t.conn.AddCommand(s.config.DefaultCmd)
+	}
+
+	log.Infof("web terminal user [%v] from %v connected to [%v] readonly %v", user, r.RemoteAddr, target, t.readOnly)
+
+	exitCode, err := t.run(strings.Split(s.config.DefaultCmd, " "), uint(cols), uint(rows))
+	if err != nil {
+		log.Warnf("web terminal user [%v] session to [%v] failed: %v", user, target, err)
+		t.close(websocket.CloseInternalServerErr, err.Error())
+		return
+	}
+
+	log.Infof("web terminal user [%v] session to [%v] exit status %v", user, target, exitCode)
+	t.close(websocket.CloseNormalClosure, fmt.Sprintf("exit status %v", exitCode))
+}
+
+type terminal struct {
+	ws        *websocket.Conn
+	writeLock sync.Mutex
+
+	session  bridge.Session
+	readOnly bool
+
+	// conn is the entry of the admin api, nil without registry
+	conn *bridge.Conn
+}
+
+func (t *terminal) Write(p []byte) (int, error) {
+	t.writeLock.Lock()
+	defer t.writeLock.Unlock()
+
+	if err := t.ws.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+func (t *terminal) close(code int, reason string) {
+	t.writeLock.Lock()
+	defer t.writeLock.Unlock()
+
+	_ = t.ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason))
+}
+
+// run follows the same order as ssh sessions, initial size goes to provider before exec
+func (t *terminal) run(cmd []string, cols, rows uint) (int, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if cols > 0 && rows > 0 {
+		if err := t.session.Resize(ctx, bridge.ResizeOptions{Width: cols, Height: rows}); err != nil {
+			return 0, err
+		}
+	}
+
+	stdin, stdinWriter := io.Pipe()
+	defer stdinWriter.Close()
+
+	var input io.Reader = stdin
+	var output io.Writer = t
+	if t.conn != nil {
+		input = t.conn.CountInput(input)
+		output = t.conn.CountOutput(output)
+	}
+
+	r, err := t.session.Exec(ctx, bridge.ExecConfig{
+		Input:  input,
+		Output: output,
+		Cmd:    cmd,
+		Tty:    true,
+		Shell:  true, // the default command, like a shell request of ssh
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	go func() {
+		// the browser is gone, the command is stopped
+		defer cancel()
+		defer stdinWriter.Close()
+
+		for {
+			var msg message
+			if err := t.ws.ReadJSON(&msg); err != nil {
+				if _, ok := err.(*json.SyntaxError); ok {
+					continue
+				}
+				return
+			}
+
+			switch msg.Type {
+			case "input":
+				if t.readOnly {
+					continue
+				}
+
+				if _, err := stdinWriter.Write([]byte(msg.Data)); err != nil {
+					return
+				}
+			case "resize":
+				if msg.Cols == 0 || msg.Rows == 0 {
+					continue
+				}
+
+				if err := t.session.Resize(ctx, bridge.ResizeOptions{Width: msg.Cols, Height: msg.Rows}); err != nil {
+					log.Warnf("web terminal resize failed: %v", err)
+				}
+			}
+		}
+	}()
+
+	select {
+	case result := <-r:
+		// the browser only sees the exit status
+		if result.Error != nil {
+			log.Warnf("web terminal exec [%v] failed: %v", strings.Join(cmd, " "), result.Error)
+		}
+
+		return result.ExitCode, nil
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+// ListenAndServe serves the web terminal at addr, tls is enabled when both certFile and keyFile are set
+// setting only one of them is an error, tokens must not fall back to plain http
+func (s *Server) ListenAndServe(addr, certFile, keyFile string) error {
+	if (certFile == "") != (keyFile == "") {
+		return fmt.Errorf("tls requires both a certificate and a key file")
+	}
+
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           s,
+		ReadHeaderTimeout: 30 * time.Second,
+	}
+
+	if certFile != "" && keyFile != "" {
+		return server.ListenAndServeTLS(certFile, keyFile)
+	}
+
+	return server.ListenAndServe()
+}
@@ -0,0 +1,356 @@
+package webterm
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/tg123/docker-sshd/pkg/bridge"
+)
+
+// testAssets stands in for the vendored xterm.js release
+var testAssets = fstest.MapFS{
+	"xterm.js":     {Data: []byte("// xterm")},
+	"xterm.css":    {Data: []byte("/* xterm */")},
+	"addon-fit.js": {Data: []byte("// fit")},
+	"fetch.go":     {Data: []byte("package main")},
+}
+
+type echoProvider struct {
+	mu          sync.Mutex
+	resizeCalls []bridge.ResizeOptions
+	execCalls   []bridge.ExecConfig
+}
+
+func (e *echoProvider) Resize(ctx context.Context, size bridge.ResizeOptions) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.resizeCalls = append(e.resizeCalls, size)
+	return nil
+}
+
+func (e *echoProvider) NewSession() bridge.Session {
+	return e
+}
+
+func (e *echoProvider) Close() error {
+	return nil
+}
+
+func (e *echoProvider) Exec(ctx context.Context, cfg bridge.ExecConfig) (<-chan bridge.ExecResult, error) {
+	e.mu.Lock()
+	e.execCalls = append(e.execCalls, cfg)
+	e.mu.Unlock()
+
+	r := make(chan bridge.ExecResult, 1)
+	go func() {
+		defer func() { r <- bridge.ExecResult{ExitCode: 3} }()
+
+		buf := make([]byte, 1024)
+		for {
+			n, err := cfg.Input.Read(buf)
+			if err != nil {
+				return
+			}
+
+			_, _ = cfg.Output.Write(buf[:n])
+
+			if string(buf[:n]) == "exit" {
+				return
+			}
+		}
+	}()
+
+	return r, nil
+}
+
+func (e *echoProvider) resizes() []bridge.ResizeOptions {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]bridge.ResizeOptions(nil), e.resizeCalls...)
+}
+
+func newTestServer(t *testing.T, provider bridge.SessionProvider, readOnly bool) *httptest.Server {
+	t.Helper()
+
+	s, err := New(Config{
+		DefaultCmd:    "/bin/sh",
+		Authenticator: StaticTokens(map[string]string{"secret": "alice"}),
+		ReadOnly:      readOnly,
+		Assets:        testAssets,
+		NewProvider: func(ctx context.Context, user, target string) (bridge.SessionProvider, error) {
+			if user != "alice" || target != "c1" {
+				t.Errorf("unexpected user %v target %v", user, target)
+			}
+			return provider, nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("New returned error: %v", err)
+	}
+
+	return httptest.NewServer(s)
+}
+
+func dialTerminal(t *testing.T, server *httptest.Server, token string) (*websocket.Conn, *http.Response, error) {
+	t.Helper()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws?target=c1&cols=80&rows=24"
+	return websocket.DefaultDialer.Dial(url, http.Header{"Sec-WebSocket-Protocol": []string{"webterm, bearer." + token}})
+}
+
+func TestWebTerminalRejectsBadToken(t *testing.T) {
+	server := newTestServer(t, &echoProvider{}, false)
+	defer server.Close()
+
+	_, resp, err := dialTerminal(t, server, "wrong")
+	if err == nil {
+		t.Fatal("expected dial to fail with bad token")
+	}
+
+	if resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %#v", resp)
+	}
+}
+
+func TestWebTerminalServesOnlyAssets(t *testing.T) {
+	server := newTestServer(t, &echoProvider{}, false)
+	defer server.Close()
+
+	for path, want := range map[string]int{
+		"/assets/xterm.js":     http.StatusOK,
+		"/assets/addon-fit.js": http.StatusOK,
+		"/assets/xterm.css":    http.StatusOK,
+		"/assets/fetch.go":     http.StatusNotFound,
+		"/assets/":             http.StatusNotFound,
+	} {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatalf("get %v returned error: %v", path, err)
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+
+		if resp.StatusCode != want {
+			t.Fatalf("get %v: expected %v, got %v", path, want, resp.StatusCode)
+		}
+	}
+
+	resp, err := http.Get(server.URL + "/")
+	if err != nil {
+		t.Fatalf("get index returned error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	index, _ := io.ReadAll(resp.Body)
+	if strings.Contains(string(index), "://") {
+		t.Fatalf("index loads from another origin:\n%s", index)
+	}
+}
+
+func TestNewRequiresAssets(t *testing.T) {
+	_, err := New(Config{
+		Authenticator: StaticTokens(map[string]string{"secret": "alice"}),
+		Assets:        fstest.MapFS{"xterm.js": {Data: []byte("// xterm")}},
+		NewProvider: func(ctx context.Context, user, target string) (bridge.SessionProvider, error) {
+			return nil, nil
+		},
+	})
+	if err == nil {
+		t.Fatal("expected New to fail without the xterm assets")
+	}
+}
+
+func TestWebTerminalSession(t *testing.T) {
+	provider := &echoProvider{}
+	server := newTestServer(t, provider, false)
+	defer server.Close()
+
+	ws, _, err := dialTerminal(t, server, "secret")
+	if err != nil {
+		t.Fatalf("dial returned error: %v", err)
+	}
+	defer ws.Close()
+
+	if got := provider.resizes(); len(got) != 1 || got[0].Width != 80 || got[0].Height != 24 {
+		t.Fatalf("expected initial resize 80x24 before exec, got %#v", got)
+	}
+
+	send := func(msg message) {
+		b, _ := json.Marshal(msg)
+		if err := ws.WriteMessage(websocket.TextMessage, b); err != nil {
+			t.Fatalf("write returned error: %v", err)
+		}
+	}
+
+	send(message{Type: "resize", Cols: 100, Rows: 30})
+	send(message{Type: "input", Data: "hello"})
+
+	_ = ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, data, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatalf("read returned error: %v", err)
+	}
+
+	if string(data) != "hello" {
+		t.Fatalf("unexpected output %q", data)
+	}
+
+	if got := provider.resizes(); len(got) != 2 || got[1].Width != 100 || got[1].Height != 30 {
+		t.Fatalf("expected resize to 100x30, got %#v", got)
+	}
+
+	send(message{Type: "input", Data: "exit"})
+
+	if _, _, err := ws.ReadMessage(); err != nil {
+		t.Fatalf("read returned error: %v", err)
+	}
+
+	_, _, err = ws.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseNormalClosure) || !strings.Contains(err.Error(), "exit status 3") {
+		t.Fatalf("expected close with exit status, got %v", err)
+	}
+}
+
+func TestWebTerminalRegistersSessions(t *testing.T) {
+	registry := bridge.NewRegistry()
+
+	s, err := New(Config{
+		DefaultCmd:    "/bin/sh",
+		Authenticator: StaticTokens(map[string]string{"secret": "alice"}),
+		Assets:        testAssets,
+		Registry:      registry,
+		NewProvider: func(ctx context.Context, user, target string) (bridge.SessionProvider, error) {
+			return &echoProvider{}, nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("New returned error: %v", err)
+	}
+
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	ws, _, err := dialTerminal(t, server, "secret")
+	if err != nil {
+		t.Fatalf("dial returned error: %v", err)
+	}
+	defer ws.Close()
+
+	deadline := time.Now().Add(time.Second)
+	for len(registry.Connections()) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected web session to be registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if conns := registry.Connections(); conns[0].User != "alice" || conns[0].Target != "c1" || conns[0].Commands[0] != "/bin/sh" {
+		t.Fatalf("unexpected connections %#v", conns)
+	}
+
+	if n := registry.Broadcast("c1", "maintenance"); n != 1 {
+		t.Fatalf("expected broadcast to reach the web session, got %v", n)
+	}
+
+	_ = ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, data, err := ws.ReadMessage(); err != nil || !strings.Contains(string(data), "[broadcast] maintenance") {
+		t.Fatalf("expected broadcast message, got %q %v", data, err)
+	}
+
+	if n := registry.KillTarget("c1"); n != 1 {
+		t.Fatalf("expected web session to be killed, got %v", n)
+	}
+
+	if _, _, err := ws.ReadMessage(); err == nil {
+		t.Fatal("expected killed web session to be closed")
+	}
+
+	deadline = time.Now().Add(time.Second)
+	for len(registry.Connections()) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected web session to be unregistered, got %#v", registry.Connections())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWebTerminalReadOnlyDropsInput(t *testing.T) {
+	provider := &echoProvider{}
+	server := newTestServer(t, provider, true)
+	defer server.Close()
+
+	ws, _, err := dialTerminal(t, server, "secret")
+	if err != nil {
+		t.Fatalf("dial returned error: %v", err)
+	}
+	defer ws.Close()
+
+	b, _ := json.Marshal(message{Type: "input", Data: "rm -rf /"})
+	_ = ws.WriteMessage(websocket.TextMessage, b)
+
+	_ = ws.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, data, err := ws.ReadMessage(); err == nil {
+		t.Fatalf("expected no output in read-only session, got %q", data)
+	}
+}
+
+func TestOIDCUserinfo(t *testing.T) {
+	var issuer *httptest.Server
+	issuer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			_ = json.NewEncoder(w).Encode(map[string]string{"userinfo_endpoint": issuer.URL + "/userinfo"})
+		case "/userinfo":
+			if r.Header.Get("Authorization") != "Bearer good" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			_ = json.NewEncoder(w).Encode(map[string]string{"sub": "123", "preferred_username": "bob"})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer issuer.Close()
+
+	auth, err := OIDC(context.Background(), issuer.URL, "preferred_username")
+	if err != nil {
+		t.Fatalf("OIDC returned error: %v", err)
+	}
+
+	user, err := auth.Authenticate(context.Background(), "good")
+	if err != nil || user != "bob" {
+		t.Fatalf("expected bob, got %v %v", user, err)
+	}
+
+	if _, err := auth.Authenticate(context.Background(), "bad"); err == nil {
+		t.Fatal("expected bad token to be rejected")
+	}
+}
+
+func TestListenAndServeRequiresCertAndKey(t *testing.T) {
+	s, err := New(Config{
+		Authenticator: StaticTokens(map[string]string{"secret": "alice"}),
+		Assets:        testAssets,
+		NewProvider: func(ctx context.Context, user, target string) (bridge.SessionProvider, error) {
+			return nil, nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("New returned error: %v", err)
+	}
+
+	for _, files := range [][2]string{{"cert.pem", ""}, {"", "key.pem"}} {
+		if err := s.ListenAndServe("127.0.0.1:0", files[0], files[1]); err == nil {
+			t.Fatalf("expected error for certificate %q and key %q", files[0], files[1])
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package wsconn
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+var _ net.Conn = (*conn)(nil)
+var _ net.Listener = (*Listener)(nil)
+
+// conn adapts a websocket connection to net.Conn, ssh bytes are carried in binary messages
+type conn struct {
+	ws *websocket.Conn
+
+	reader   io.Reader
+	readLock sync.Mutex
+
+	writeLock sync.Mutex
+}
+
+// NewConn wraps a websocket connection as net.Conn
+func NewConn(ws *websocket.Conn) net.Conn {
+	return &conn{ws: ws}
+}
+
+func (c *conn) Read(p []byte) (int, error) {
+	c.readLock.Lock()
+	defer c.readLock.Unlock()
+
+	for {
+		if c.reader == nil {
+			t, r, err := c.ws.NextReader()
+			if err != nil {
+				if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+					return 0, io.EOF
+				}
+				return 0, err
+			}
+
+			if t != websocket.BinaryMessage && t != websocket.TextMessage {
+				continue
+			}
+
+			c.reader = r
+		}
+
+		n, err := c.reader.Read(p)
+		if err == io.EOF {
+			c.reader = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+
+		return n, err
+	}
+}
+
+func (c *conn) Write(p []byte) (int, error) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	if err := c.ws.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+func (c *conn) Close() error {
+	c.writeLock.Lock()
+	_ = c.ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	c.writeLock.Unlock()
+
+	return c.ws.Close()
+}
+
+func (c *conn) LocalAddr() net.Addr {
+	return c.ws.LocalAddr()
+}
+
+func (c *conn) RemoteAddr() net.Addr {
+	return c.ws.RemoteAddr()
+}
+
+func (c *conn) SetDeadline(t time.Time) error {
+	if err := c.ws.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.ws.SetWriteDeadline(t)
+}
+
+func (c *conn) SetReadDeadline(t time.Time) error {
+	return c.ws.SetReadDeadline(t)
+}
+
+func (c *conn) SetWriteDeadline(t time.Time) error {
+	return c.ws.SetWriteDeadline(t)
+}
+
+// Listener is a net.Listener fed by websocket upgrades, it is also the http.Handler doing the upgrade
+type Listener struct {
+	addr     net.Addr
+	upgrader websocket.Upgrader
+
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewListener creates a Listener, addr is reported by Addr()
+func NewListener(addr net.Addr) *Listener {
+	return &Listener{
+		addr: addr,
+		upgrader: websocket.Upgrader{
+			// ssh clients such as websocat do not send Origin, the ssh handshake does the authentication
+			CheckOrigin: func(r *http.Request) bool { return true },
+		},
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+func (l *Listener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ws, err := l.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Warnf("websocket upgrade from %v failed: %v", r.RemoteAddr, err)
+		return
+	}
+
+	c := NewConn(ws)
+
+	select {
+	case l.conns <- c:
+	case <-l.done:
+		_ = c.Close()
+	}
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *Listener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *Listener) Addr() net.Addr {
+	return l.addr
+}
+
+// Listen starts a http server at addr and upgrades requests to path into ssh connections
+// tls is enabled when both certFile and keyFile are set, setting only one of them is an error
+func Listen(addr, path, certFile, keyFile string) (net.Listener, error) {
+	if (certFile == "") != (keyFile == "") {
+		return nil, fmt.Errorf("tls requires both a certificate and a key file")
+	}
+
+	tcp, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	l := NewListener(tcp.Addr())
+
+	mux := http.NewServeMux()
+	mux.Handle(path, l)
+
+	server := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 30 * time.Second,
+	}
+
+	go func() {
+		var err error
+		if certFile != "" && keyFile != "" {
+			err = server.ServeTLS(tcp, certFile, keyFile)
+		} else {
+			err = server.Serve(tcp)
+		}
+
+		if err != nil && err != http.ErrServerClosed {
+			log.Errorf("websocket server at %v stopped: %v", addr, err)
+		}
+
+		_ = l.Close()
+	}()
+
+	go func() {
+		<-l.done
+		_ = server.Shutdown(context.Background())
+	}()
+
+	return l, nil
+}
+
+// Dial connects to a websocket ssh endpoint, url is ws:// or wss://
+func Dial(ctx context.Context, url string, header http.Header) (net.Conn, error) {
+	ws, resp, err := websocket.DefaultDialer.DialContext(ctx, url, header)
+	if err != nil {
+		if resp != nil {
+			return nil, fmt.Errorf("websocket dial %v failed: %v (%v)", url, err, resp.Status)
+		}
+		return nil, err
+	}
+
+	return NewConn(ws), nil
+}
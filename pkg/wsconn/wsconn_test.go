@@ -0,0 +1,73 @@
+package wsconn
+
+import (
+	"context"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestListenerRoundTrip(t *testing.T) {
+	l := NewListener(nil)
+	defer l.Close()
+
+	server := httptest.NewServer(l)
+	defer server.Close()
+
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		_, _ = io.Copy(c, c)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	c, err := Dial(ctx, "ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial returned error: %v", err)
+	}
+	defer c.Close()
+
+	if _, err := c.Write([]byte("SSH-2.0-")); err != nil {
+		t.Fatalf("write returned error: %v", err)
+	}
+
+	if _, err := c.Write([]byte("test\r\n")); err != nil {
+		t.Fatalf("write returned error: %v", err)
+	}
+
+	_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	buf := make([]byte, 14)
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Fatalf("read returned error: %v", err)
+	}
+
+	if string(buf) != "SSH-2.0-test\r\n" {
+		t.Fatalf("unexpected echo: %q", buf)
+	}
+}
+
+func TestListenerAcceptAfterClose(t *testing.T) {
+	l := NewListener(nil)
+	_ = l.Close()
+
+	if _, err := l.Accept(); err == nil {
+		t.Fatal("expected error when accepting on closed listener")
+	}
+}
+
+func TestListenRequiresCertAndKey(t *testing.T) {
+	for _, files := range [][2]string{{"cert.pem", ""}, {"", "key.pem"}} {
+		if l, err := Listen("127.0.0.1:0", "/ssh", files[0], files[1]); err == nil {
+			_ = l.Close()
+			t.Fatalf("expected error for certificate %q and key %q", files[0], files[1])
+		}
+	}
+}